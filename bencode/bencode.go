@@ -2,8 +2,10 @@ package bencode
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"io"
+	"sort"
 )
 
 var (
@@ -59,6 +61,28 @@ func (o *BObject) Dict() (map[string]*BObject, error) {
 	return o.val_.(map[string]*BObject), nil
 }
 
+// Native converts the object to plain Go values:
+// string, int, []interface{} and map[string]interface{}
+func (o *BObject) Native() interface{} {
+	switch o.type_ {
+	case BLIST:
+		list, _ := o.List()
+		res := make([]interface{}, len(list))
+		for i, elem := range list {
+			res[i] = elem.Native()
+		}
+		return res
+	case BDICT:
+		dict, _ := o.Dict()
+		res := make(map[string]interface{}, len(dict))
+		for k, v := range dict {
+			res[k] = v.Native()
+		}
+		return res
+	}
+	return o.val_
+}
+
 func EncodeString(w io.Writer, val string) int {
 	// abc -> 3:abc
 	strLen := len(val)
@@ -89,9 +113,16 @@ func DecodeString(r io.Reader) (val string, err error) {
 	if b != ':' {
 		return val, ErrCol
 	}
-	buf := make([]byte, num) // make a buffer with length 'num'
-	_, err = io.ReadAtLeast(br, buf, num)
-	val =string(buf)
+	if num < 0 {
+		return val, ErrNum
+	}
+	// grow the buffer with the data actually read, 'num' comes from the input
+	buf := new(bytes.Buffer)
+	_, err = io.CopyN(buf, br, int64(num))
+	if err != nil {
+		return val, err
+	}
+	val = buf.String()
 	return
 }
 
@@ -193,9 +224,14 @@ func (o *BObject) Bencode(w io.Writer) int {
 	case BDICT:
 		bw.WriteByte('d')
 		dict, _ := o.Dict()
-		for k, v := range dict{
+		keys := make([]string, 0, len(dict))
+		for k := range dict {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // keys of a dict are sorted
+		for _, k := range keys {
 			wLen += EncodeString(bw, k)
-			wLen += v.Bencode(bw)
+			wLen += dict[k].Bencode(bw)
 		}
 		bw.WriteByte('e')
 		wLen += 2
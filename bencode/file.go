@@ -0,0 +1,29 @@
+package bencode
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile marshals s into the file at path, replacing it atomically so a
+// crash never leaves half of it
+func WriteFile(path string, s interface{}) error {
+	buf := new(bytes.Buffer)
+	Marshal(buf, s)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,44 @@
+package bencode
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	type state struct {
+		Name  string `bencode:"name"`
+		Count int    `bencode:"count"`
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+	for _, count := range []int{1, 2} {
+		err := WriteFile(path, &state{"x", count})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got state
+	err = Unmarshal(f, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (state{"x", 2}) {
+		t.Errorf("read back %+v", got)
+	}
+	// no temporary file is left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files in the directory", len(entries))
+	}
+
+	if WriteFile(filepath.Join(dir, "missing", "state"), &state{}) == nil {
+		t.Error("write to a missing directory succeeded")
+	}
+}
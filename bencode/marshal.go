@@ -4,9 +4,21 @@ import (
 	"errors"
 	"io"
 	"reflect"
+	"sort"
 	"strings"
 )
 
+// tagKey returns the dict key of a struct field, `bencode:"key,omitempty"`
+// skips the field when marshaling its zero value
+func tagKey(ft reflect.StructField) (key string, omitEmpty bool) {
+	tag := ft.Tag.Get("bencode")
+	key, opt, _ := strings.Cut(tag, ",")
+	if key == "" {
+		key = strings.ToLower(ft.Name)
+	}
+	return key, opt == "omitempty"
+}
+
 // reflect: type interface{}; value {e.typ, e.word, flag}
 func unmarshalList(p reflect.Value, list []*BObject) error {
 	// check if the p is a pointer and ensure the value is addressable
@@ -18,6 +30,16 @@ func unmarshalList(p reflect.Value, list []*BObject) error {
 	if len(list) == 0 {
 		return nil
 	}
+	// mixed lists, e.g. [code, message] of a KRPC error
+	if k := v.Type().Elem().Kind(); k == reflect.Interface || k == reflect.Map {
+		for i, o := range list {
+			err := unmarshalValue(v.Index(i), o)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	switch list[0].type_ {
 	case BSTR:
 		for i, o := range list {
@@ -90,14 +112,15 @@ func unmarshalDict(p reflect.Value, dict map[string]*BObject) error {
 		}
 		ft := v.Type().Field(i)
 		// accesses to the metadata of the i-th field, which contains multiple attributes
-		key := ft.Tag.Get("bencode") // check the Tag first, otherwise make sure the key in struct is public
-		if key == "" {
-			key = strings.ToLower(ft.Name)
-		}
+		key, _ := tagKey(ft) // check the Tag first, otherwise make sure the key in struct is public
 		fo := dict[key] // *BObject
 		if fo == nil {
 			continue
 		}
+		if ft.Type.Kind() == reflect.Interface {
+			unmarshalValue(fv, fo)
+			continue
+		}
 		//  to provide the data that will be assigned to the struct's field
 		switch fo.type_ {
 		case BSTR:
@@ -127,6 +150,10 @@ func unmarshalDict(p reflect.Value, dict map[string]*BObject) error {
 			}
 			fv.Set(lp.Elem())
 		case BDICT:
+			if ft.Type.Kind() == reflect.Map {
+				unmarshalValue(fv, fo)
+				break
+			}
 			if ft.Type.Kind() != reflect.Struct {
 				break
 			}
@@ -142,6 +169,72 @@ func unmarshalDict(p reflect.Value, dict map[string]*BObject) error {
 	return nil
 }
 
+// unmarshalValue sets v from o when the type of v is only known at runtime,
+// i.e. map values and interfaces
+func unmarshalValue(v reflect.Value, o *BObject) error {
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return ErrTyp
+		}
+		v.Set(reflect.ValueOf(o.Native()))
+		return nil
+	}
+	switch o.type_ {
+	case BSTR:
+		if v.Kind() != reflect.String {
+			return ErrTyp
+		}
+		val, _ := o.Str()
+		v.SetString(val)
+	case BINT:
+		if v.Kind() != reflect.Int {
+			return ErrTyp
+		}
+		val, _ := o.Int()
+		v.SetInt(int64(val))
+	case BLIST:
+		if v.Kind() != reflect.Slice {
+			return ErrTyp
+		}
+		list, _ := o.List()
+		lp := reflect.New(v.Type())
+		lp.Elem().Set(reflect.MakeSlice(v.Type(), len(list), len(list)))
+		err := unmarshalList(lp, list)
+		if err != nil {
+			return err
+		}
+		v.Set(lp.Elem())
+	case BDICT:
+		dict, _ := o.Dict()
+		switch v.Kind() {
+		case reflect.Struct:
+			dp := reflect.New(v.Type())
+			err := unmarshalDict(dp, dict)
+			if err != nil {
+				return err
+			}
+			v.Set(dp.Elem())
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return ErrTyp
+			}
+			m := reflect.MakeMapWithSize(v.Type(), len(dict))
+			for key, eo := range dict {
+				ev := reflect.New(v.Type().Elem()).Elem()
+				// entries of an unexpected type are skipped, like struct fields
+				if unmarshalValue(ev, eo) != nil {
+					continue
+				}
+				m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), ev)
+			}
+			v.Set(m)
+		default:
+			return ErrTyp
+		}
+	}
+	return nil
+}
+
 func Unmarshal(r io.Reader, s interface{}) error {
 	o, err := Parse(r)
 	if err != nil {
@@ -186,6 +279,12 @@ func marshalValue(w io.Writer, v reflect.Value) int {
 		len += marshalList(w, v)
 	case reflect.Struct:
 		len += marshalDict(w, v)
+	case reflect.Map:
+		len += marshalMap(w, v)
+	case reflect.Interface, reflect.Ptr:
+		if !v.IsNil() {
+			len += marshalValue(w, v.Elem())
+		}
 	}
 	return len
 }
@@ -203,23 +302,55 @@ func marshalList(w io.Writer, v reflect.Value) int {
 	return len
 }
 
-// d -- e
-func marshalDict(w io.Writer, v reflect.Value) int {
+type dictEntry struct {
+	key string
+	val reflect.Value
+}
+
+// d -- e, keys must be sorted or the info hash would not match
+func writeDict(w io.Writer, entries []dictEntry) int {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
 	len := 2
-	w.Write([]byte{'l'})
+	w.Write([]byte{'d'})
+	for _, e := range entries {
+		// marshal the nested elements
+		len += EncodeString(w, e.key)
+		len += marshalValue(w, e.val)
+	}
+	w.Write([]byte{'e'})
+	return len
+}
+
+func marshalDict(w io.Writer, v reflect.Value) int {
+	var entries []dictEntry
 	for i := 0; i < v.NumField(); i++ {
 		fv := v.Field(i)
 		ft := v.Type().Field(i)
-		key := ft.Tag.Get("bencode")
-		if key == "" {
-			key = strings.ToLower(ft.Name)
+		if !ft.IsExported() {
+			continue
 		}
-		// marshal the nested elements
-		len += EncodeString(w, key)
-		len += marshalValue(w, fv)
+		key, omitEmpty := tagKey(ft)
+		if omitEmpty && fv.IsZero() {
+			continue
+		}
+		// a nil value has no bencode form
+		if k := fv.Kind(); (k == reflect.Interface || k == reflect.Ptr) && fv.IsNil() {
+			continue
+		}
+		entries = append(entries, dictEntry{key, fv})
 	}
-	w.Write([]byte{'e'})
-	return len
+	return writeDict(w, entries)
+}
+
+func marshalMap(w io.Writer, v reflect.Value) int {
+	entries := make([]dictEntry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		entries = append(entries, dictEntry{iter.Key().String(), iter.Value()})
+	}
+	return writeDict(w, entries)
 }
 
 // struct / slice -> bencode
@@ -38,7 +38,11 @@ func Parse(r io.Reader) (*BObject, error) {
 		br.ReadByte() // read and consume a single byte `l`, advancing the position
 		var list []*BObject
 		for {
-			if p, _ := br.Peek(1); p[0] == 'e' { // p is a 1-length slice of byte `[]byte`
+			p, err := br.Peek(1) // p is a 1-length slice of byte `[]byte`
+			if err != nil {
+				return nil, err
+			}
+			if p[0] == 'e' {
 				br.ReadByte()
 				break
 			}
@@ -55,7 +59,11 @@ func Parse(r io.Reader) (*BObject, error) {
 		br.ReadByte()
 		dict := make(map[string]*BObject)
 		for {
-			if p, _ := br.Peek(1); p[0] == 'e' {
+			p, err := br.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if p[0] == 'e' {
 				br.ReadByte()
 				break
 			}
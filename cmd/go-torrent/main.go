@@ -0,0 +1,37 @@
+// Command go-torrent works with torrents from the command line.
+//
+//	go-torrent verify file.torrent --dir path
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: go-torrent <command> [arguments]
+
+commands:
+  verify file.torrent --dir path   check the data of a torrent against its piece hashes
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "verify":
+		err = verify(os.Args[2:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "go-torrent: "+err.Error())
+		os.Exit(exitCode(err))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go-torrent/torrent"
+	"os"
+	"path/filepath"
+)
+
+// errDamaged makes verify exit with 1, other errors exit with 2
+var errDamaged = errors.New("some pieces are missing or corrupt")
+
+func exitCode(err error) int {
+	if errors.Is(err, errDamaged) {
+		return 1
+	}
+	return 2
+}
+
+// verifyReport is written to stdout as JSON, progress goes to stderr
+type verifyReport struct {
+	Torrent     string               `json:"torrent"`
+	InfoHash    string               `json:"info_hash"`
+	Path        string               `json:"path"`
+	Pieces      int                  `json:"pieces"`
+	ValidPieces int                  `json:"valid_pieces"`
+	BadPieces   []int                `json:"bad_pieces"`
+	Files       []torrent.FileReport `json:"files"`
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "directory holding the data of the torrent")
+	quiet := flags.Bool("quiet", false, "no progress output")
+	// flags may come before or after the torrent file
+	var files []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		files = append(files, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(files) != 1 {
+		return fmt.Errorf("verify needs one torrent file")
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		return err
+	}
+	tf, err := torrent.ParseFile(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(*dir, tf.FileName)
+	storage, err := torrent.OpenFileStorage(path, tf.PieceLen, tf.FileList())
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	progress := func(done, total int) {
+		if !*quiet && (done%100 == 0 || done == total) {
+			fmt.Fprintf(os.Stderr, "verifying, progress: %d/%d (%0.2f%%)\n", done, total, float64(done)*100/float64(total))
+		}
+	}
+	field, reports, err := torrent.VerifyProgress(tf, storage, progress)
+	if err != nil {
+		return err
+	}
+
+	report := verifyReport{
+		Torrent:   files[0],
+		InfoHash:  fmt.Sprintf("%x", tf.InfoSHA),
+		Path:      path,
+		Pieces:    len(tf.PieceSHA),
+		BadPieces: []int{},
+		Files:     reports,
+	}
+	for i := range tf.PieceSHA {
+		if field.HasPiece(i) {
+			report.ValidPieces++
+		} else {
+			report.BadPieces = append(report.BadPieces, i)
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return err
+	}
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "%d of %d pieces valid\n", report.ValidPieces, report.Pieces)
+	}
+	if report.ValidPieces < report.Pieces {
+		return errDamaged
+	}
+	return nil
+}
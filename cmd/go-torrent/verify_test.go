@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"go-torrent/bencode"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	Files       []testFile `bencode:"files"`
+	Pieces      string     `bencode:"pieces"`
+	PieceLength int        `bencode:"piece length"`
+}
+
+type testTorrent struct {
+	Announce string   `bencode:"announce"`
+	Info     testInfo `bencode:"info"`
+}
+
+// writeTorrent stores the files a, b and c of random data below dir/data
+// and returns the path of their torrent file
+func writeTorrent(t *testing.T, dir string, pieceLen int, lengths ...int) string {
+	t.Helper()
+	info := testInfo{Name: "data", PieceLength: pieceLen}
+	var data []byte
+	for i, length := range lengths {
+		name := string(rune('a' + i))
+		b := make([]byte, length)
+		rand.Read(b)
+		data = append(data, b...)
+		info.Files = append(info.Files, testFile{length, []string{name}})
+		os.MkdirAll(filepath.Join(dir, "data"), 0755)
+		if err := os.WriteFile(filepath.Join(dir, "data", name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < len(data); i += pieceLen {
+		sum := sha1.Sum(data[i:min(i+pieceLen, len(data))])
+		info.Pieces += string(sum[:])
+	}
+	buf := new(bytes.Buffer)
+	bencode.Marshal(buf, testTorrent{"http://tracker", info})
+	path := filepath.Join(dir, "data.torrent")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runVerify runs the verify command and decodes its report
+func runVerify(t *testing.T, args ...string) (verifyReport, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = verify(args)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	var report verifyReport
+	if len(out) > 0 {
+		if e := json.Unmarshal(out, &report); e != nil {
+			t.Fatalf("bad report %q: %v", out, e)
+		}
+	}
+	return report, err
+}
+
+func TestVerifyValid(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTorrent(t, dir, 1<<10, 3000, 5000)
+	report, err := runVerify(t, path, "--dir", dir, "--quiet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pieces != 8 || report.ValidPieces != 8 || len(report.BadPieces) != 0 {
+		t.Errorf("report %+v", report)
+	}
+}
+
+func TestVerifyDamaged(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTorrent(t, dir, 1<<10, 3000, 5000, 2000)
+	// piece 2 spans a and b, c is gone
+	f, err := os.OpenFile(filepath.Join(dir, "data", "a"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, 2500)
+	f.WriteAt([]byte{^b[0]}, 2500)
+	f.Close()
+	os.Remove(filepath.Join(dir, "data", "c"))
+
+	report, err := runVerify(t, "--quiet", "--dir", dir, path)
+	if exitCode(err) != 1 {
+		t.Fatalf("exit code %d for damaged data, %v", exitCode(err), err)
+	}
+	want := []int{2, 7, 8, 9}
+	if len(report.BadPieces) != len(want) {
+		t.Fatalf("bad pieces %v, want %v", report.BadPieces, want)
+	}
+	for i := range want {
+		if report.BadPieces[i] != want[i] {
+			t.Fatalf("bad pieces %v, want %v", report.BadPieces, want)
+		}
+	}
+	files := report.Files
+	if len(files) != 3 {
+		t.Fatalf("%d files in the report", len(files))
+	}
+	if len(files[0].Corrupt) != 1 || files[0].Corrupt[0].Begin != 2048 || files[0].Corrupt[0].End != 3000 {
+		t.Errorf("a corrupt %v", files[0].Corrupt)
+	}
+	if len(files[1].Corrupt) != 1 || files[1].Corrupt[0].End != 72 || len(files[1].Missing) != 0 {
+		t.Errorf("b corrupt %v, missing %v", files[1].Corrupt, files[1].Missing)
+	}
+	if len(files[2].Missing) != 1 || files[2].Missing[0].End != 2000 {
+		t.Errorf("c missing %v", files[2].Missing)
+	}
+}
+
+func TestVerifyUsage(t *testing.T) {
+	_, err := runVerify(t, "--quiet")
+	if err == nil || exitCode(err) != 2 {
+		t.Errorf("verify without a torrent: %v", err)
+	}
+	_, err = runVerify(t, filepath.Join(t.TempDir(), "none.torrent"))
+	if err == nil || exitCode(err) != 2 {
+		t.Errorf("verify of a missing torrent: %v", err)
+	}
+}
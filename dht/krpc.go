@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-torrent/bencode"
+)
+
+// KRPC: every message is a bencoded dict sent in a single UDP packet,
+// "y" tells queries ("q"), responses ("r") and errors ("e") apart
+type krpcMsg struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A krpcArgs      `bencode:"a,omitempty"`
+	R krpcResp      `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+	V string        `bencode:"v,omitempty"`
+}
+
+type krpcArgs struct {
+	Id          string   `bencode:"id"`
+	Target      string   `bencode:"target,omitempty"`
+	InfoHash    string   `bencode:"info_hash,omitempty"`
+	Port        int      `bencode:"port,omitempty"`
+	Token       string   `bencode:"token,omitempty"`
+	ImpliedPort int      `bencode:"implied_port,omitempty"`
+	Want        []string `bencode:"want,omitempty"`
+}
+
+type krpcResp struct {
+	Id     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// BEP 32: "want" asks for the nodes of one or both address families, a
+// query without it gets the family it was sent over
+const (
+	wantNodes  = "n4"
+	wantNodes6 = "n6"
+)
+
+// error codes of BEP 5
+const (
+	ErrGeneric  = 201
+	ErrServer   = 202
+	ErrProtocol = 203
+	ErrMethod   = 204
+)
+
+// KRPCError is an error message sent back by a node
+type KRPCError struct {
+	Code int
+	Msg  string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Msg)
+}
+
+var ErrTimeout = errors.New("query timed out")
+
+func encodeMsg(msg *krpcMsg) []byte {
+	buf := new(bytes.Buffer)
+	bencode.Marshal(buf, msg)
+	return buf.Bytes()
+}
+
+func decodeMsg(b []byte) (*krpcMsg, error) {
+	msg := new(krpcMsg)
+	err := bencode.Unmarshal(bytes.NewReader(b), msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.T == "" {
+		return nil, errors.New("krpc message without transaction id")
+	}
+	return msg, nil
+}
+
+// krpcErr converts the "e" list of an error message
+func krpcErr(msg *krpcMsg) error {
+	res := &KRPCError{Code: ErrGeneric, Msg: "unknown error"}
+	if len(msg.E) > 0 {
+		if code, ok := msg.E[0].(int); ok {
+			res.Code = code
+		}
+	}
+	if len(msg.E) > 1 {
+		if s, ok := msg.E[1].(string); ok {
+			res.Msg = s
+		}
+	}
+	return res
+}
+
+func parseID(s string) (ID, bool) {
+	var id ID
+	if len(s) != IDLEN {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"time"
+)
+
+const IDLEN int = 20
+
+// ID identifies a node, and an info hash lives in the same key space
+type ID [IDLEN]byte
+
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// prefixLen returns the number of leading bits id has in common with o,
+// which picks the bucket o belongs to
+func (id ID) prefixLen(o ID) int {
+	for i := 0; i < IDLEN; i++ {
+		x := id[i] ^ o[i]
+		if x == 0 {
+			continue
+		}
+		n := 0
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		return i*8 + n
+	}
+	return IDLEN * 8
+}
+
+// closer reports whether a is closer to target than b by XOR distance
+func closer(target, a, b ID) bool {
+	for i := 0; i < IDLEN; i++ {
+		da := a[i] ^ target[i]
+		db := b[i] ^ target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// Node is a contact of the routing table
+type Node struct {
+	Id       ID
+	Addr     netip.AddrPort
+	lastSeen time.Time
+	fails    int
+}
+
+// good nodes answered recently, questionable ones are pinged before they are
+// replaced and bad ones are replaced right away
+func (n *Node) good() bool {
+	return n.fails == 0 && time.Since(n.lastSeen) < BucketRefresh
+}
+
+func (n *Node) bad() bool {
+	return n.fails >= MaxFails
+}
+
+// compact node info: 20 bytes id + 4 bytes ip + 2 bytes port, the nodes6
+// form of BEP 32 has 16 bytes ip
+const (
+	compactNodeLen  = IDLEN + 6
+	compactNode6Len = IDLEN + 18
+)
+
+// encodeNodes returns the IPv4 nodes in the nodes form
+func encodeNodes(nodes []*Node) string {
+	return encodeNodesOf(nodes, false)
+}
+
+// encodeNodes6 returns the IPv6 nodes in the nodes6 form
+func encodeNodes6(nodes []*Node) string {
+	return encodeNodesOf(nodes, true)
+}
+
+func encodeNodesOf(nodes []*Node, ipv6 bool) string {
+	buf := new(bytes.Buffer)
+	for _, n := range nodes {
+		if n.Addr.Addr().Is4() == ipv6 {
+			continue
+		}
+		buf.Write(n.Id[:])
+		buf.WriteString(encodePeer(n.Addr))
+	}
+	return buf.String()
+}
+
+func decodeNodes(s string) []*Node {
+	return decodeNodesOf(s, compactNodeLen)
+}
+
+func decodeNodes6(s string) []*Node {
+	return decodeNodesOf(s, compactNode6Len)
+}
+
+func decodeNodesOf(s string, nodeLen int) []*Node {
+	if len(s)%nodeLen != 0 {
+		return nil
+	}
+	nodes := make([]*Node, 0, len(s)/nodeLen)
+	for i := 0; i < len(s); i += nodeLen {
+		n := new(Node)
+		copy(n.Id[:], s[i:i+IDLEN])
+		addr, ok := decodePeer(s[i+IDLEN : i+nodeLen])
+		if !ok {
+			continue
+		}
+		n.Addr = addr
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// compact peer info: 4 or 16 bytes ip + 2 bytes port
+func encodePeer(addr netip.AddrPort) string {
+	ip := addr.Addr().AsSlice()
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], addr.Port())
+	return string(buf)
+}
+
+func decodePeer(s string) (netip.AddrPort, bool) {
+	if len(s) != 6 && len(s) != 18 {
+		return netip.AddrPort{}, false
+	}
+	ip, _ := netip.AddrFromSlice([]byte(s[:len(s)-2]))
+	port := binary.BigEndian.Uint16([]byte(s[len(s)-2:]))
+	if port == 0 {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip.Unmap(), port), true
+}
@@ -0,0 +1,745 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultAddr = ":6881"
+
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+const (
+	Alpha            = 3 // queries in flight during a lookup
+	QueryTimeout     = 3 * time.Second
+	TokenRotate      = 5 * time.Minute
+	PeerExpire       = 30 * time.Minute
+	SaveInterval     = 5 * time.Minute
+	MaxValues        = 50   // peers returned by get_peers, to fit in one packet
+	MaxPeers         = 500  // peers stored per info hash, the oldest is dropped
+	MaxInfoHashes    = 5000 // info hashes we store peers of, the least recently announced is dropped
+	maintainInterval = time.Minute
+)
+
+type Config struct {
+	Addr           string         // UDP address to listen on, DefaultAddr if empty
+	Conn           net.PacketConn // optional, a socket shared with other protocols, Addr is then ignored
+	Id             ID             // optional, restored from StateFile or random if zero
+	BootstrapNodes []string       // host:port, DefaultBootstrapNodes if nil, empty for a private network
+	StateFile      string         // optional, the routing table is restored from and saved to this file
+	QueryTimeout   time.Duration  // QueryTimeout if zero
+}
+
+type pendingQuery struct {
+	addr netip.AddrPort
+	ch   chan *krpcMsg
+}
+
+// Server is a node of the mainline DHT (BEP 5)
+type Server struct {
+	cfg       Config
+	conn      net.PacketConn
+	ownConn   bool
+	id        ID
+	table     *table
+	mu        sync.Mutex
+	tid       uint16
+	pending   map[string]*pendingQuery
+	pinging   map[netip.AddrPort]bool
+	secret    [16]byte
+	oldSecret [16]byte
+	rotatedAt time.Time
+	peers     map[ID]*peerStore
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func New(cfg Config) (*Server, error) {
+	if cfg.BootstrapNodes == nil {
+		cfg.BootstrapNodes = DefaultBootstrapNodes
+	}
+	if cfg.QueryTimeout == 0 {
+		cfg.QueryTimeout = QueryTimeout
+	}
+	s := &Server{
+		cfg:       cfg,
+		conn:      cfg.Conn,
+		id:        cfg.Id,
+		pending:   make(map[string]*pendingQuery),
+		pinging:   make(map[netip.AddrPort]bool),
+		peers:     make(map[ID]*peerStore),
+		rotatedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	rand.Read(s.secret[:])
+	s.oldSecret = s.secret
+
+	var saved []*Node
+	if cfg.StateFile != "" {
+		st, err := loadState(cfg.StateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("fail to load dht state, " + err.Error())
+		} else if err == nil {
+			if s.id == (ID{}) {
+				s.id = st.id
+			}
+			saved = st.nodes
+		}
+	}
+	if s.id == (ID{}) {
+		s.id = RandomID()
+	}
+	s.table = newTable(s.id)
+	for _, n := range saved {
+		s.table.insert(n.Id, n.Addr)
+	}
+
+	if s.conn == nil {
+		addr := cfg.Addr
+		if addr == "" {
+			addr = DefaultAddr
+		}
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			fmt.Println("fail to listen on udp: " + addr)
+			return nil, err
+		}
+		s.conn = conn
+		s.ownConn = true
+	}
+	go s.readLoop()
+	go s.maintain()
+	return s, nil
+}
+
+func (s *Server) ID() ID {
+	return s.id
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Nodes returns the contacts of the routing table
+func (s *Server) Nodes() []*Node {
+	return s.table.nodes()
+}
+
+// Close stops the node and saves its routing table
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.cfg.StateFile != "" {
+			err = s.Save()
+		}
+		if s.ownConn {
+			s.conn.Close()
+		}
+	})
+	return err
+}
+
+// Save writes the routing table to the state file
+func (s *Server) Save() error {
+	if s.cfg.StateFile == "" {
+		return errors.New("no state file configured")
+	}
+	return saveState(s.cfg.StateFile, s.id, s.table.nodes())
+}
+
+func toAddrPort(addr net.Addr) netip.AddrPort {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.AddrPort{}
+		}
+		udp = net.UDPAddrFromAddrPort(ap)
+	}
+	ap := udp.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+func (s *Server) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if s.closed() {
+				return
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			fmt.Println("dht read failed, " + err.Error())
+			return
+		}
+		addr := toAddrPort(from)
+		if !addr.IsValid() || addr.Port() == 0 {
+			continue
+		}
+		msg, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.Y {
+		case "q":
+			s.handleQuery(addr, msg)
+		case "r", "e":
+			s.mu.Lock()
+			p := s.pending[msg.T]
+			s.mu.Unlock()
+			if p != nil && p.addr == addr {
+				select {
+				case p.ch <- msg:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) send(addr netip.AddrPort, msg *krpcMsg) error {
+	_, err := s.conn.WriteTo(encodeMsg(msg), net.UDPAddrFromAddrPort(addr))
+	return err
+}
+
+func (s *Server) sendError(addr netip.AddrPort, t string, code int, text string) {
+	s.send(addr, &krpcMsg{T: t, Y: "e", E: []interface{}{code, text}})
+}
+
+// query sends a query and waits for its response, nodes that answer are
+// added to the routing table
+func (s *Server) query(ctx context.Context, addr netip.AddrPort, method string, args krpcArgs) (*krpcMsg, error) {
+	s.mu.Lock()
+	s.tid++
+	t := string([]byte{byte(s.tid >> 8), byte(s.tid)})
+	p := &pendingQuery{addr: addr, ch: make(chan *krpcMsg, 1)}
+	s.pending[t] = p
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, t)
+		s.mu.Unlock()
+	}()
+
+	args.Id = string(s.id[:])
+	err := s.send(addr, &krpcMsg{T: t, Y: "q", Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(s.cfg.QueryTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-p.ch:
+		if res.Y == "e" {
+			return nil, krpcErr(res)
+		}
+		id, ok := parseID(res.R.Id)
+		if !ok {
+			return nil, fmt.Errorf("invalid node id from %s", addr)
+		}
+		s.insertNode(id, addr)
+		return res, nil
+	case <-timer.C:
+		s.table.failed(addr)
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		return nil, errors.New("dht server closed")
+	}
+}
+
+// insertNode adds a node that answered us, the oldest node of a full bucket
+// is pinged and replaced if it does not answer anymore
+func (s *Server) insertNode(id ID, addr netip.AddrPort) {
+	oldest, ok := s.table.insert(id, addr)
+	if ok || oldest == nil {
+		return
+	}
+	go func() {
+		_, err := s.Ping(context.Background(), oldest.Addr)
+		if err != nil {
+			s.table.remove(oldest.Id)
+			s.table.insert(id, addr)
+		}
+	}()
+}
+
+// AddNode pings a node and adds it to the routing table if it answers, e.g.
+// for the port a peer sent in a PORT message
+func (s *Server) AddNode(addr netip.AddrPort) {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	s.mu.Lock()
+	if s.pinging[addr] {
+		s.mu.Unlock()
+		return
+	}
+	s.pinging[addr] = true
+	s.mu.Unlock()
+	go func() {
+		s.Ping(context.Background(), addr)
+		s.mu.Lock()
+		delete(s.pinging, addr)
+		s.mu.Unlock()
+	}()
+}
+
+func (s *Server) Ping(ctx context.Context, addr netip.AddrPort) (ID, error) {
+	res, err := s.query(ctx, addr, methodPing, krpcArgs{})
+	if err != nil {
+		return ID{}, err
+	}
+	id, _ := parseID(res.R.Id)
+	return id, nil
+}
+
+func (s *Server) token(ip netip.Addr, secret [16]byte) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.AsSlice())
+	return string(h.Sum(nil)[:8])
+}
+
+// validToken accepts tokens of the current and the previous secret, so a
+// token stays valid for at least TokenRotate
+func (s *Server) validToken(token string, ip netip.Addr) bool {
+	s.mu.Lock()
+	secret, old := s.secret, s.oldSecret
+	s.mu.Unlock()
+	return token == s.token(ip, secret) || token == s.token(ip, old)
+}
+
+func (s *Server) handleQuery(addr netip.AddrPort, msg *krpcMsg) {
+	id, ok := parseID(msg.A.Id)
+	if !ok {
+		s.sendError(addr, msg.T, ErrProtocol, "invalid id")
+		return
+	}
+	res := krpcResp{Id: string(s.id[:])}
+	switch msg.Q {
+	case methodPing:
+	case methodFindNode:
+		target, ok := parseID(msg.A.Target)
+		if !ok {
+			s.sendError(addr, msg.T, ErrProtocol, "invalid target")
+			return
+		}
+		res.Nodes, res.Nodes6 = s.wantedNodes(addr, msg.A.Want, target)
+	case methodGetPeers:
+		infoHash, ok := parseID(msg.A.InfoHash)
+		if !ok {
+			s.sendError(addr, msg.T, ErrProtocol, "invalid info_hash")
+			return
+		}
+		s.mu.Lock()
+		res.Token = s.token(addr.Addr(), s.secret)
+		s.mu.Unlock()
+		want4, want6 := wants(addr, msg.A.Want)
+		for _, peer := range s.storedPeers(infoHash) {
+			if peer.Addr().Is4() && want4 || !peer.Addr().Is4() && want6 {
+				res.Values = append(res.Values, encodePeer(peer))
+			}
+		}
+		if len(res.Values) == 0 {
+			res.Nodes, res.Nodes6 = s.wantedNodes(addr, msg.A.Want, infoHash)
+		}
+	case methodAnnouncePeer:
+		infoHash, ok := parseID(msg.A.InfoHash)
+		if !ok {
+			s.sendError(addr, msg.T, ErrProtocol, "invalid info_hash")
+			return
+		}
+		if !s.validToken(msg.A.Token, addr.Addr()) {
+			s.sendError(addr, msg.T, ErrProtocol, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = int(addr.Port())
+		}
+		if port <= 0 || port > 65535 {
+			s.sendError(addr, msg.T, ErrProtocol, "invalid port")
+			return
+		}
+		s.storePeer(infoHash, netip.AddrPortFrom(addr.Addr(), uint16(port)))
+	default:
+		s.sendError(addr, msg.T, ErrMethod, "method unknown")
+		return
+	}
+	s.send(addr, &krpcMsg{T: msg.T, Y: "r", R: res})
+
+	// a node that queries us is only added once it answers a query of ours
+	if !s.table.has(id) {
+		s.AddNode(addr)
+	}
+}
+
+// wants returns the address families a query asks for
+func wants(addr netip.AddrPort, want []string) (bool, bool) {
+	if len(want) == 0 {
+		return addr.Addr().Is4(), !addr.Addr().Is4()
+	}
+	var want4, want6 bool
+	for _, w := range want {
+		switch w {
+		case wantNodes:
+			want4 = true
+		case wantNodes6:
+			want6 = true
+		}
+	}
+	return want4, want6
+}
+
+// wantedNodes returns the closest nodes to target in the nodes and nodes6 forms
+func (s *Server) wantedNodes(addr netip.AddrPort, want []string, target ID) (string, string) {
+	want4, want6 := wants(addr, want)
+	var nodes, nodes6 string
+	if want4 {
+		nodes = encodeNodes(s.table.closestOf(target, K, false))
+	}
+	if want6 {
+		nodes6 = encodeNodes6(s.table.closestOf(target, K, true))
+	}
+	return nodes, nodes6
+}
+
+// peerStore is the peers announced for an info hash
+type peerStore struct {
+	peers map[netip.AddrPort]time.Time
+	last  time.Time // the latest announce
+}
+
+// storePeer records an announce, the oldest peer or info hash makes room
+// once the store is full
+func (s *Server) storePeer(infoHash ID, peer netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	store := s.peers[infoHash]
+	if store == nil {
+		if len(s.peers) >= MaxInfoHashes {
+			var oldest ID
+			var at time.Time
+			for id, st := range s.peers {
+				if at.IsZero() || st.last.Before(at) {
+					oldest, at = id, st.last
+				}
+			}
+			delete(s.peers, oldest)
+		}
+		store = &peerStore{peers: make(map[netip.AddrPort]time.Time)}
+		s.peers[infoHash] = store
+	}
+	if _, ok := store.peers[peer]; !ok && len(store.peers) >= MaxPeers {
+		var oldest netip.AddrPort
+		var at time.Time
+		for p, t := range store.peers {
+			if at.IsZero() || t.Before(at) {
+				oldest, at = p, t
+			}
+		}
+		delete(store.peers, oldest)
+	}
+	store.peers[peer] = now
+	store.last = now
+}
+
+func (s *Server) storedPeers(infoHash ID) []netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	store := s.peers[infoHash]
+	if store == nil {
+		return nil
+	}
+	var res []netip.AddrPort
+	for peer := range store.peers {
+		if len(res) >= MaxValues {
+			break
+		}
+		res = append(res, peer)
+	}
+	return res
+}
+
+// Bootstrap joins the network through the bootstrap nodes and looks up our
+// own id to fill the routing table
+func (s *Server) Bootstrap(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, node := range s.cfg.BootstrapNodes {
+		// every address of the node, so IPv6-only hosts can join as well
+		addrs, err := resolveAll(ctx, node)
+		if err != nil {
+			fmt.Println("fail to resolve bootstrap node: " + node)
+			continue
+		}
+		for _, addr := range addrs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.query(ctx, addr, methodFindNode, krpcArgs{Target: string(s.id[:]), Want: []string{wantNodes, wantNodes6}})
+			}()
+		}
+	}
+	wg.Wait()
+	if s.table.len() == 0 {
+		return errors.New("bootstrap failed, no node answered")
+	}
+	_, err := s.lookup(ctx, s.id, false)
+	return err
+}
+
+func resolveAll(ctx context.Context, hostport string) ([]netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), uint16(p)))
+	}
+	return addrs, nil
+}
+
+type lookupResult struct {
+	nodes  []*Node // closest nodes that answered
+	tokens map[ID]string
+	peers  []netip.AddrPort
+}
+
+// lookup walks toward target, querying the closest nodes it knows Alpha at a
+// time until the K closest have all answered or failed
+func (s *Server) lookup(ctx context.Context, target ID, getPeers bool) (*lookupResult, error) {
+	if s.table.len() == 0 {
+		err := s.Bootstrap(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	method := methodFindNode
+	args := krpcArgs{Target: string(target[:])}
+	if getPeers {
+		method = methodGetPeers
+		args = krpcArgs{InfoHash: string(target[:])}
+	}
+	// nodes of both families, the ones we cannot reach simply time out
+	args.Want = []string{wantNodes, wantNodes6}
+
+	type result struct {
+		node *Node
+		msg  *krpcMsg
+		err  error
+	}
+	cands := s.table.closest(target, K)
+	seen := make(map[ID]bool)
+	for _, n := range cands {
+		seen[n.Id] = true
+	}
+	queried := make(map[ID]bool)
+	failed := make(map[ID]bool)
+	peers := make(map[netip.AddrPort]bool)
+	res := &lookupResult{tokens: make(map[ID]string)}
+	// we may be one of the closest nodes ourselves
+	if getPeers {
+		for _, peer := range s.storedPeers(target) {
+			peers[peer] = true
+			res.peers = append(res.peers, peer)
+		}
+	}
+	results := make(chan result, Alpha)
+	inflight := 0
+
+	for {
+		for inflight < Alpha {
+			var next *Node
+			window := 0
+			for _, n := range cands {
+				if failed[n.Id] {
+					continue
+				}
+				if window++; window > K {
+					break
+				}
+				if !queried[n.Id] {
+					next = n
+					break
+				}
+			}
+			if next == nil {
+				break
+			}
+			queried[next.Id] = true
+			inflight++
+			go func(n *Node) {
+				msg, err := s.query(ctx, n.Addr, method, args)
+				results <- result{n, msg, err}
+			}(next)
+		}
+		if inflight == 0 {
+			break
+		}
+		r := <-results
+		inflight--
+		if r.err != nil {
+			failed[r.node.Id] = true
+			continue
+		}
+		res.nodes = append(res.nodes, r.node)
+		if r.msg.R.Token != "" {
+			res.tokens[r.node.Id] = r.msg.R.Token
+		}
+		for _, v := range r.msg.R.Values {
+			if peer, ok := decodePeer(v); ok && !peers[peer] {
+				peers[peer] = true
+				res.peers = append(res.peers, peer)
+			}
+		}
+		nodes := append(decodeNodes(r.msg.R.Nodes), decodeNodes6(r.msg.R.Nodes6)...)
+		for _, n := range nodes {
+			if seen[n.Id] || n.Id == s.id {
+				continue
+			}
+			seen[n.Id] = true
+			cands = append(cands, n)
+		}
+		sort.Slice(cands, func(i, j int) bool {
+			return closer(target, cands[i].Id, cands[j].Id)
+		})
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(res.nodes, func(i, j int) bool {
+		return closer(target, res.nodes[i].Id, res.nodes[j].Id)
+	})
+	if len(res.nodes) > K {
+		res.nodes = res.nodes[:K]
+	}
+	return res, nil
+}
+
+// FindNode returns the K closest nodes to target that answered
+func (s *Server) FindNode(ctx context.Context, target ID) ([]*Node, error) {
+	res, err := s.lookup(ctx, target, false)
+	if err != nil {
+		return nil, err
+	}
+	return res.nodes, nil
+}
+
+// GetPeers returns the peers of a torrent stored by the nodes close to it
+func (s *Server) GetPeers(ctx context.Context, infoHash ID) ([]netip.AddrPort, error) {
+	res, err := s.lookup(ctx, infoHash, true)
+	if err != nil {
+		return nil, err
+	}
+	return res.peers, nil
+}
+
+// Announce tells the nodes closest to the info hash that we accept peers on
+// port, and returns the peers they already know
+func (s *Server) Announce(ctx context.Context, infoHash ID, port int) ([]netip.AddrPort, error) {
+	res, err := s.lookup(ctx, infoHash, true)
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for _, n := range res.nodes {
+		token, ok := res.tokens[n.Id]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(n *Node) {
+			defer wg.Done()
+			args := krpcArgs{InfoHash: string(infoHash[:]), Port: port, Token: token}
+			s.query(ctx, n.Addr, methodAnnouncePeer, args)
+		}(n)
+	}
+	wg.Wait()
+	return res.peers, nil
+}
+
+// maintain rotates the token secret, expires stored peers, refreshes stale
+// buckets and saves the routing table
+func (s *Server) maintain() {
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	savedAt := time.Now()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if time.Since(s.rotatedAt) >= TokenRotate {
+			s.oldSecret = s.secret
+			rand.Read(s.secret[:])
+			s.rotatedAt = time.Now()
+		}
+		for infoHash, store := range s.peers {
+			for peer, at := range store.peers {
+				if time.Since(at) >= PeerExpire {
+					delete(store.peers, peer)
+				}
+			}
+			if len(store.peers) == 0 {
+				delete(s.peers, infoHash)
+			}
+		}
+		s.mu.Unlock()
+
+		for _, i := range s.table.stale() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			s.lookup(ctx, s.table.randomIn(i), false)
+			cancel()
+			s.table.touch(i)
+		}
+
+		if s.cfg.StateFile != "" && time.Since(savedAt) >= SaveInterval {
+			err := s.Save()
+			if err != nil {
+				fmt.Println("fail to save dht state, " + err.Error())
+			}
+			savedAt = time.Now()
+		}
+	}
+}
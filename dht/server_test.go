@@ -0,0 +1,162 @@
+package dht
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newNetwork starts n nodes on loopback, all bootstrapped from the first
+func newNetwork(t *testing.T, n int, configure func(i int, cfg *Config)) []*Server {
+	t.Helper()
+	first, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { first.Close() })
+	nodes := []*Server{first}
+	for i := 1; i < n; i++ {
+		cfg := Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{first.Addr().String()}, QueryTimeout: time.Second}
+		if configure != nil {
+			configure(i, &cfg)
+		}
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		err = s.Bootstrap(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, s)
+	}
+	return nodes
+}
+
+func TestPing(t *testing.T) {
+	nodes := newNetwork(t, 2, nil)
+	id, err := nodes[1].Ping(context.Background(), toAddrPort(nodes[0].Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != nodes[0].ID() {
+		t.Errorf("ping answered by %s, want %s", id, nodes[0].ID())
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	nodes := newNetwork(t, 20, nil)
+	found, err := nodes[3].FindNode(context.Background(), nodes[15].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 || found[0].Id != nodes[15].ID() {
+		t.Errorf("node %s not found first", nodes[15].ID())
+	}
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	nodes := newNetwork(t, 20, nil)
+	infoHash := RandomID()
+	_, err := nodes[5].Announce(context.Background(), infoHash, 1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers, err := nodes[17].GetPeers(context.Background(), infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := netip.MustParseAddrPort("127.0.0.1:1234")
+	for _, p := range peers {
+		if p == want {
+			return
+		}
+	}
+	t.Errorf("peers %v do not include %v", peers, want)
+}
+
+func TestBadToken(t *testing.T) {
+	nodes := newNetwork(t, 2, nil)
+	infoHash := RandomID()
+	_, err := nodes[1].query(context.Background(), toAddrPort(nodes[0].Addr()), methodAnnouncePeer, krpcArgs{
+		InfoHash: string(infoHash[:]),
+		Port:     1234,
+		Token:    "bogus",
+	})
+	if err == nil {
+		t.Error("announce_peer with a bad token accepted")
+	}
+	if len(nodes[0].storedPeers(infoHash)) != 0 {
+		t.Error("peer stored")
+	}
+}
+
+func TestState(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "dht.state")
+	nodes := newNetwork(t, 10, func(i int, cfg *Config) {
+		if i == 3 {
+			cfg.StateFile = state
+		}
+	})
+	id, n := nodes[3].ID(), len(nodes[3].Nodes())
+	err := nodes[3].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{Addr: "127.0.0.1:0", StateFile: state, BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.ID() != id {
+		t.Errorf("id %s restored as %s", id, s.ID())
+	}
+	if len(s.Nodes()) != n {
+		t.Errorf("%d nodes restored, want %d", len(s.Nodes()), n)
+	}
+}
+
+func TestStorePeerLimits(t *testing.T) {
+	nodes := newNetwork(t, 1, nil)
+	s := nodes[0]
+	var hash ID
+	peer := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881)
+	}
+	for i := 0; i < MaxPeers; i++ {
+		s.storePeer(hash, peer(i))
+	}
+	s.mu.Lock()
+	s.peers[hash].peers[peer(7)] = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+	s.storePeer(hash, peer(MaxPeers))
+	s.mu.Lock()
+	n := len(s.peers[hash].peers)
+	_, kept := s.peers[hash].peers[peer(7)]
+	s.mu.Unlock()
+	if n != MaxPeers || kept {
+		t.Errorf("%d peers stored, oldest kept %v", n, kept)
+	}
+
+	// the info hash announced least recently makes room
+	for i := 1; i < MaxInfoHashes; i++ {
+		s.storePeer(ID{byte(i >> 8), byte(i)}, peer(0))
+	}
+	s.mu.Lock()
+	s.peers[ID{0, 7}].last = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+	s.storePeer(ID{0xff, 0xff}, peer(0))
+	s.mu.Lock()
+	n = len(s.peers)
+	_, kept = s.peers[ID{0, 7}]
+	s.mu.Unlock()
+	if n != MaxInfoHashes || kept {
+		t.Errorf("%d info hashes stored, oldest kept %v", n, kept)
+	}
+	if len(s.storedPeers(hash)) != MaxValues {
+		t.Error("peers of a recent info hash dropped")
+	}
+}
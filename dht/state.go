@@ -0,0 +1,42 @@
+package dht
+
+import (
+	"fmt"
+	"go-torrent/bencode"
+	"os"
+)
+
+// the routing table is saved as a bencoded dict, nodes in compact form
+type rawState struct {
+	Id     string `bencode:"id"`
+	Nodes  string `bencode:"nodes"`
+	Nodes6 string `bencode:"nodes6,omitempty"`
+}
+
+type state struct {
+	id    ID
+	nodes []*Node
+}
+
+func loadState(path string) (*state, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	raw := new(rawState)
+	err = bencode.Unmarshal(f, raw)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := parseID(raw.Id)
+	if !ok {
+		return nil, fmt.Errorf("invalid node id in %s", path)
+	}
+	return &state{id: id, nodes: append(decodeNodes(raw.Nodes), decodeNodes6(raw.Nodes6)...)}, nil
+}
+
+// saveState writes the id and the routing table
+func saveState(path string, id ID, nodes []*Node) error {
+	return bencode.WriteFile(path, &rawState{Id: string(id[:]), Nodes: encodeNodes(nodes), Nodes6: encodeNodes6(nodes)})
+}
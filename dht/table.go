@@ -0,0 +1,227 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	K             = 8 // nodes per bucket, and nodes returned by find_node
+	MaxFails      = 3
+	BucketRefresh = 15 * time.Minute
+)
+
+type bucket struct {
+	nodes   []*Node // least recently seen first
+	changed time.Time
+}
+
+// table is the Kademlia routing table, bucket i holds the nodes sharing
+// exactly i leading bits with our own id
+type table struct {
+	self    ID
+	mu      sync.Mutex
+	buckets [IDLEN * 8]bucket
+}
+
+func newTable(self ID) *table {
+	t := &table{self: self}
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].changed = now
+	}
+	return t
+}
+
+func (t *table) index(id ID) int {
+	n := t.self.prefixLen(id)
+	if n >= len(t.buckets) {
+		return -1
+	}
+	return n
+}
+
+// insert records that a node answered us, it returns the least recently seen
+// node of a full bucket, which should be pinged to make room
+func (t *table) insert(id ID, addr netip.AddrPort) (oldest *Node, ok bool) {
+	i := t.index(id)
+	if i < 0 || !addr.IsValid() {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[i]
+	now := time.Now()
+	for j, n := range b.nodes {
+		if n.Id != id {
+			continue
+		}
+		// a known id at another address is ignored, it may be spoofed
+		if n.Addr != addr {
+			return nil, false
+		}
+		n.lastSeen = now
+		n.fails = 0
+		b.nodes = append(append(b.nodes[:j], b.nodes[j+1:]...), n)
+		b.changed = now
+		return nil, true
+	}
+	n := &Node{Id: id, Addr: addr, lastSeen: now}
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, n)
+		b.changed = now
+		return nil, true
+	}
+	for j, old := range b.nodes {
+		if old.bad() {
+			b.nodes = append(append(b.nodes[:j], b.nodes[j+1:]...), n)
+			b.changed = now
+			return nil, true
+		}
+	}
+	if b.nodes[0].good() {
+		return nil, false
+	}
+	copied := *b.nodes[0]
+	return &copied, false
+}
+
+// failed counts a query the node at addr did not answer
+func (t *table) failed(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if n.Addr == addr {
+				n.fails++
+				return
+			}
+		}
+	}
+}
+
+func (t *table) remove(id ID) {
+	i := t.index(id)
+	if i < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[i]
+	for j, n := range b.nodes {
+		if n.Id == id {
+			b.nodes = append(b.nodes[:j], b.nodes[j+1:]...)
+			return
+		}
+	}
+}
+
+func (t *table) has(id ID) bool {
+	i := t.index(id)
+	if i < 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range t.buckets[i].nodes {
+		if n.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// closest returns up to k nodes closest to target, bad nodes excluded
+func (t *table) closest(target ID, k int) []*Node {
+	return t.closestWhere(target, k, func(n *Node) bool { return true })
+}
+
+// closestOf only returns the nodes of one address family
+func (t *table) closestOf(target ID, k int, ipv6 bool) []*Node {
+	return t.closestWhere(target, k, func(n *Node) bool { return n.Addr.Addr().Is4() != ipv6 })
+}
+
+func (t *table) closestWhere(target ID, k int, keep func(*Node) bool) []*Node {
+	t.mu.Lock()
+	var nodes []*Node
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			if !n.bad() && keep(n) {
+				copied := *n
+				nodes = append(nodes, &copied)
+			}
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].Id, nodes[j].Id)
+	})
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+func (t *table) nodes() []*Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes []*Node
+	for i := range t.buckets {
+		for _, n := range t.buckets[i].nodes {
+			copied := *n
+			nodes = append(nodes, &copied)
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cnt := 0
+	for i := range t.buckets {
+		cnt += len(t.buckets[i].nodes)
+	}
+	return cnt
+}
+
+// stale returns the buckets nobody has been seen in for BucketRefresh, only
+// buckets up to the deepest non-empty one are worth refreshing
+func (t *table) stale() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	deepest := 0
+	for i := range t.buckets {
+		if len(t.buckets[i].nodes) > 0 {
+			deepest = i
+		}
+	}
+	var res []int
+	for i := 0; i <= deepest; i++ {
+		if time.Since(t.buckets[i].changed) >= BucketRefresh {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// touch marks a bucket as refreshed
+func (t *table) touch(i int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buckets[i].changed = time.Now()
+}
+
+// randomIn returns a random id that falls into bucket i
+func (t *table) randomIn(i int) ID {
+	id := RandomID()
+	for b := 0; b < i; b++ {
+		mask := byte(0x80 >> uint(b%8))
+		id[b/8] = id[b/8]&^mask | t.self[b/8]&mask
+	}
+	mask := byte(0x80 >> uint(i%8))
+	id[i/8] = id[i/8]&^mask | ^t.self[i/8]&mask
+	return id
+}
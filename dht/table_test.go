@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// idWithPrefix returns an id sharing exactly n leading bits with self
+func idWithPrefix(self ID, n int, last byte) ID {
+	id := self
+	id[n/8] ^= 0x80 >> (n % 8)
+	id[IDLEN-1] ^= last
+	return id
+}
+
+func TestTableFullBucket(t *testing.T) {
+	self := RandomID()
+	tb := newTable(self)
+	for i := 0; i < K; i++ {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881)
+		_, ok := tb.insert(idWithPrefix(self, 0, byte(i+1)), addr)
+		if !ok {
+			t.Fatalf("node %d not inserted", i)
+		}
+	}
+	// the bucket is full of good nodes, the newcomer is dropped
+	addr := netip.MustParseAddrPort("10.0.1.0:6881")
+	oldest, ok := tb.insert(idWithPrefix(self, 0, 0xff), addr)
+	if ok || oldest != nil {
+		t.Errorf("inserted %v into a full bucket, oldest %v", ok, oldest)
+	}
+	if tb.len() != K {
+		t.Errorf("%d nodes, want %d", tb.len(), K)
+	}
+	// a failing node makes room
+	first := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, 0}), 6881)
+	for i := 0; i < MaxFails; i++ {
+		tb.failed(first)
+	}
+	if _, ok := tb.insert(idWithPrefix(self, 0, 0xff), addr); !ok {
+		t.Error("bad node not replaced")
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	self := RandomID()
+	tb := newTable(self)
+	var ids []ID
+	for i := 0; i < 20; i++ {
+		id := idWithPrefix(self, i, 0)
+		ids = append(ids, id)
+		tb.insert(id, netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881))
+	}
+	target := ids[12]
+	nodes := tb.closest(target, K)
+	if len(nodes) != K {
+		t.Fatalf("%d nodes, want %d", len(nodes), K)
+	}
+	if nodes[0].Id != target {
+		t.Errorf("closest node %s, want %s", nodes[0].Id, target)
+	}
+	for i := 1; i < len(nodes); i++ {
+		if closer(target, nodes[i].Id, nodes[i-1].Id) {
+			t.Fatal("nodes not sorted by distance")
+		}
+	}
+}
+
+func TestNodesEncoding(t *testing.T) {
+	nodes := []*Node{
+		{Id: ID{1}, Addr: netip.MustParseAddrPort("10.0.0.1:6881")},
+		{Id: ID{2}, Addr: netip.MustParseAddrPort("[2001:db8::1]:6882")},
+		{Id: ID{3}, Addr: netip.MustParseAddrPort("10.0.0.3:6883")},
+	}
+	s := encodeNodes(nodes)
+	if len(s) != 2*compactNodeLen {
+		t.Fatalf("nodes of %d bytes, want %d", len(s), 2*compactNodeLen)
+	}
+	got := decodeNodes(s)
+	if len(got) != 2 || got[0].Id != nodes[0].Id || got[1].Addr != nodes[2].Addr {
+		t.Errorf("decoded %v", got)
+	}
+	s6 := encodeNodes6(nodes)
+	if len(s6) != compactNode6Len {
+		t.Fatalf("nodes6 of %d bytes, want %d", len(s6), compactNode6Len)
+	}
+	got = decodeNodes6(s6)
+	if len(got) != 1 || got[0].Id != nodes[1].Id || got[0].Addr != nodes[1].Addr {
+		t.Errorf("decoded %v", got)
+	}
+	// the lengths of the two forms do not mix
+	if decodeNodes(s6) != nil || decodeNodes6(s) != nil {
+		t.Error("nodes decoded in the wrong form")
+	}
+}
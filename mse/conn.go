@@ -0,0 +1,58 @@
+package mse
+
+import (
+	"bufio"
+	"crypto/rc4"
+	"io"
+	"net"
+	"sync"
+)
+
+// conn reads what is left of the handshake buffer before the socket, the
+// initial payload of the other side comes first
+type conn struct {
+	net.Conn
+	r      io.Reader
+	ia     []byte // already decrypted
+	method CryptoMethod
+	enc    *rc4.Cipher
+	dec    *rc4.Cipher
+	wmu    sync.Mutex
+}
+
+func newConn(c net.Conn, r *bufio.Reader, ia []byte, method CryptoMethod, enc, dec *rc4.Cipher) *conn {
+	return &conn{Conn: c, r: r, ia: ia, method: method, enc: enc, dec: dec}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.ia) > 0 {
+		n := copy(b, c.ia)
+		c.ia = c.ia[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.method == CryptoRC4 {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.method != CryptoRC4 {
+		return c.Conn.Write(b)
+	}
+	// the key stream must advance in the order bytes hit the wire
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Method returns the crypto method of an established connection
+func Method(c net.Conn) CryptoMethod {
+	if c, ok := c.(*conn); ok {
+		return c.method
+	}
+	return CryptoPlaintext
+}
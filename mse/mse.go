@@ -0,0 +1,277 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+)
+
+// Message Stream Encryption: a Diffie-Hellman exchange hides the handshake,
+// then the stream is either RC4 obfuscated or left in plaintext, whichever
+// both sides support. SKEY is the info hash of the torrent.
+
+type CryptoMethod uint32
+
+const (
+	CryptoPlaintext CryptoMethod = 0x01
+	CryptoRC4       CryptoMethod = 0x02
+)
+
+const (
+	KeyLen    = 96  // public keys are padded to the length of the prime
+	MaxPadLen = 512 // PadA, PadB, PadC and PadD
+)
+
+var (
+	ErrNoMethod = errors.New("no common crypto method")
+	ErrNoSkey   = errors.New("unknown skey")
+	ErrSync     = errors.New("fail to synchronize on the stream")
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8) // verification constant
+)
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	x := new(big.Int).SetBytes(buf)
+	y := new(big.Int).Exp(generator, x, prime)
+	return &keyPair{private: x, public: y.FillBytes(make([]byte, KeyLen))}, nil
+}
+
+// secret computes S from the public key of the other side
+func (k *keyPair) secret(public []byte) []byte {
+	y := new(big.Int).SetBytes(public)
+	s := new(big.Int).Exp(y, k.private, prime)
+	return s.FillBytes(make([]byte, KeyLen))
+}
+
+// newCipher returns the RC4 stream of one direction, the first 1024 bytes
+// of the key stream are discarded
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() []byte {
+	pad := make([]byte, mrand.Intn(MaxPadLen+1))
+	rand.Read(pad)
+	return pad
+}
+
+// scan reads r until pattern has been seen, giving up after max bytes
+func scan(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, len(pattern))
+	for i := 0; i < max; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(pattern) {
+			window = window[1:]
+		}
+		window = append(window, b)
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return ErrSync
+}
+
+// Initiate runs the handshake of the connecting side and returns a
+// connection that encrypts with the method selected by the other side
+func Initiate(c net.Conn, skey []byte, provide CryptoMethod) (net.Conn, CryptoMethod, error) {
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, 0, err
+	}
+	// 1. A->B: Ya, PadA
+	_, err = c.Write(append(keys.public, randomPad()...))
+	if err != nil {
+		return nil, 0, err
+	}
+	// 2. B->A: Yb, PadB
+	r := bufio.NewReader(c)
+	yb := make([]byte, KeyLen)
+	_, err = io.ReadFull(r, yb)
+	if err != nil {
+		return nil, 0, err
+	}
+	s := keys.secret(yb)
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+	buf := new(bytes.Buffer)
+	buf.Write(hash([]byte("req1"), s))
+	req2 := hash([]byte("req2"), skey)
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		buf.WriteByte(req2[i] ^ req3[i])
+	}
+	plain := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(plain[8:12], uint32(provide))
+	enc.XORKeyStream(plain, plain)
+	buf.Write(plain)
+	_, err = c.Write(buf.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD), PadB is skipped
+	// by looking for the encrypted VC
+	encVC := make([]byte, len(vc))
+	dec.XORKeyStream(encVC, vc)
+	err = scan(r, encVC, MaxPadLen+len(vc))
+	if err != nil {
+		return nil, 0, err
+	}
+	head := make([]byte, 4+2)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(head, head)
+	method := CryptoMethod(binary.BigEndian.Uint32(head[0:4]))
+	padLen := int(binary.BigEndian.Uint16(head[4:6]))
+	if method&provide == 0 || (method != CryptoPlaintext && method != CryptoRC4) {
+		return nil, 0, fmt.Errorf("peer selected crypto method %d", method)
+	}
+	if padLen > MaxPadLen {
+		return nil, 0, fmt.Errorf("padD too long: %d", padLen)
+	}
+	pad := make([]byte, padLen)
+	_, err = io.ReadFull(r, pad)
+	if err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(pad, pad)
+	return newConn(c, r, nil, method, enc, dec), method, nil
+}
+
+// Accept runs the handshake of the receiving side, the skey of the peer must
+// be one of skeys, it is returned along with the encrypted connection
+func Accept(c net.Conn, skeys [][]byte, allowed CryptoMethod) (net.Conn, []byte, error) {
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	// 1. A->B: Ya, PadA
+	r := bufio.NewReader(c)
+	ya := make([]byte, KeyLen)
+	_, err = io.ReadFull(r, ya)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 2. B->A: Yb, PadB
+	_, err = c.Write(append(keys.public, randomPad()...))
+	if err != nil {
+		return nil, nil, err
+	}
+	s := keys.secret(ya)
+
+	// 3. A->B: PadA is skipped by looking for HASH('req1', S)
+	err = scan(r, hash([]byte("req1"), s), MaxPadLen+sha1.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := make([]byte, sha1.Size)
+	_, err = io.ReadFull(r, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	req3 := hash([]byte("req3"), s)
+	for i := range req {
+		req[i] ^= req3[i]
+	}
+	var skey []byte
+	for _, k := range skeys {
+		if bytes.Equal(hash([]byte("req2"), k), req) {
+			skey = k
+			break
+		}
+	}
+	if skey == nil {
+		return nil, nil, ErrNoSkey
+	}
+
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+	head := make([]byte, 8+4+2)
+	_, err = io.ReadFull(r, head)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(head, head)
+	if !bytes.Equal(head[0:8], vc) {
+		return nil, nil, ErrSync
+	}
+	provide := CryptoMethod(binary.BigEndian.Uint32(head[8:12]))
+	padLen := int(binary.BigEndian.Uint16(head[12:14]))
+	if padLen > MaxPadLen {
+		return nil, nil, fmt.Errorf("padC too long: %d", padLen)
+	}
+	rest := make([]byte, padLen+2)
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padLen:]))
+	_, err = io.ReadFull(r, ia)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var method CryptoMethod
+	switch {
+	case provide&allowed&CryptoRC4 != 0:
+		method = CryptoRC4
+	case provide&allowed&CryptoPlaintext != 0:
+		method = CryptoPlaintext
+	default:
+		return nil, nil, ErrNoMethod
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	res := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(res[8:12], uint32(method))
+	enc.XORKeyStream(res, res)
+	_, err = c.Write(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newConn(c, r, ia, method, enc, dec), skey, nil
+}
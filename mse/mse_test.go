@@ -0,0 +1,191 @@
+package mse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type initiateResult struct {
+	conn   net.Conn
+	method CryptoMethod
+	err    error
+}
+
+type acceptResult struct {
+	conn net.Conn
+	skey []byte
+	err  error
+}
+
+// handshake runs both sides over a pipe
+func handshake(t *testing.T, skey []byte, provide CryptoMethod, skeys [][]byte, allowed CryptoMethod) (initiateResult, acceptResult) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	accepted := make(chan acceptResult, 1)
+	go func() {
+		conn, skey, err := Accept(b, skeys, allowed)
+		if err != nil {
+			// unblock the initiator
+			b.Close()
+		}
+		accepted <- acceptResult{conn, skey, err}
+	}()
+	conn, method, err := Initiate(a, skey, provide)
+	if err != nil {
+		a.Close()
+	}
+	return initiateResult{conn, method, err}, <-accepted
+}
+
+func TestRoundTrip(t *testing.T) {
+	skey := []byte("01234567890123456789")
+	dialed, res := handshake(t, skey, CryptoRC4|CryptoPlaintext, [][]byte{[]byte("other"), skey}, CryptoRC4|CryptoPlaintext)
+	if dialed.err != nil || res.err != nil {
+		t.Fatal(dialed.err, res.err)
+	}
+	conn, method := dialed.conn, dialed.method
+	if method != CryptoRC4 || Method(conn) != CryptoRC4 || Method(res.conn) != CryptoRC4 {
+		t.Errorf("method %d, want rc4", method)
+	}
+	if !bytes.Equal(res.skey, skey) {
+		t.Errorf("skey %q", res.skey)
+	}
+
+	msg := []byte("\x13BitTorrent protocol")
+	go conn.Write(msg)
+	got := make([]byte, len(msg))
+	_, err := io.ReadFull(res.conn, got)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("read %q, %v", got, err)
+	}
+	go res.conn.Write(msg)
+	_, err = io.ReadFull(conn, got)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+func TestWrongSkey(t *testing.T) {
+	dialed, res := handshake(t, []byte("skey"), CryptoRC4, [][]byte{[]byte("other")}, CryptoRC4)
+	if res.err != ErrNoSkey {
+		t.Errorf("accept: %v, want %v", res.err, ErrNoSkey)
+	}
+	if dialed.err == nil {
+		t.Error("initiate succeeded")
+	}
+}
+
+func TestMethods(t *testing.T) {
+	both := CryptoRC4 | CryptoPlaintext
+	for _, tc := range []struct {
+		provide, allowed, want CryptoMethod
+	}{
+		{both, both, CryptoRC4},
+		{both, CryptoRC4, CryptoRC4},
+		{both, CryptoPlaintext, CryptoPlaintext},
+		{CryptoRC4, both, CryptoRC4},
+		{CryptoPlaintext, both, CryptoPlaintext},
+		{CryptoPlaintext, CryptoPlaintext, CryptoPlaintext},
+		{CryptoRC4, CryptoPlaintext, 0},
+		{CryptoPlaintext, CryptoRC4, 0},
+	} {
+		skey := []byte("skey")
+		dialed, res := handshake(t, skey, tc.provide, [][]byte{skey}, tc.allowed)
+		if tc.want == 0 {
+			if res.err != ErrNoMethod || dialed.err == nil {
+				t.Errorf("provide %d, allowed %d: %v, %v", tc.provide, tc.allowed, dialed.err, res.err)
+			}
+			continue
+		}
+		if dialed.err != nil || res.err != nil {
+			t.Errorf("provide %d, allowed %d: %v, %v", tc.provide, tc.allowed, dialed.err, res.err)
+			continue
+		}
+		if dialed.method != tc.want || Method(res.conn) != tc.want {
+			t.Errorf("provide %d, allowed %d: method %d, want %d", tc.provide, tc.allowed, dialed.method, tc.want)
+		}
+		msg := []byte("data")
+		go dialed.conn.Write(msg)
+		got := make([]byte, len(msg))
+		_, err := io.ReadFull(res.conn, got)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("read %q, %v", got, err)
+		}
+	}
+}
+
+func TestPadTooLong(t *testing.T) {
+	skey := []byte("skey")
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	accepted := make(chan error, 1)
+	go func() {
+		_, _, err := Accept(b, [][]byte{skey}, CryptoRC4)
+		accepted <- err
+		b.Close()
+	}()
+
+	// step 1 and 3 of the initiator with a PadC longer than allowed
+	keys, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Write(keys.public)
+	yb := make([]byte, KeyLen)
+	_, err = io.ReadFull(a, yb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, a)
+	s := keys.secret(yb)
+	buf := new(bytes.Buffer)
+	buf.Write(hash([]byte("req1"), s))
+	req2 := hash([]byte("req2"), skey)
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		buf.WriteByte(req2[i] ^ req3[i])
+	}
+	plain := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(plain[8:12], uint32(CryptoRC4))
+	binary.BigEndian.PutUint16(plain[12:14], MaxPadLen+1)
+	newCipher("keyA", s, skey).XORKeyStream(plain, plain)
+	buf.Write(plain)
+	a.Write(buf.Bytes())
+
+	err = <-accepted
+	if err == nil || err == ErrSync {
+		t.Errorf("accept: %v, want padC too long", err)
+	}
+}
+
+func TestPadALimit(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	accepted := make(chan error, 1)
+	go func() {
+		_, _, err := Accept(b, [][]byte{[]byte("skey")}, CryptoRC4)
+		accepted <- err
+		b.Close()
+	}()
+	// a public key followed by more than MaxPadLen bytes of garbage
+	go io.Copy(io.Discard, a)
+	a.Write(make([]byte, KeyLen+MaxPadLen+2*20))
+	if err := <-accepted; err != ErrSync {
+		t.Errorf("accept: %v, want %v", err, ErrSync)
+	}
+}
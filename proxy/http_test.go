@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// connectServer is an HTTP proxy stand-in that only opens CONNECT tunnels,
+// with basic auth if user is set
+func connectServer(t *testing.T, user, pass string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+				u, p, ok := auth.BasicAuth()
+				if user != "" && (!ok || u != user || p != pass) {
+					c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				up, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				defer up.Close()
+				c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(up, br)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := echoServer(t)
+	p, err := Parse("http://user:secret@" + connectServer(t, "user", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := p.Dial(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn)
+
+	p.Password = "wrong"
+	_, err = p.Dial(context.Background(), target)
+	if err == nil {
+		t.Error("wrong password accepted")
+	}
+}
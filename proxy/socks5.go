@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RFC 1928, with the username/password authentication of RFC 1929
+const (
+	socksVersion   byte = 0x05
+	authNone       byte = 0x00
+	authPassword   byte = 0x02
+	authNoMethod   byte = 0xFF
+	cmdConnect     byte = 0x01
+	cmdUDPAssoc    byte = 0x03
+	atypIPv4       byte = 0x01
+	atypDomain     byte = 0x03
+	atypIPv6       byte = 0x04
+	replySucceeded byte = 0x00
+)
+
+var ErrUDPNotSupported = errors.New("udp needs a socks5 proxy")
+
+// writeAddr appends addr in the socks5 form: type, address, port
+func writeAddr(buf *bytes.Buffer, addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("invalid port: %s", addr)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		buf.WriteByte(atypDomain)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf.WriteByte(atypIPv4)
+		buf.Write(ip4)
+	} else {
+		buf.WriteByte(atypIPv6)
+		buf.Write(ip.To16())
+	}
+	binary.Write(buf, binary.BigEndian, uint16(p))
+	return nil
+}
+
+// readAddr reads an address in the socks5 form
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		host = ip.String()
+	case atypDomain:
+		n := make([]byte, 1)
+		_, err = io.ReadFull(r, n)
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		_, err = io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown socks5 address type: %d", atyp[0])
+	}
+	if err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksAuth negotiates the authentication method
+func (p *Proxy) socksAuth(conn net.Conn) error {
+	methods := []byte{authNone}
+	if p.Username != "" {
+		methods = append(methods, authPassword)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	res := make([]byte, 2)
+	_, err = io.ReadFull(conn, res)
+	if err != nil {
+		return err
+	}
+	if res[0] != socksVersion {
+		return fmt.Errorf("not a socks5 proxy")
+	}
+	switch res[1] {
+	case authNone:
+		return nil
+	case authPassword:
+		if p.Username == "" {
+			return fmt.Errorf("socks5 proxy asks for a password")
+		}
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return fmt.Errorf("socks5 credentials too long")
+		}
+		buf := new(bytes.Buffer)
+		buf.WriteByte(0x01)
+		buf.WriteByte(byte(len(p.Username)))
+		buf.WriteString(p.Username)
+		buf.WriteByte(byte(len(p.Password)))
+		buf.WriteString(p.Password)
+		_, err = conn.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, res)
+		if err != nil {
+			return err
+		}
+		if res[1] != 0x00 {
+			return fmt.Errorf("socks5 authentication failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("no acceptable socks5 authentication method")
+	}
+}
+
+// socksRequest sends a command and returns the bound address of the reply
+func (p *Proxy) socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	err := p.socksAuth(conn)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.NewBuffer([]byte{socksVersion, cmd, 0x00})
+	err = writeAddr(buf, addr)
+	if err != nil {
+		return "", err
+	}
+	_, err = conn.Write(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	res := make([]byte, 3)
+	_, err = io.ReadFull(conn, res)
+	if err != nil {
+		return "", err
+	}
+	if res[0] != socksVersion {
+		return "", fmt.Errorf("not a socks5 proxy")
+	}
+	if res[1] != replySucceeded {
+		return "", fmt.Errorf("socks5 request to %s failed, reply %d", addr, res[1])
+	}
+	return readAddr(conn)
+}
+
+func (p *Proxy) socksConnect(conn net.Conn, addr string) (net.Conn, error) {
+	_, err := p.socksRequest(conn, cmdConnect, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenPacket opens a UDP association with a socks5 proxy, datagrams are
+// relayed by the proxy as long as the returned PacketConn is open
+func (p *Proxy) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if p.Type != SOCKS5 {
+		return nil, ErrUDPNotSupported
+	}
+	ctrl, err := new(net.Dialer).DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ctrl.SetDeadline(deadline)
+	}
+	relay, err := p.socksRequest(ctrl, cmdUDPAssoc, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+	relayAddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	// an unspecified relay address means the host of the proxy
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	c := &udpConn{PacketConn: pc, ctrl: ctrl, relay: relayAddr}
+	// the association ends when the proxy drops the control connection
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// udpConn wraps datagrams in the socks5 UDP request header
+type udpConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+	once  sync.Once
+}
+
+func (c *udpConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf := bytes.NewBuffer([]byte{0x00, 0x00, 0x00}) // RSV, FRAG
+	err := writeAddr(buf, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	buf.Write(b)
+	_, err = c.PacketConn.WriteTo(buf.Bytes(), c.relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// only the relay talks to us, fragments are not supported
+		if from.String() != c.relay.String() || n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), udpAddr, nil
+	}
+}
+
+func (c *udpConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
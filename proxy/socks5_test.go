@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// socksServer is a SOCKS5 stand-in supporting CONNECT and UDP ASSOCIATE,
+// with username/password auth if user is set
+type socksServer struct {
+	ln         net.Listener
+	user, pass string
+	connects   atomic.Int32
+	datagrams  atomic.Int32
+}
+
+func newSocksServer(t *testing.T, user, pass string) *socksServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{ln: ln, user: user, pass: pass}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) proxy(user, pass string) *Proxy {
+	return &Proxy{Type: SOCKS5, Addr: s.ln.Addr().String(), Username: user, Password: pass}
+}
+
+func (s *socksServer) handle(c net.Conn) {
+	defer c.Close()
+	hdr := make([]byte, 2)
+	io.ReadFull(c, hdr)
+	methods := make([]byte, hdr[1])
+	io.ReadFull(c, methods)
+	if s.user == "" {
+		c.Write([]byte{5, 0})
+	} else {
+		if !bytes.Contains(methods, []byte{2}) {
+			c.Write([]byte{5, 0xff})
+			return
+		}
+		c.Write([]byte{5, 2})
+		io.ReadFull(c, hdr)
+		user := make([]byte, hdr[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, hdr[:1])
+		pass := make([]byte, hdr[0])
+		io.ReadFull(c, pass)
+		if string(user) != s.user || string(pass) != s.pass {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	}
+	req := make([]byte, 3)
+	io.ReadFull(c, req)
+	addr, err := readAddr(c)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case cmdConnect:
+		up, err := net.Dial("tcp", addr)
+		if err != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer up.Close()
+		s.connects.Add(1)
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(up, c)
+		io.Copy(c, up)
+	case cmdUDPAssoc:
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer pc.Close()
+		port := pc.LocalAddr().(*net.UDPAddr).Port
+		// an unspecified address, the client uses the host of the proxy
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+		go s.relay(pc)
+		io.Copy(io.Discard, c)
+	}
+}
+
+// relay forwards the datagrams of the first client and wraps the answers
+func (s *socksServer) relay(pc net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 1<<16)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readAddr(r)
+			if err != nil {
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", dst)
+			if err != nil {
+				continue
+			}
+			s.datagrams.Add(1)
+			pc.WriteTo(buf[n-r.Len():n], addr)
+			continue
+		}
+		udp := from.(*net.UDPAddr)
+		hdr := append([]byte{0, 0, 0, 1}, udp.IP.To4()...)
+		hdr = append(hdr, byte(udp.Port>>8), byte(udp.Port))
+		pc.WriteTo(append(hdr, buf[:n]...), client)
+	}
+}
+
+// echoServer answers every TCP connection with what it reads
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echo sends a message over conn and checks that it comes back
+func echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echoed %q", buf)
+	}
+}
+
+func TestSocksConnect(t *testing.T) {
+	target := echoServer(t)
+	s := newSocksServer(t, "", "")
+	conn, err := s.proxy("", "").Dial(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn)
+	if s.connects.Load() != 1 {
+		t.Errorf("%d connects, want 1", s.connects.Load())
+	}
+}
+
+func TestSocksAuth(t *testing.T) {
+	target := echoServer(t)
+	s := newSocksServer(t, "user", "secret")
+	conn, err := s.proxy("user", "secret").Dial(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn)
+
+	_, err = s.proxy("user", "wrong").Dial(context.Background(), target)
+	if err == nil {
+		t.Error("wrong password accepted")
+	}
+	_, err = s.proxy("", "").Dial(context.Background(), target)
+	if err == nil {
+		t.Error("no auth accepted")
+	}
+}
+
+func TestSocksUDP(t *testing.T) {
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 100)
+		n, from, err := target.ReadFrom(buf)
+		if err == nil {
+			target.WriteTo(buf[:n], from)
+		}
+	}()
+
+	s := newSocksServer(t, "user", "secret")
+	pc, err := s.proxy("user", "secret").ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	_, err = pc.WriteTo([]byte("ping"), target.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from.String() != target.LocalAddr().String() {
+		t.Errorf("got %q from %s", buf[:n], from)
+	}
+	if s.datagrams.Load() != 1 {
+		t.Errorf("%d datagrams relayed, want 1", s.datagrams.Load())
+	}
+}
+
+func TestHTTPProxyNoUDP(t *testing.T) {
+	_, err := (&Proxy{Type: HTTP, Addr: "127.0.0.1:1"}).ListenPacket(context.Background())
+	if err != ErrUDPNotSupported {
+		t.Errorf("got %v, want ErrUDPNotSupported", err)
+	}
+}
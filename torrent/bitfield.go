@@ -4,6 +4,11 @@ import "strconv"
 
 type Bitfield []byte
 
+// NewBitfield returns an empty bitfield large enough for n pieces
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
 func (field Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
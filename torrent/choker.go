@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	ChokeInterval      = 10 * time.Second
+	OptimisticInterval = 30 * time.Second
+	DefaultUploadSlots = 4
+)
+
+// choker decides which peers we upload to: the interested peers that give
+// us the best download rate (upload rate once seeding) are unchoked, plus
+// one optimistic unchoke so new peers get a chance to prove themselves
+type choker struct {
+	t          *Torrent
+	slots      int
+	optimistic *PeerConn
+	optimistAt time.Time
+	roundAt    time.Time
+	prev       map[*PeerConn]int64 // transferred bytes at the last round
+	rates      map[*PeerConn]float64
+	kick       chan struct{}
+	done       chan struct{}
+	now        func() time.Time // the clock, tests set their own
+	rand       *rand.Rand       // picks the optimistic unchoke, seeded in tests
+}
+
+func newChoker(t *Torrent, slots int) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{
+		t:       t,
+		slots:   slots,
+		roundAt: time.Now(),
+		prev:    make(map[*PeerConn]int64),
+		rates:   make(map[*PeerConn]float64),
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		now:     time.Now,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// kickNow asks for a rechoke with the current rates, e.g. once a peer
+// becomes interested, so it does not wait for the next round
+func (ch *choker) kickNow() {
+	select {
+	case ch.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (ch *choker) run() {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch.done:
+			return
+		case <-ticker.C:
+			ch.measure()
+			ch.rechoke()
+		case <-ch.kick:
+			ch.rechoke()
+		}
+	}
+}
+
+func (ch *choker) stop() {
+	close(ch.done)
+}
+
+// measure updates the rate of every peer since the last round
+func (ch *choker) measure() {
+	now := ch.now()
+	elapsed := now.Sub(ch.roundAt).Seconds()
+	ch.roundAt = now
+	seeding := ch.t.complete()
+
+	conns := ch.t.connList()
+	prev := make(map[*PeerConn]int64, len(conns))
+	rates := make(map[*PeerConn]float64, len(conns))
+	for _, c := range conns {
+		n := c.downloaded.Load()
+		if seeding {
+			n = c.uploaded.Load()
+		}
+		if last, ok := ch.prev[c]; ok && elapsed > 0 && n >= last {
+			rates[c] = float64(n-last) / elapsed
+		}
+		prev[c] = n
+	}
+	ch.prev = prev
+	ch.rates = rates
+}
+
+func (ch *choker) rechoke() {
+	conns := ch.t.connList()
+	var interested []*PeerConn
+	for _, c := range conns {
+		if c.isPeerInterested() {
+			interested = append(interested, c)
+		}
+	}
+	sort.SliceStable(interested, func(i, j int) bool {
+		return ch.rates[interested[i]] > ch.rates[interested[j]]
+	})
+
+	unchoke := make(map[*PeerConn]bool)
+	regular := ch.slots - 1
+	for i := 0; i < regular && i < len(interested); i++ {
+		unchoke[interested[i]] = true
+	}
+
+	// rotate the optimistic unchoke, or replace it once it left or lost interest
+	if ch.optimistic == nil || !ch.optimistic.isPeerInterested() || !contains(conns, ch.optimistic) ||
+		ch.now().Sub(ch.optimistAt) >= OptimisticInterval {
+		var candidates []*PeerConn
+		for _, c := range interested {
+			if !unchoke[c] && c != ch.optimistic {
+				candidates = append(candidates, c)
+			}
+		}
+		ch.optimistic = nil
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[ch.rand.Intn(len(candidates))]
+		}
+		ch.optimistAt = ch.now()
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+
+	for _, c := range conns {
+		if unchoke[c] {
+			c.up.unchoke()
+		} else {
+			c.up.choke()
+		}
+	}
+}
+
+func contains(conns []*PeerConn, c *PeerConn) bool {
+	for _, conn := range conns {
+		if conn == c {
+			return true
+		}
+	}
+	return false
+}
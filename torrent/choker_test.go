@@ -0,0 +1,163 @@
+package torrent
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newChokerTorrent returns a torrent of one piece with n connected peers,
+// all choked, whose messages are discarded
+func newChokerTorrent(t *testing.T, n int) (*Torrent, []*PeerConn) {
+	t.Helper()
+	tt := newTorrent(&TorrentTask{PieceSHA: make([][SHALEN]byte, 1)})
+	t.Cleanup(tt.close)
+	var conns []*PeerConn
+	for i := 0; i < n; i++ {
+		a, b := net.Pipe()
+		go io.Copy(io.Discard, b)
+		t.Cleanup(func() { a.Close() })
+		c := &PeerConn{Conn: a, AmChoking: true, announced: true}
+		c.up = newUploader(tt, c)
+		tt.conns[c] = struct{}{}
+		conns = append(conns, c)
+	}
+	return tt, conns
+}
+
+// newTestChoker returns a choker whose clock only moves with advance and
+// whose optimistic unchokes are always picked the same way
+func newTestChoker(tt *Torrent, slots int) (ch *choker, advance func(time.Duration)) {
+	now := time.Unix(1000, 0)
+	ch = newChoker(tt, slots)
+	ch.now = func() time.Time { return now }
+	ch.rand = rand.New(rand.NewSource(1))
+	ch.roundAt = now
+	return ch, func(d time.Duration) { now = now.Add(d) }
+}
+
+func unchoked(conns []*PeerConn) []bool {
+	res := make([]bool, len(conns))
+	for i, c := range conns {
+		res[i] = !c.isAmChoking()
+	}
+	return res
+}
+
+func TestChokerTopRates(t *testing.T) {
+	tt, conns := newChokerTorrent(t, 5)
+	ch := newChoker(tt, 3)
+	for i, c := range conns {
+		c.PeerInterested = true
+		ch.rates[c] = float64(i)
+	}
+	ch.rechoke()
+	got := unchoked(conns)
+	// two regular slots for the fastest, the optimistic one for another
+	if !got[4] || !got[3] {
+		t.Errorf("fastest peers choked: %v", got)
+	}
+	n := 0
+	for _, u := range got {
+		if u {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Errorf("%d peers unchoked, want 3", n)
+	}
+}
+
+func TestChokerNotInterested(t *testing.T) {
+	tt, conns := newChokerTorrent(t, 2)
+	ch := newChoker(tt, 3)
+	ch.rates[conns[0]] = 100
+	conns[1].PeerInterested = true
+	conns[0].AmChoking = false
+	ch.rechoke()
+	if got := unchoked(conns); got[0] || !got[1] {
+		t.Errorf("unchoked %v, want only the interested peer", got)
+	}
+}
+
+func TestChokerMeasure(t *testing.T) {
+	tt, conns := newChokerTorrent(t, 2)
+	ch, advance := newTestChoker(tt, 3)
+	ch.measure()
+	conns[0].downloaded.Store(1000)
+	conns[1].uploaded.Store(1000)
+	advance(ChokeInterval)
+	ch.measure()
+	// leeching, peers are rated by what they send us
+	if ch.rates[conns[0]] != 100 || ch.rates[conns[1]] != 0 {
+		t.Errorf("rates while leeching: %v, %v", ch.rates[conns[0]], ch.rates[conns[1]])
+	}
+
+	tt.markPiece(0)
+	ch.measure()
+	advance(ChokeInterval)
+	conns[1].uploaded.Store(2000)
+	ch.measure()
+	// seeding, by what we send them
+	if ch.rates[conns[0]] != 0 || ch.rates[conns[1]] != 100 {
+		t.Errorf("rates while seeding: %v, %v", ch.rates[conns[0]], ch.rates[conns[1]])
+	}
+}
+
+func TestChokerSeedingTopDownloaders(t *testing.T) {
+	tt, conns := newChokerTorrent(t, 4)
+	tt.markPiece(0)
+	// one regular slot, the optimistic one goes to a peer left over
+	ch, advance := newTestChoker(tt, 2)
+	for _, c := range conns {
+		c.PeerInterested = true
+	}
+	ch.measure()
+	// the peers that download the most from us, not the ones we get the
+	// most from, keep their slot
+	conns[0].downloaded.Store(1 << 20)
+	conns[2].uploaded.Store(1000)
+	conns[3].uploaded.Store(500)
+	advance(ChokeInterval)
+	ch.measure()
+	ch.rechoke()
+	if got := unchoked(conns); !got[2] {
+		t.Errorf("unchoked %v, want the top downloader", got)
+	}
+	if ch.optimistic == conns[2] {
+		t.Error("regular slot taken by the optimistic unchoke")
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	tt, conns := newChokerTorrent(t, 4)
+	ch, advance := newTestChoker(tt, 2)
+	for i, c := range conns {
+		c.PeerInterested = true
+		ch.rates[c] = float64(i)
+	}
+	ch.rechoke()
+	first := ch.optimistic
+	if first == nil || first == conns[3] {
+		t.Fatalf("optimistic unchoke %v", first)
+	}
+	// the optimistic unchoke is kept for three rounds
+	for round := 1; round < 3; round++ {
+		advance(ChokeInterval)
+		ch.rechoke()
+		if ch.optimistic != first {
+			t.Fatalf("optimistic unchoke rotated after %d rounds", round)
+		}
+	}
+	advance(ChokeInterval)
+	ch.rechoke()
+	if ch.optimistic == first || ch.optimistic == conns[3] || ch.optimistic == nil {
+		t.Fatal("optimistic unchoke not rotated after three rounds")
+	}
+	if got := unchoked(conns); got[slices.Index(conns, first)] {
+		t.Error("previous optimistic unchoke not choked")
+	}
+}
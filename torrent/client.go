@@ -0,0 +1,499 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"go-torrent/dht"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientConfig are the settings of a Client, zero values are the defaults.
+// The DHT node is not created by the client, it may share its socket with
+// uTP and keeps its routing table in a state file, both up to the caller
+type ClientConfig struct {
+	PeerId       [IDLEN]byte  // random if not set
+	Port         int          // peers are accepted on it, a free one if 0
+	DataDir      string       // torrents are stored below it, the working directory if empty
+	ConnOptions  *ConnOptions // optional, how peers are connected, the client sets its Limits
+	DHT          *dht.Server  // optional, finds peers for every torrent, the caller closes it after the client
+	UploadSlots  int          // of each torrent, DefaultUploadSlots if not set
+	MaxConns     int          // peer connections of all torrents together, 0 for no limit
+	DiskOps      int          // storage reads and writes of all torrents running at once, 0 for no limit
+	DownloadRate int          // bytes per second of all torrents together, 0 for no limit
+	UploadRate   int          // bytes per second of all torrents together, 0 for no limit
+}
+
+// Client runs many torrents at once. They share its listener, DHT node,
+// peer id, connection and rate limits and disk slots
+type Client struct {
+	config   ClientConfig
+	opts     *ConnOptions
+	listener *Listener
+	disk     chan struct{} // a slot for each storage operation, nil without a cap
+	mu       sync.Mutex
+	torrents map[[SHALEN]byte]*Handle
+	closed   bool
+}
+
+var errClientClosed = errors.New("client closed")
+
+// NewClient starts listening for peers, config may be nil
+func NewClient(config *ClientConfig) (*Client, error) {
+	c := &Client{torrents: make(map[[SHALEN]byte]*Handle)}
+	if config != nil {
+		c.config = *config
+	}
+	if c.config.PeerId == [IDLEN]byte{} {
+		_, err := rand.Read(c.config.PeerId[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := ConnOptions{}
+	if c.config.ConnOptions != nil {
+		opts = *c.config.ConnOptions
+	}
+	opts.Limits = NewLimits(c.config.MaxConns, c.config.DownloadRate, c.config.UploadRate)
+	c.opts = &opts
+	if c.config.DiskOps > 0 {
+		c.disk = make(chan struct{}, c.config.DiskOps)
+	}
+	ln, err := Listen(c.config.Port, c.config.PeerId, c.opts)
+	if err != nil {
+		return nil, err
+	}
+	c.listener = ln
+	return c, nil
+}
+
+func (c *Client) PeerId() [IDLEN]byte {
+	return c.config.PeerId
+}
+
+// Port is where the client accepts peers
+func (c *Client) Port() int {
+	return c.listener.Port()
+}
+
+// AddTorrent adds a torrent, it is stopped until Start is called
+func (c *Client) AddTorrent(tf *TorrentFile) (*Handle, error) {
+	h := &Handle{c: c, infoSHA: tf.InfoSHA}
+	h.setTorrentFile(tf)
+	err := c.add(h)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// AddMagnet adds the torrent of a magnet link, its metadata is fetched from
+// peers once it is started
+func (c *Client) AddMagnet(m *Magnet) (*Handle, error) {
+	h := &Handle{c: c, infoSHA: m.InfoSHA, magnet: m}
+	err := c.add(h)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (c *Client) add(h *Handle) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClientClosed
+	}
+	if _, ok := c.torrents[h.infoSHA]; ok {
+		return fmt.Errorf("torrent already added: %x", h.infoSHA)
+	}
+	c.torrents[h.infoSHA] = h
+	return nil
+}
+
+// Torrents returns the torrents of the client, ordered by info hash
+func (c *Client) Torrents() []*Handle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	handles := make([]*Handle, 0, len(c.torrents))
+	for _, h := range c.torrents {
+		handles = append(handles, h)
+	}
+	sort.Slice(handles, func(i, j int) bool {
+		return bytes.Compare(handles[i].infoSHA[:], handles[j].infoSHA[:]) < 0
+	})
+	return handles
+}
+
+// Torrent returns the torrent with the info hash, nil if there is none
+func (c *Client) Torrent(infoSHA [SHALEN]byte) *Handle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.torrents[infoSHA]
+}
+
+// Remove stops a torrent and drops it from the client, deleteData removes
+// its files and resume file as well
+func (c *Client) Remove(infoSHA [SHALEN]byte, deleteData bool) error {
+	c.mu.Lock()
+	h, ok := c.torrents[infoSHA]
+	delete(c.torrents, infoSHA)
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown torrent: %x", infoSHA)
+	}
+	h.remove()
+	if !deleteData {
+		return nil
+	}
+	name, err := h.dataPath()
+	if err != nil {
+		// no metadata, nothing was written
+		return nil
+	}
+	err = os.RemoveAll(name)
+	if e := os.Remove(name + ".resume"); e != nil && !os.IsNotExist(e) && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Close stops every torrent and the listener, the DHT node of the config is
+// left open
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	handles := c.torrents
+	c.torrents = make(map[[SHALEN]byte]*Handle)
+	c.mu.Unlock()
+	for _, h := range handles {
+		h.remove()
+	}
+	return c.listener.Close()
+}
+
+// task builds the task of a torrent, stored below the data directory
+func (c *Client) task(tf *TorrentFile, peers []PeerInfo, prios *Priorities) (*TorrentTask, error) {
+	name, err := filePath(c.config.DataDir, []string{tf.FileName})
+	if err != nil {
+		return nil, err
+	}
+	files, err := NewFileStorage(name, tf.PieceLen, tf.FileList())
+	if err != nil {
+		return nil, err
+	}
+	var storage Storage = files
+	if c.disk != nil {
+		storage = &diskStorage{files, c.disk}
+	}
+	return &TorrentTask{
+		PeerId:      c.config.PeerId,
+		PeerList:    peers,
+		InfoSHA:     tf.InfoSHA,
+		FileName:    name,
+		FileLen:     tf.FileLen,
+		Files:       tf.Files,
+		PieceLen:    tf.PieceLen,
+		PieceSHA:    tf.PieceSHA,
+		InfoBytes:   tf.InfoBytes,
+		Private:     tf.Private,
+		Listener:    c.listener,
+		UploadSlots: c.config.UploadSlots,
+		DHT:         c.config.DHT,
+		ConnOptions: c.opts,
+		Storage:     storage,
+		Priorities:  prios,
+		ResumeFile:  name + ".resume",
+		WebSeeds:    tf.URLList,
+	}, nil
+}
+
+// diskStorage makes the storages of a client share its disk slots
+type diskStorage struct {
+	Storage
+	slots chan struct{}
+}
+
+func (s *diskStorage) ReadAt(index int, p []byte, begin int) (int, error) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+	return s.Storage.ReadAt(index, p, begin)
+}
+
+func (s *diskStorage) WriteAt(index int, p []byte, begin int) (int, error) {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+	return s.Storage.WriteAt(index, p, begin)
+}
+
+// Handle is a torrent of a Client. It is stopped until Start, paused
+// torrents stay connected but request nothing
+type Handle struct {
+	c       *Client
+	infoSHA [SHALEN]byte
+	magnet  *Magnet // set for a magnet link
+
+	mu       sync.Mutex
+	tf       *TorrentFile // nil until the metadata of a magnet link arrived
+	prios    *Priorities
+	t        *Torrent           // nil unless running
+	cancel   context.CancelFunc // stops the run, nil while stopped
+	finished chan struct{}      // closed once the run is over or its download is done
+	err      error
+	paused   bool
+	removed  bool
+}
+
+func (h *Handle) InfoHash() [SHALEN]byte {
+	return h.infoSHA
+}
+
+// TorrentFile returns the metainfo, nil until the metadata of a magnet link
+// arrived
+func (h *Handle) TorrentFile() *TorrentFile {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.tf
+}
+
+// Priorities returns the priorities of the files, nil until the metadata of
+// a magnet link arrived
+func (h *Handle) Priorities() *Priorities {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.prios
+}
+
+// Torrent returns the running torrent, e.g. for its stats or readers, nil
+// while it is stopped
+func (h *Handle) Torrent() *Torrent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.t
+}
+
+// setTorrentFile records the metainfo, the files a magnet link does not
+// select are skipped
+func (h *Handle) setTorrentFile(tf *TorrentFile) {
+	prios := NewPriorities(len(tf.FileList()))
+	if h.magnet != nil {
+		for i := range tf.FileList() {
+			if !h.magnet.Selected(i) {
+				prios.SetFile(i, PrioritySkip)
+			}
+		}
+	}
+	h.tf = tf
+	h.prios = prios
+}
+
+// dataPath returns where the files of the torrent are stored
+func (h *Handle) dataPath() (string, error) {
+	tf := h.TorrentFile()
+	if tf == nil {
+		return "", fmt.Errorf("no metadata")
+	}
+	return filePath(h.c.config.DataDir, []string{tf.FileName})
+}
+
+// Start runs the torrent, or resumes it if it is paused. It returns right
+// away, the metadata and the peers are looked up in the background
+func (h *Handle) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.removed {
+		return fmt.Errorf("torrent removed: %x", h.infoSHA)
+	}
+	if h.paused {
+		h.paused = false
+		if h.t != nil {
+			h.t.picker.setPaused(false)
+		}
+	}
+	if h.cancel != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.finished = make(chan struct{})
+	h.err = nil
+	go h.run(ctx, h.finished)
+	return nil
+}
+
+// Pause stops requesting blocks, the peers stay connected and are still
+// served. Start resumes the torrent
+func (h *Handle) Pause() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.paused = true
+	if h.t != nil {
+		h.t.picker.setPaused(true)
+	}
+}
+
+// Stop closes the torrent and its connections, the resume file is saved so
+// Start goes on from there. Tracker requests and metadata fetches still
+// running are given up
+func (h *Handle) Stop() {
+	h.mu.Lock()
+	cancel, t, finished := h.cancel, h.t, h.finished
+	h.cancel = nil
+	h.t = nil
+	if cancel != nil {
+		// the run sees it before starting the torrent
+		cancel()
+	}
+	h.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	if t != nil {
+		t.Close()
+	}
+	<-finished
+}
+
+func (h *Handle) remove() {
+	h.mu.Lock()
+	h.removed = true
+	h.mu.Unlock()
+	h.Stop()
+}
+
+// Wait blocks until every piece we want is verified, the torrent keeps
+// seeding afterwards. It fails if the torrent is stopped first
+func (h *Handle) Wait() error {
+	h.mu.Lock()
+	finished := h.finished
+	h.mu.Unlock()
+	if finished == nil {
+		return fmt.Errorf("torrent not started: %x", h.infoSHA)
+	}
+	<-finished
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// run fetches the metadata if needed, finds peers and downloads the torrent
+func (h *Handle) run(ctx context.Context, finished chan struct{}) {
+	err := h.download(ctx)
+	if ctx.Err() != nil {
+		err = fmt.Errorf("torrent stopped: %x", h.infoSHA)
+	}
+	h.mu.Lock()
+	h.err = err
+	// a failed run is over, Start may try again
+	if err != nil && h.finished == finished && h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+		h.t = nil
+	}
+	h.mu.Unlock()
+	close(finished)
+}
+
+func (h *Handle) download(ctx context.Context) error {
+	c := h.c
+	tf := h.TorrentFile()
+	stats := metadataStats
+	if tf != nil {
+		stats = AnnounceStats{Left: int64(tf.FileLen)}
+	}
+	peers, interval := h.announce(ctx, stats)
+	if h.magnet != nil {
+		peers = append(append([]PeerInfo(nil), h.magnet.Peers...), peers...)
+		// trackerless links only have the DHT to find peers with the metadata
+		if tf == nil && c.config.DHT != nil {
+			lookup, cancel := context.WithTimeout(ctx, time.Minute)
+			found, err := dhtPeers(lookup, c.config.DHT, h.infoSHA, 0)
+			cancel()
+			if err != nil {
+				fmt.Println("dht lookup failed, " + err.Error())
+			}
+			peers = append(peers, found...)
+		}
+		if tf == nil {
+			res, err := fetchMetadataFrom(ctx, h.magnet, peers, c.config.PeerId, c.opts)
+			if err != nil {
+				return err
+			}
+			h.mu.Lock()
+			h.setTorrentFile(res)
+			h.mu.Unlock()
+			tf = res
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// opening the storage may check every piece, the handle is not locked
+	// meanwhile
+	task, err := c.task(tf, peers, h.Priorities())
+	if err != nil {
+		return err
+	}
+	t, err := Start(task)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	// stopped while starting, the torrent is not kept
+	if ctx.Err() != nil {
+		h.mu.Unlock()
+		t.Close()
+		return ctx.Err()
+	}
+	h.t = t
+	if h.paused {
+		t.picker.setPaused(true)
+	}
+	h.mu.Unlock()
+	go h.announceRoutine(ctx, t, interval)
+	return t.Wait()
+}
+
+// announce tells the trackers of the torrent about our transfer, it returns
+// their peers and the seconds they want until the next announce
+func (h *Handle) announce(ctx context.Context, stats AnnounceStats) ([]PeerInfo, int) {
+	c := h.c
+	if h.magnet != nil {
+		return h.magnet.announce(ctx, c.config.PeerId, c.Port(), stats, c.opts)
+	}
+	tf := h.TorrentFile()
+	if tf.Announce == "" {
+		return nil, 0
+	}
+	return announce(ctx, tf, c.config.PeerId, c.Port(), stats, c.opts)
+}
+
+// announceRoutine announces again at the interval the trackers asked for
+// until the torrent is stopped, the peers found are dialed while downloading
+func (h *Handle) announceRoutine(ctx context.Context, t *Torrent, interval int) {
+	for {
+		wait := time.Duration(interval) * time.Second
+		if interval <= 0 {
+			wait = DefaultAnnounceInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-t.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		var peers []PeerInfo
+		peers, interval = h.announce(ctx, t.announceStats())
+		t.AddPeers(peers)
+	}
+}
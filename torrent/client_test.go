@@ -0,0 +1,409 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitHandle fails the test unless the torrent of h finishes in time
+func waitHandle(t *testing.T, h *Handle) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- h.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download timed out")
+	}
+}
+
+func TestClientDownload(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewClient(&ClientConfig{DataDir: dir, DiskOps: 2, MaxConns: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// two torrents, each seeded by its own peer from its tracker
+	var handles []*Handle
+	var datas [][]byte
+	for _, name := range []string{"one", "two"} {
+		tf, data := newTestTorrent(t, name, 1<<14, 100000)
+		ln := newSeed(t, tf, data, nil)
+		tracker := httptest.NewServer(trackerHandler(listenerPeer(ln)))
+		defer tracker.Close()
+		tf.Announce = tracker.URL
+		h, err := c.AddTorrent(tf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Start()
+		handles = append(handles, h)
+		datas = append(datas, data)
+	}
+	for i, h := range handles {
+		waitHandle(t, h)
+		got, err := os.ReadFile(filepath.Join(dir, h.TorrentFile().FileName))
+		if err != nil || !bytes.Equal(got, datas[i]) {
+			t.Errorf("%s differs, %v", h.TorrentFile().FileName, err)
+		}
+	}
+	if len(c.Torrents()) != 2 {
+		t.Errorf("%d torrents", len(c.Torrents()))
+	}
+}
+
+func TestClientAddRemove(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewClient(&ClientConfig{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf, _ := newTestTorrent(t, "file", 1<<14, 1<<15)
+	h, err := c.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AddTorrent(tf); err == nil {
+		t.Error("torrent added twice")
+	}
+	if c.Torrent(tf.InfoSHA) != h {
+		t.Error("torrent not found by its info hash")
+	}
+	if err := h.Wait(); err == nil {
+		t.Error("Wait of a stopped torrent")
+	}
+	h.Start()
+	for h.Torrent() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.Stop()
+	// the resume file of the stopped torrent is saved
+	if _, err := os.Stat(filepath.Join(dir, "file.resume")); err != nil {
+		t.Errorf("no resume file after Stop: %v", err)
+	}
+	err = c.Remove(tf.InfoSHA, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file", "file.resume"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left after Remove", name)
+		}
+	}
+	if h.Start() == nil {
+		t.Error("removed torrent started")
+	}
+	c.Close()
+	if _, err := c.AddTorrent(tf); err == nil {
+		t.Error("torrent added to a closed client")
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 100000)
+	ln := newSeed(t, tf, data, nil)
+	c, err := NewClient(&ClientConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, _ := c.AddTorrent(tf)
+	h.Start()
+	for h.Torrent() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the peer is connected but asked for nothing
+	h.Pause()
+	h.Torrent().AddPeers([]PeerInfo{listenerPeer(ln)})
+	time.Sleep(100 * time.Millisecond)
+	if done, _ := h.Torrent().picker.progress(); done != 0 {
+		t.Fatalf("%d pieces downloaded while paused", done)
+	}
+	// Start resumes it
+	h.Start()
+	waitHandle(t, h)
+}
+
+func TestClientStartUnlocked(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 1<<16)
+	dir := t.TempDir()
+	writeFiles(t, tf, data, dir)
+	c, err := NewClient(&ClientConfig{DataDir: dir, DiskOps: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the data in place is checked on start, which waits for the disk
+	c.disk <- struct{}{}
+	h.Start()
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		h.Pause()
+		h.Torrent()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handle locked while the torrent starts")
+	}
+	<-c.disk
+	waitHandle(t, h)
+	tt := h.Torrent()
+	if tt == nil {
+		t.Fatal("torrent not running")
+	}
+	tt.picker.mu.Lock()
+	paused := tt.picker.paused
+	tt.picker.mu.Unlock()
+	if !paused {
+		t.Error("pause while starting lost")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(1 << 20)
+	start := time.Now()
+	// a second of bytes is in the bucket, the rest takes about half a second
+	r.wait(1 << 20)
+	r.wait(1 << 19)
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("1.5 seconds of bytes took %v", d)
+	}
+	if newRateLimiter(0) != nil {
+		t.Error("limiter without a rate")
+	}
+}
+
+func TestLimitsConns(t *testing.T) {
+	l := NewLimits(1, 0, 0)
+	if !l.acquire(nil) {
+		t.Fatal("no slot for the first connection")
+	}
+	if l.acquire(nil) {
+		t.Fatal("slot beyond the limit")
+	}
+	cancel := make(chan struct{})
+	got := make(chan bool)
+	go func() { got <- l.acquire(cancel) }()
+	l.release()
+	if !<-got {
+		t.Error("released slot not taken")
+	}
+	close(cancel)
+	if l.acquire(cancel) {
+		t.Error("slot taken after cancel")
+	}
+}
+
+func TestClientAnnouncesPort(t *testing.T) {
+	ports := make(chan string, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case ports <- r.URL.Query().Get("port"):
+		default:
+		}
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	tf, _ := newTestTorrent(t, "file", 1<<14, 1<<15)
+	tf.Announce = tracker.URL
+	c, err := NewClient(&ClientConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	select {
+	case port := <-ports:
+		if port != strconv.Itoa(c.Port()) {
+			t.Errorf("announced port %s, listening on %d", port, c.Port())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no announce")
+	}
+}
+
+func TestClientReannounce(t *testing.T) {
+	queries := make(chan url.Values, 4)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case queries <- r.URL.Query():
+		default:
+		}
+		w.Write([]byte("d8:intervali1e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	tf, _ := newTestTorrent(t, "file", 1<<14, 1<<15)
+	tf.Announce = tracker.URL
+	c, err := NewClient(&ClientConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	<-queries
+	for h.Torrent() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.Torrent().uploaded.Store(100)
+	// the tracker asked for an announce every second, with our transfer
+	select {
+	case q := <-queries:
+		if q.Get("uploaded") != "100" || q.Get("left") != strconv.Itoa(tf.FileLen) {
+			t.Errorf("announced uploaded %s, left %s", q.Get("uploaded"), q.Get("left"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no announce after the interval")
+	}
+}
+
+func TestClientCloseTwice(t *testing.T) {
+	tf, _ := newTestTorrent(t, "file", 1<<14, 1<<15)
+	c, err := NewClient(&ClientConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := c.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	h.Stop()
+	c.Close()
+	c.Close()
+}
+
+func TestClientDownloadsFromInboundPeer(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 1<<15)
+	dir := t.TempDir()
+	c, err := NewClient(&ClientConfig{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	for h.Torrent() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a seeder connecting to the client is asked for every block
+	peer := PeerInfo{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(c.Port())}
+	conn, err := NewConn(peer, tf.InfoSHA, [IDLEN]byte{'s'}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	field := NewBitfield(len(tf.PieceSHA))
+	for i := range tf.PieceSHA {
+		field.SetPiece(i)
+	}
+	conn.WriteMsg(&PeerMsg{MsgBitfield, field})
+	conn.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	done := make(chan error, 1)
+	go func() { done <- h.Wait() }()
+	go func() {
+		for {
+			msg, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.Id != MsgRequest {
+				continue
+			}
+			index, begin, length, err := GetRequest(msg)
+			if err != nil {
+				return
+			}
+			off := index*tf.PieceLen + begin
+			conn.WriteMsg(NewPieceMsg(index, begin, data[off:off+length]))
+		}
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing downloaded from the inbound peer")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+}
+
+func TestClientStopDuringAnnounce(t *testing.T) {
+	announced := make(chan struct{}, 1)
+	release := make(chan struct{})
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case announced <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer tracker.Close()
+	defer close(release)
+
+	tf, _ := newTestTorrent(t, "file", 1<<14, 1<<15)
+	tf.Announce = tracker.URL
+	c, err := NewClient(&ClientConfig{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	<-announced
+	stopped := make(chan struct{})
+	go func() {
+		h.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop waits for the tracker")
+	}
+}
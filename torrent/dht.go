@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go-torrent/dht"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// how often the DHT is asked for peers and told about us
+const DHTAnnounceInterval = 5 * time.Minute
+
+func NewPortMsg(port int) *PeerMsg {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(port))
+	return &PeerMsg{MsgPort, payload}
+}
+
+func GetPort(msg *PeerMsg) (int, error) {
+	if msg.Id != MsgPort {
+		return 0, fmt.Errorf("expected MsgPort (Id %d), got Id %d", MsgPort, msg.Id)
+	}
+	if len(msg.Payload) != 2 {
+		return 0, fmt.Errorf("expected payload length 2, got length %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint16(msg.Payload)), nil
+}
+
+func (t *Torrent) dhtPort() int {
+	addr, ok := t.DHT.Addr().(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+	return addr.Port
+}
+
+// handlePort adds the DHT node of a peer to our routing table
+func (t *Torrent) handlePort(c *PeerConn, msg *PeerMsg) error {
+	port, err := GetPort(msg)
+	if err != nil {
+		return err
+	}
+	if t.DHT == nil || port == 0 {
+		return nil
+	}
+	ip, ok := netip.AddrFromSlice(c.Peer.Ip)
+	if !ok {
+		return nil
+	}
+	t.DHT.AddNode(netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+	return nil
+}
+
+// dhtRoutine looks up peers in the DHT and announces us there as long as
+// the torrent is open, the peers found are dialed while downloading
+func (t *Torrent) dhtRoutine() {
+	ticker := time.NewTicker(DHTAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		// the lookup is given up once the torrent is closed
+		go func() {
+			select {
+			case <-t.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		port := 0
+		if t.Listener != nil {
+			port = t.Listener.Port()
+		}
+		peers, err := dhtPeers(ctx, t.DHT, t.InfoSHA, port)
+		cancel()
+		if err != nil {
+			fmt.Println("dht lookup failed, " + err.Error())
+		}
+		t.AddPeers(peers)
+
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dhtPeers looks up the peers of a torrent in the DHT, we are announced
+// there as well unless port is 0
+func dhtPeers(ctx context.Context, s *dht.Server, infoSHA [SHALEN]byte, port int) ([]PeerInfo, error) {
+	var addrs []netip.AddrPort
+	var err error
+	if port != 0 {
+		addrs, err = s.Announce(ctx, dht.ID(infoSHA), port)
+	} else {
+		addrs, err = s.GetPeers(ctx, dht.ID(infoSHA))
+	}
+	peers := make([]PeerInfo, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, PeerInfo{Ip: net.IP(addr.Addr().AsSlice()), Port: addr.Port()})
+	}
+	return peers, err
+}
@@ -0,0 +1,19 @@
+package torrent
+
+import (
+	"testing"
+)
+
+func TestPortMsg(t *testing.T) {
+	port, err := GetPort(NewPortMsg(6881))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 6881 {
+		t.Errorf("port %d, want 6881", port)
+	}
+	_, err = GetPort(&PeerMsg{MsgPort, []byte{1}})
+	if err == nil {
+		t.Error("short port message accepted")
+	}
+}
@@ -3,8 +3,9 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
-	"os"
+	"go-torrent/dht"
 	"time"
 )
 
@@ -14,9 +15,21 @@ type TorrentTask struct {
 	PeerList	[]PeerInfo
 	InfoSHA		[SHALEN]byte
 	FileName	string
-	FileLen		int
+	FileLen		int // of all files together
+	Files		[]FileInfo // multi-file torrents only, stored below FileName
 	PieceLen	int
 	PieceSHA	[][SHALEN]byte // hashes of all pieces, used to verify the integrity of pieces after being downloaded
+	InfoBytes	[]byte // optional, raw info dict served to peers that fetch the metadata
+	Private		bool // peers are only exchanged with the tracker, no PEX
+	Listener	*Listener // optional, serves inbound peers and keeps seeding once the download is finished
+	UploadSlots	int // peers unchoked at once including the optimistic one, DefaultUploadSlots if not set
+	Extensions	*Extensions // optional, extension messages handled besides the built-in ones
+	DHT			*dht.Server // optional, finds peers without a tracker and announces us
+	ConnOptions	*ConnOptions // optional, how peers are dialed, e.g. encryption
+	Storage		Storage // optional, the files named after FileName by default
+	Priorities	*Priorities // optional, which files and pieces are downloaded first or not at all
+	ResumeFile	string // optional, FileName + ".resume" with the default storage
+	WebSeeds	[]string // optional, BEP 19 URLs of HTTP servers holding the files
 }
 
 type pieceTask struct {
@@ -25,13 +38,16 @@ type pieceTask struct {
 	length 	int
 }
 
+// taskState is what we requested from a peer and not received yet
 type taskState struct {
-	index		int
-	conn  		*PeerConn
-	requested	int
-	downloaded	int
-	backlog		int
-	data		[]byte
+	conn		*PeerConn
+	pending		[]pendingBlock
+	pipe		pipeline // how many requests are kept pending
+}
+
+type pendingBlock struct {
+	blockRequest
+	sentAt		time.Time
 }
 
 type pieceResult struct {
@@ -39,88 +55,277 @@ type pieceResult struct {
 	data	[]byte
 }
 
-const	BLOCKSIZE = 15000
-const	MAXBLOCK = 5
+const	BLOCKSIZE = 16 * 1024
+const	MAXBLOCK = 5 // requests pending with a peer before its rate is known, and the fewest kept
 
+// Download runs a torrent until every piece we want is verified. With a
+// Listener it keeps seeding afterwards, otherwise it is closed
 func Download(task *TorrentTask) error {
+	t, err := Start(task)
+	if err != nil {
+		return err
+	}
+	err = t.Wait()
+	if err == nil && task.Listener == nil {
+		t.close()
+	}
+	return err
+}
+
+// Start runs a torrent in the background, e.g. to read it while it
+// downloads. Wait returns once it is done, Close stops it
+func Start(task *TorrentTask) (*Torrent, error) {
 	fmt.Println("start downloading " + task.FileName)
-	// initialize 2 channels
-	taskQueue := make(chan *pieceTask, len(task.PieceSHA))
-	resultQueue := make(chan *pieceResult)
-	// split torrentTask to pieceTask
-	for index, sha := range task.PieceSHA {
-		begin, end := task.getPieceBound(index)
-		taskQueue <- &pieceTask{index, sha, (end-begin)}
+	storage, err := task.openStorage()
+	if err != nil {
+		fmt.Println("fail to open storage: " + task.FileName)
+		return nil, err
+	}
+	t := newTorrent(task)
+	t.resultQueue = make(chan *pieceResult)
+	// verified pieces are written right away and served from there
+	t.setStorage(storage)
+	// pieces we have are dropped before any peer is contacted
+	t.resume = task.resumePath()
+	if t.resume != "" {
+		t.restore()
+		go t.resumeRoutine()
+	}
+	if task.Listener != nil {
+		task.Listener.Add(t)
 	}
 	// initialize goroutine for each peer
-	for _, peer := range task.PeerList {
-		go task.peerRoutine(peer, taskQueue, resultQueue)
-	}
-	// each peer, store the data in RAM
-	buf := make([]byte, task.FileLen)
-	count := 0
-	for count < len(task.PieceSHA) {
-		res := <- resultQueue
-		begin, end := task.getPieceBound(res.index)
-		// check in go routine??
-		copy(buf[begin:end], res.data)
-		count++
-		// progress
-		percent := float64(count) / float64(len(task.PieceSHA))
-		fmt.Printf("downloading, progress: (%0.2%%)\n", percent)
+	t.startDownload()
+	t.AddPeers(task.PeerList)
+	if task.DHT != nil && !task.Private {
+		go t.dhtRoutine()
 	}
-	close(taskQueue)
-	close(resultQueue)
+	for _, url := range task.WebSeeds {
+		go t.webSeedRoutine(url)
+	}
+	go t.downloadRoutine()
+	return t, nil
+}
 
-	// create file
-	file, err := os.Create(task.FileName)
+// downloadRoutine writes the verified pieces until the ones we want are
+// done, priorities may change meanwhile
+func (t *Torrent) downloadRoutine() {
+	defer close(t.finished)
+	for {
+		wait := t.picker.wait()
+		if t.picker.complete() {
+			break
+		}
+		var res *pieceResult
+		select {
+		case res = <-t.resultQueue:
+		case <-wait:
+			continue
+		case <-t.done:
+			t.stopDownload()
+			t.err = fmt.Errorf("torrent closed before the download finished")
+			return
+		}
+		err := t.writePiece(res)
+		if err != nil {
+			fmt.Printf("fail to write piece %d: %v\n", res.index, err)
+			t.stopDownload()
+			t.err = err
+			t.Close()
+			return
+		}
+		t.markPiece(res.index)
+		// progress
+		done, wanted := t.picker.progress()
+		if wanted > 0 {
+			percent := float64(done) / float64(wanted)
+			fmt.Printf("downloading, progress: (%0.2f%%)\n", percent*100)
+		}
+	}
+	t.stopDownload()
+	stats := t.Stats()
+	fmt.Printf("download finished, %d bytes received, %d bytes wasted on duplicate blocks\n", stats.Downloaded, stats.Wasted)
+	err := t.saveResume()
 	if err != nil {
-		fmt.Println("fail to create file: " + task.FileName)
-		return err
+		fmt.Println("fail to save resume file: " + err.Error())
+	}
+}
+
+// Wait blocks until every piece we want is verified, or the download failed
+func (t *Torrent) Wait() error {
+	<-t.finished
+	return t.err
+}
+
+// Close stops the torrent, drops its peers and closes its storage
+func (t *Torrent) Close() {
+	if t.Listener != nil {
+		t.Listener.Remove(t.InfoSHA)
 	}
-	_, err = file.Write(buf)
+	t.close()
+}
+func (t *Torrent) writePiece(res *pieceResult) error {
+	t.mu.Lock()
+	storage := t.storage
+	t.mu.Unlock()
+	if storage == nil {
+		return fmt.Errorf("torrent closed")
+	}
+	_, err := storage.WriteAt(res.index, res.data, 0)
 	if err != nil {
-		fmt.Println("fail to write data")
 		return err
 	}
-	return nil
+	return storage.MarkComplete(res.index)
 }
 
-func (t *TorrentTask) peerRoutine(peer PeerInfo, taskQueue chan *pieceTask, resultQueue chan *pieceResult) {
+// BlockTimeout is how long a peer may take for a block before it is
+// requested from someone else
+const BlockTimeout = 10 * time.Second
+
+func (t *Torrent) peerRoutine(peer PeerInfo) {
+	// wait for a slot under the connection limit
+	limits := t.ConnOptions.limits()
+	if !limits.acquire(t.done) {
+		return
+	}
+	defer limits.release()
 	// connect with peer
-	conn, err := NewConn(peer, t.InfoSHA, t.PeerId)
+	conn, err := NewConn(peer, t.InfoSHA, t.PeerId, t.ConnOptions)
 	if err != nil {
-		fmt.Println("fail to connect peer: " + peer.Ip.String())
+		fmt.Println("fail to connect peer: " + peer.String())
 		return
 	}
 	defer conn.Close()
+	// serve the requests of the peer while downloading from it
+	if !t.addConn(conn) {
+		return
+	}
+	defer t.removeConn(conn)
+
+	fmt.Println("successful handshake with peer: " + peer.String())
+	t.downloadFrom(conn, false)
+}
 
-	fmt.Println("successful handshake with peer: " + peer.Ip.String())
+// downloadFrom requests blocks from a connected peer until every piece we
+// want is verified. Then it goes on serving the peer if serve is set
+func (t *Torrent) downloadFrom(conn *PeerConn, serve bool) {
+	peer := conn.Peer
 	conn.WriteMsg(&PeerMsg{MsgInterested, nil})
-	// send the task back to the the task channel with any failure 
-	for task := range taskQueue {
-		// piece not found
-		if !conn.Field.HasPiece(task.index) {
-			taskQueue <- task
-			continue
+	conn.AmInterested = true
+
+	// messages are read on their own goroutine, so a peer without a block
+	// for us still tells us about its new pieces and its unchoke
+	msgs := make(chan *PeerMsg)
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go readLoop(conn, msgs, errs, quit)
+
+	// blocks still requested from the peer go back to the others
+	defer t.picker.releaseAll(conn)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	state := &taskState{conn: conn, pipe: newPipeline()}
+	conn.queueDepth.Store(int64(state.pipe.depth))
+	for !t.picker.complete() {
+		wait := t.picker.wait()
+		err := state.fill()
+		if err == nil {
+			select {
+			case msg := <-msgs:
+				err = state.handleMsg(msg)
+			case err = <-errs:
+			case <-wait:
+			case <-ticker.C:
+				state.expire()
+				state.pipe.adjust(conn.downloaded.Load(), conn.maxRequests())
+				conn.queueDepth.Store(int64(state.pipe.depth))
+			}
 		}
-		fmt.Printf("get task, index: %v, peer : %v\n", task.index, peer.Ip.String())
-		res, err := downloadPiece(conn, task)
-		// download failure
 		if err != nil {
-			taskQueue <- task
-			fmt.Println("fail to download piece" + err.Error())
+			fmt.Println("fail to download from peer " + peer.String() + ": " + err.Error())
+			return
+		}
+	}
+	if !serve {
+		return
+	}
+	conn.WriteMsg(&PeerMsg{MsgNotInterested, nil})
+	conn.AmInterested = false
+	for {
+		select {
+		case msg := <-msgs:
+			if t.serveMsg(conn, msg) != nil {
+				return
+			}
+		case <-errs:
 			return
 		}
-		// check integrity failed
-		if !checkPiece(task, res) {
-			taskQueue <- task
+	}
+}
+
+// fill requests blocks until the queue of the peer is full. While choked, only the
+// allowed fast pieces of the peer make progress
+func (state *taskState) fill() error {
+	c := state.conn
+	// blocks another peer sent in the endgame are cancelled already
+	pending := state.pending[:0]
+	for _, p := range state.pending {
+		if c.t.picker.requested(c, p.blockRequest) {
+			pending = append(pending, p)
+		}
+	}
+	state.pending = pending
+	for len(state.pending) < state.pipe.depth {
+		req, ok := c.t.picker.nextBlock(c, func(index int) bool {
+			return c.Field.HasPiece(index) && (!c.PeerChoking || c.allowedIn[index])
+		})
+		if !ok {
+			return nil
+		}
+		// index, offset, blocksize
+		_, err := c.WriteMsg(NewRequestMsg(req.index, req.begin, req.length))
+		if err != nil {
+			c.t.picker.release(c, req)
+			return err
+		}
+		state.pending = append(state.pending, pendingBlock{req, time.Now()})
+	}
+	return nil
+}
+
+// expire gives up the blocks the peer is too slow for, if they still arrive
+// they are used all the same
+func (state *taskState) expire() {
+	now := time.Now()
+	pending := state.pending[:0]
+	for _, p := range state.pending {
+		if now.Sub(p.sentAt) < BlockTimeout {
+			pending = append(pending, p)
 			continue
 		}
-		resultQueue <- res
+		fmt.Printf("block timed out, index: %v, begin: %v, peer: %v\n", p.index, p.begin, state.conn.Peer.String())
+		state.conn.t.picker.release(state.conn, p.blockRequest)
 	}
+	state.pending = pending
 }
 
+// readLoop reads the messages of a peer we download from, until the
+// connection fails or quit is closed
+func readLoop(c *PeerConn, msgs chan<- *PeerMsg, errs chan<- error, quit <-chan struct{}) {
+	for {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			errs <- err
+			return
+		}
+		select {
+		case msgs <- msg:
+		case <-quit:
+			return
+		}
+	}
+}
 
 func (t *TorrentTask) getPieceBound(index int) (begin, end int) {
 	begin = index * t.PieceLen
@@ -141,11 +346,7 @@ func checkPiece(task *pieceTask, res *pieceResult) bool {
 	return true
 }
 
-func (state *taskState) handleMsg() error {
-	msg, err := state.conn.ReadMsg()
-	if err != nil {
-		return err
-	}
+func (state *taskState) handleMsg(msg *PeerMsg) error {
 	// heartbeat
 	if msg == nil {
 		return nil
@@ -153,63 +354,100 @@ func (state *taskState) handleMsg() error {
 	// otherwise there must be an Id
 	switch msg.Id {
 	case MsgChoke:
-		state.conn.Choked = true // default
+		state.conn.PeerChoking = true // default
+		// fast peers reject each request, others drop them silently
+		if !state.conn.SupportsFast() {
+			for _, p := range state.pending {
+				state.conn.t.picker.release(state.conn, p.blockRequest)
+			}
+			state.pending = nil
+		}
 	case MsgUnchoke:
-		state.conn.Choked = false
+		state.conn.PeerChoking = false
 	case MsgHave: 
 	// once a new piece is downloaded, the peer sends a Msg and updates bitfield 
 		index, err := GetHaveIndex(msg)
 		if err != nil {
 			return err
 		}
-		state.conn.Field.SetPiece(index)
+		state.conn.t.peerHave(state.conn, index)
+	case MsgBitfield:
+		state.conn.t.setPeerField(state.conn, msg.Payload)
 	case MsgPiece:
-		// request
-		n, err := CopyPieceData(state.index, state.data, msg)
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		data := msg.Payload[8:]
+		if p, ok := state.settle(index, begin); ok {
+			state.pipe.sample(time.Since(p.sentAt))
+		}
+		state.conn.downloaded.Add(int64(len(data)))
+		state.conn.t.downloaded.Add(int64(len(data)))
+		return state.conn.t.receiveBlock(state.conn, index, begin, data)
+	case MsgReject:
+		index, begin, length, err := GetRequest(msg)
 		if err != nil {
 			return err
 		}
-		// data update after successful download
-		state.downloaded += n
-		state.backlog--
+		if _, ok := state.settle(index, begin); ok {
+			state.conn.t.picker.release(state.conn, blockRequest{index, begin, length})
+		}
+	case MsgInterested, MsgNotInterested, MsgRequest, MsgCancel:
+		return state.conn.up.handle(msg)
+	case MsgHaveAll, MsgHaveNone, MsgSuggest, MsgAllowedFast:
+		return state.conn.t.handleFastMsg(state.conn, msg)
+	case MsgExtended:
+		return state.conn.t.exts.handle(state.conn, msg.Payload)
+	case MsgPort:
+		return state.conn.t.handlePort(state.conn, msg)
 	}
 	return nil
 }
 
-func downloadPiece(conn *PeerConn, task *pieceTask) (*pieceResult, error) {
-	state := &taskState{
-		index:	task.index,
-		conn:	conn,
-		data:	make([]byte, task.length),
-	}
-	conn.SetDeadline(time.Now().Add(15 * time.Second))
-	defer conn.SetDeadline(time.Time{})
-
-	for state.downloaded < task.length {
-		// the connected peer must be unchoked
-		if !conn.Choked {
-			for state.backlog < MAXBLOCK && state.requested < task.length {
-				length := BLOCKSIZE
-				// corner case
-				if task.length - state.requested < length {
-					length = task.length - state.requested
-				}
-				// index, offset, blocksize
-				msg := NewRequestMsg(state.index, state.requested, length)
-				_, err := state.conn.WriteMsg(msg)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += length
-			}
-		}
-		err := state.handleMsg()
-		if err != nil {
-			return nil, err
+// settle removes a block from the pending requests, it reports false for
+// blocks that are not pending
+func (state *taskState) settle(index, begin int) (pendingBlock, bool) {
+	for i, p := range state.pending {
+		if p.index == index && p.begin == begin {
+			state.pending = append(state.pending[:i], state.pending[i+1:]...)
+			return p, true
 		}
 	}
-	// check the result in peerRoutine
-	return &pieceResult{state.index, state.data}, nil
+	return pendingBlock{}, false
 }
 
+// receiveBlock stores a block from c, the other peers it was requested from
+// are cancelled. The piece it completes is checked and handed to Download
+func (t *Torrent) receiveBlock(c *PeerConn, index, begin int, block []byte) error {
+	data, cancel, err := t.picker.received(c, index, begin, block)
+	if err != nil {
+		return err
+	}
+	for _, other := range cancel {
+		// a web seed sends what it fetched anyway
+		if !other.webSeed {
+			other.WriteMsg(NewCancelMsg(index, begin, len(block)))
+		}
+	}
+	if data == nil {
+		return nil
+	}
+	res := &pieceResult{index, data}
+	// check integrity failed, every block is requested again
+	if !checkPiece(&pieceTask{index, t.PieceSHA[index], len(data)}, res) {
+		if sender := t.picker.failed(index); sender == c && c.webSeed {
+			return fmt.Errorf("web seed sent a corrupt piece: %d", index)
+		}
+		return nil
+	}
+	select {
+	case t.resultQueue <- res:
+	case <-t.stopped:
+		// Download is over, e.g. the piece was skipped meanwhile
+		t.picker.failed(index)
+	case <-t.done:
+	}
+	return nil
+}
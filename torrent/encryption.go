@@ -0,0 +1,124 @@
+package torrent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go-torrent/mse"
+	"go-torrent/proxy"
+	"go-torrent/utp"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// EncryptionPolicy decides whether peer connections use MSE/PE
+type EncryptionPolicy int
+
+const (
+	EncryptionDisabled EncryptionPolicy = iota // plaintext only
+	EncryptionPrefer                           // encrypt when the peer supports it, plaintext otherwise
+	EncryptionRequire                          // drop peers that do not encrypt
+)
+
+const MSETimeout = 5 * time.Second
+
+// ConnOptions are the settings of peer connections, used by NewConn and the
+// Listener, nil means the defaults
+type ConnOptions struct {
+	Encryption EncryptionPolicy
+	Transport  Transport    // optional, TCP if nil
+	UTP        *utp.Socket  // optional, peers are dialed over Transport and uTP at once and accepted on both
+	Proxy      *proxy.Proxy // optional, takes the place of Transport and uTP for dialed peers if its policy covers them
+	Limits     *Limits      // optional, connection and rate caps shared by every peer
+}
+
+func (o *ConnOptions) proxy() *proxy.Proxy {
+	if o == nil {
+		return nil
+	}
+	return o.Proxy
+}
+
+func (o *ConnOptions) transport() Transport {
+	if o == nil || o.Transport == nil {
+		return TCP
+	}
+	return o.Transport
+}
+
+func (o *ConnOptions) encryption() EncryptionPolicy {
+	if o == nil {
+		return EncryptionDisabled
+	}
+	return o.Encryption
+}
+
+// methods returns the crypto methods we accept under the policy, RC4 is
+// always preferred by the side that selects
+func (p EncryptionPolicy) methods() mse.CryptoMethod {
+	if p == EncryptionRequire {
+		return mse.CryptoRC4
+	}
+	return mse.CryptoRC4 | mse.CryptoPlaintext
+}
+
+// encrypt runs the MSE handshake on an outbound connection
+func encrypt(conn net.Conn, infoSHA [SHALEN]byte, policy EncryptionPolicy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(MSETimeout))
+	defer conn.SetDeadline(time.Time{})
+	res, _, err := mse.Initiate(conn, infoSHA[:], policy.methods())
+	return res, err
+}
+
+// refusedEncryption reports whether an MSE handshake failed because the peer
+// hung up on it, as peers without MSE do. Timeouts and garbled answers are no
+// reason to go plaintext
+func refusedEncryption(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// bufConn replays the bytes peeked by the listener
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// acceptEncryption tells plaintext handshakes from MSE ones and answers the
+// latter with the info hashes of our torrents as SKEY, the SKEY of the peer
+// is returned for encrypted connections
+func (l *Listener) acceptEncryption(conn net.Conn) (net.Conn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(MSETimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	policy := l.opts.encryption()
+	r := bufio.NewReader(conn)
+	head, err := r.Peek(20)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn = &bufConn{conn, r}
+	if head[0] == 19 && string(head[1:20]) == "BitTorrent protocol" {
+		if policy == EncryptionRequire {
+			return nil, nil, fmt.Errorf("plaintext handshake refused")
+		}
+		return conn, nil, nil
+	}
+	if policy == EncryptionDisabled {
+		return nil, nil, fmt.Errorf("encrypted handshake refused")
+	}
+	l.mu.Lock()
+	skeys := make([][]byte, 0, len(l.torrents))
+	for infoSHA := range l.torrents {
+		skey := infoSHA
+		skeys = append(skeys, skey[:])
+	}
+	l.mu.Unlock()
+	return mse.Accept(conn, skeys, policy.methods())
+}
@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"bytes"
+	"go-torrent/mse"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestEncryptionPolicies(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 1000)
+	policies := []EncryptionPolicy{EncryptionDisabled, EncryptionPrefer, EncryptionRequire}
+	for _, listen := range policies {
+		ln := newSeed(t, tf, data, &ConnOptions{Encryption: listen})
+		for _, dial := range policies {
+			c, err := NewConn(listenerPeer(ln), tf.InfoSHA, [IDLEN]byte{'e'}, &ConnOptions{Encryption: dial})
+			// plaintext only meets encryption only
+			refused := (listen == EncryptionDisabled && dial == EncryptionRequire) ||
+				(listen == EncryptionRequire && dial == EncryptionDisabled)
+			if refused {
+				if err == nil {
+					c.Close()
+					t.Errorf("listen %d, dial %d: connected", listen, dial)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("listen %d, dial %d: %v", listen, dial, err)
+				continue
+			}
+			c.Close()
+			encrypted := listen != EncryptionDisabled && dial != EncryptionDisabled
+			if c.encrypted != encrypted {
+				t.Errorf("listen %d, dial %d: encrypted %v, want %v", listen, dial, c.encrypted, encrypted)
+			}
+		}
+	}
+}
+
+// fakePeer accepts connections and hands them to serve, it returns its
+// address and the number of connections accepted so far
+func fakePeer(t *testing.T, serve func(i int, conn net.Conn)) (PeerInfo, func() int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan int, 8)
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- i + 1
+			go func() {
+				defer conn.Close()
+				serve(i, conn)
+			}()
+		}
+	}()
+	count := func() int {
+		n := 0
+		for {
+			select {
+			case n = <-accepted:
+			default:
+				return n
+			}
+		}
+	}
+	return PeerInfo{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Addr().(*net.TCPAddr).Port)}, count
+}
+
+func TestEncryptionFallback(t *testing.T) {
+	// a peer without MSE hangs up on the key exchange, the plaintext
+	// handshake follows on a new connection
+	plain := make(chan []byte, 1)
+	peer, count := fakePeer(t, func(i int, conn net.Conn) {
+		buf := make([]byte, 20)
+		io.ReadFull(conn, buf)
+		if i == 1 {
+			plain <- buf
+		}
+	})
+	opts := &ConnOptions{Encryption: EncryptionPrefer}
+	if c, err := NewConn(peer, [SHALEN]byte{1}, [IDLEN]byte{'e'}, opts); err == nil {
+		c.Close()
+	}
+	if got := <-plain; !bytes.Equal(got, []byte("\x13BitTorrent protocol")) {
+		t.Errorf("second connection got %q", got)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+
+	// an answer that is not MSE is no refusal, the peer is not dialed again
+	peer, count = fakePeer(t, func(i int, conn net.Conn) {
+		conn.Write(make([]byte, 2048))
+		io.Copy(io.Discard, conn)
+	})
+	if c, err := NewConn(peer, [SHALEN]byte{1}, [IDLEN]byte{'e'}, opts); err == nil {
+		c.Close()
+		t.Fatal("connected to a peer answering garbage")
+	}
+	if n := count(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+func TestRefusedEncryption(t *testing.T) {
+	for _, err := range []error{io.EOF, io.ErrUnexpectedEOF, &net.OpError{Op: "read", Err: syscall.ECONNRESET}} {
+		if !refusedEncryption(err) {
+			t.Errorf("%v is no refusal", err)
+		}
+	}
+	for _, err := range []error{os.ErrDeadlineExceeded, mse.ErrSync} {
+		if refusedEncryption(err) {
+			t.Errorf("%v taken for a refusal", err)
+		}
+	}
+}
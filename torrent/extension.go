@@ -0,0 +1,187 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-torrent/bencode"
+	"sync"
+)
+
+// BEP 10: every extension message is sent as MsgExtended, the first byte of
+// the payload picks the sub message, 0 being the extended handshake
+const (
+	MsgExtended    MsgId = 20
+	ExtHandshakeId byte  = 0
+)
+
+const ClientVersion = "go-torrent 0.1"
+
+var ErrExtNotSupported = errors.New("extension not supported by peer")
+
+// ExtHandshake is the bencoded dict of the extended handshake, M maps the
+// name of each supported extension to the id the sender wants to receive it with
+type ExtHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	YourIp       string         `bencode:"yourip,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// ExtensionHandler handles the payload of an extension message, the
+// sub message id is already stripped
+type ExtensionHandler func(c *PeerConn, payload []byte) error
+
+// Extensions is a registry of extension messages by name, the ids we
+// advertise are assigned in registration order
+type Extensions struct {
+	mu       sync.RWMutex
+	names    []string
+	handlers map[string]ExtensionHandler
+}
+
+func NewExtensions() *Extensions {
+	return &Extensions{
+		handlers: make(map[string]ExtensionHandler),
+	}
+}
+
+// Register adds or replaces the handler of an extension
+func (e *Extensions) Register(name string, h ExtensionHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.handlers[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	e.handlers[name] = h
+}
+
+// clone copies the registry, so a torrent can add its own handlers to the
+// ones given in the task
+func (e *Extensions) clone() *Extensions {
+	res := NewExtensions()
+	if e == nil {
+		return res
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, name := range e.names {
+		res.Register(name, e.handlers[name])
+	}
+	return res
+}
+
+// ids returns the "m" dict of our extended handshake
+func (e *Extensions) ids() map[string]int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	m := make(map[string]int, len(e.names))
+	for i, name := range e.names {
+		m[name] = i + 1
+	}
+	return m
+}
+
+// handle routes an extension message to the handler registered for its id
+func (e *Extensions) handle(c *PeerConn, payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("empty extension message")
+	}
+	id := payload[0]
+	if id == ExtHandshakeId {
+		err := c.readExtHandshake(payload[1:])
+		if err != nil {
+			return err
+		}
+		if addr, ok := c.pexAddr(); ok && c.t != nil {
+			c.t.rememberPeer(addr)
+		}
+		return nil
+	}
+	e.mu.RLock()
+	var h ExtensionHandler
+	if int(id) <= len(e.names) {
+		h = e.handlers[e.names[id-1]]
+	}
+	e.mu.RUnlock()
+	// unknown ids are ignored, the peer may still have an old mapping
+	if h == nil {
+		return nil
+	}
+	return h(c, payload[1:])
+}
+
+func (c *PeerConn) readExtHandshake(payload []byte) error {
+	hs := new(ExtHandshake)
+	err := bencode.Unmarshal(bytes.NewReader(payload), hs)
+	if err != nil {
+		return err
+	}
+	if hs.M == nil {
+		hs.M = map[string]int{}
+	}
+	c.mu.Lock()
+	// later handshakes only update the mapping, 0 disables an extension
+	if c.Ext != nil {
+		for name, id := range c.Ext.M {
+			if _, ok := hs.M[name]; !ok {
+				hs.M[name] = id
+			}
+		}
+	}
+	for name, id := range hs.M {
+		if id == 0 {
+			delete(hs.M, name)
+		}
+	}
+	c.Ext = hs
+	c.mu.Unlock()
+	return nil
+}
+
+// SupportsExtensions reports whether the peer set the extension bit
+func (c *PeerConn) SupportsExtensions() bool {
+	return c.Reserved.Has(ExtensionBit)
+}
+
+// ExtHandshake returns the extended handshake of the peer, nil until it is received
+func (c *PeerConn) ExtHandshake() *ExtHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Ext
+}
+
+// extId returns the id the peer wants to receive an extension with, 0 if unsupported
+func (c *PeerConn) extId(name string) int {
+	hs := c.ExtHandshake()
+	if hs == nil {
+		return 0
+	}
+	return hs.M[name]
+}
+
+// WriteExtMsg sends an extension message with the id the peer asked for
+func (c *PeerConn) WriteExtMsg(name string, payload []byte) error {
+	id := c.extId(name)
+	if id == 0 {
+		return ErrExtNotSupported
+	}
+	_, err := c.WriteMsg(NewExtMsg(byte(id), payload))
+	return err
+}
+
+func (c *PeerConn) WriteExtHandshake(hs *ExtHandshake) error {
+	buf := new(bytes.Buffer)
+	bencode.Marshal(buf, hs)
+	_, err := c.WriteMsg(NewExtMsg(ExtHandshakeId, buf.Bytes()))
+	return err
+}
+
+func NewExtMsg(id byte, payload []byte) *PeerMsg {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &PeerMsg{MsgExtended, buf}
+}
@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReservedBits(t *testing.T) {
+	msg := NewHandShakeMsg([SHALEN]byte{}, [IDLEN]byte{})
+	if !msg.Reserved.Has(ExtensionBit) {
+		t.Fatal("extension bit not set")
+	}
+	if msg.Reserved[5] != 0x10 {
+		t.Errorf("reserved[5] = %#x, want 0x10", msg.Reserved[5])
+	}
+}
+
+func TestExtHandshakeUpdate(t *testing.T) {
+	exts := NewExtensions()
+	c := &PeerConn{}
+	first := append([]byte{ExtHandshakeId}, "d1:md6:ut_pexi1e11:ut_metadatai2ee1:v4:teste"...)
+	err := exts.handle(c, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := c.extId("ut_metadata"); id != 2 {
+		t.Errorf("ut_metadata id = %d, want 2", id)
+	}
+	if v := c.ExtHandshake().V; v != "test" {
+		t.Errorf("version = %q, want test", v)
+	}
+	// a later handshake without "m" keeps the mapping
+	err = exts.handle(c, append([]byte{ExtHandshakeId}, "d1:v5:othere"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := c.extId("ut_metadata"); id != 2 {
+		t.Errorf("ut_metadata id = %d after a handshake without m, want 2", id)
+	}
+	// 0 disables an extension, the others are kept
+	err = exts.handle(c, append([]byte{ExtHandshakeId}, "d1:md6:ut_pexi0eee"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := c.extId("ut_pex"); id != 0 {
+		t.Errorf("ut_pex id = %d, want 0", id)
+	}
+	if id := c.extId("ut_metadata"); id != 2 {
+		t.Errorf("ut_metadata id = %d, want 2", id)
+	}
+}
+
+func TestExtHandshakeWithoutM(t *testing.T) {
+	c := &PeerConn{}
+	err := NewExtensions().handle(c, append([]byte{ExtHandshakeId}, "de"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.extId("ut_pex") != 0 {
+		t.Error("unexpected extension")
+	}
+	// a later handshake fills the empty mapping
+	err = NewExtensions().handle(c, append([]byte{ExtHandshakeId}, "d1:md6:ut_pexi1eee"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.extId("ut_pex") != 1 {
+		t.Error("extension of a later handshake missing")
+	}
+}
+
+func TestExtensionsRoute(t *testing.T) {
+	exts := NewExtensions()
+	var got []byte
+	exts.Register("a", func(c *PeerConn, payload []byte) error { return nil })
+	exts.Register("b", func(c *PeerConn, payload []byte) error {
+		got = payload
+		return nil
+	})
+	if ids := exts.ids(); ids["a"] != 1 || ids["b"] != 2 {
+		t.Fatalf("ids = %v", ids)
+	}
+	err := exts.handle(&PeerConn{}, []byte{2, 'x'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "x" {
+		t.Errorf("payload = %q, want x", got)
+	}
+	// unknown ids are ignored
+	err = exts.handle(&PeerConn{}, []byte{9})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtHandshakeRemembersPeer(t *testing.T) {
+	tt := &Torrent{known: make(map[string]struct{})}
+	c := &PeerConn{Peer: PeerInfo{Ip: net.IPv4(127, 0, 0, 1), Port: 50000}, t: tt}
+	err := NewExtensions().handle(c, append([]byte{ExtHandshakeId}, "d1:pi6881ee"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the port an inbound peer listens on is not dialed again
+	if _, ok := tt.known["127.0.0.1:6881"]; !ok {
+		t.Errorf("listen port of the peer not remembered, known %v", tt.known)
+	}
+}
@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// BEP 6: with the fast extension a peer starts with a bitfield, Have All or
+// Have None, and every request is answered by the block or a reject
+const (
+	MsgSuggest     MsgId = 0x0D
+	MsgHaveAll     MsgId = 0x0E
+	MsgHaveNone    MsgId = 0x0F
+	MsgReject      MsgId = 0x10
+	MsgAllowedFast MsgId = 0x11
+)
+
+const (
+	AllowedFastK = 10 // pieces a choked peer may still request from us
+	MaxSuggested = 32 // suggestions kept per peer, older ones are dropped
+)
+
+func (c *PeerConn) SupportsFast() bool {
+	return c.Reserved.Has(FastBit)
+}
+
+// allowedFastSet generates the k pieces a peer at ip may request while
+// choked, as specified by BEP 6. BEP 6 only covers IPv4, where the /24 of the
+// peer is hashed, IPv6 peers hash their /48 the same way
+func allowedFastSet(ip net.IP, infoSHA [SHALEN]byte, numPieces, k int) []int {
+	if numPieces == 0 {
+		return nil
+	}
+	var x []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		x = append(x, ip16[:6]...)
+		x = append(x, make([]byte, Ip6Len-6)...)
+	} else {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	x = append(x, infoSHA[:]...)
+	set := make([]int, 0, k)
+	seen := make(map[int]bool, k)
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < SHALEN/4 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sizeField fits the bitfield of the peer to the piece count, which is only
+// known once the connection belongs to a torrent
+func (c *PeerConn) sizeField(numPieces int) {
+	field := NewBitfield(numPieces)
+	if c.haveAll {
+		for i := 0; i < numPieces; i++ {
+			field.SetPiece(i)
+		}
+		c.haveAll = false
+	} else {
+		copy(field, c.Field)
+	}
+	c.Field = field
+}
+
+// sendBitfield must be the first message after the handshake, peers without
+// the fast extension get nothing if we have nothing
+func (t *Torrent) sendBitfield(c *PeerConn, field Bitfield) error {
+	all, none := true, true
+	for i := range t.PieceSHA {
+		if field.HasPiece(i) {
+			none = false
+		} else {
+			all = false
+		}
+	}
+	var err error
+	switch {
+	case c.SupportsFast() && all:
+		_, err = c.WriteMsg(&PeerMsg{MsgHaveAll, nil})
+	case c.SupportsFast() && none:
+		_, err = c.WriteMsg(&PeerMsg{MsgHaveNone, nil})
+	case !none:
+		_, err = c.WriteMsg(&PeerMsg{MsgBitfield, field})
+	}
+	return err
+}
+
+// sendAllowedFast tells the peer which pieces it may request while choked
+func (t *Torrent) sendAllowedFast(c *PeerConn) {
+	for index := range c.allowedOut {
+		_, err := c.WriteMsg(NewAllowedFastMsg(index))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleFastMsg processes the fast extension messages that do not belong to
+// a pending request
+func (t *Torrent) handleFastMsg(c *PeerConn, msg *PeerMsg) error {
+	switch msg.Id {
+	case MsgHaveAll:
+		c.haveAll = true
+		t.setPeerField(c, nil)
+	case MsgHaveNone:
+		c.haveAll = false
+		t.setPeerField(c, nil)
+	case MsgSuggest:
+		index, err := GetHaveIndex(msg)
+		if err != nil {
+			return err
+		}
+		if index >= len(t.PieceSHA) {
+			return nil
+		}
+		c.suggested = append(c.suggested, index)
+		if len(c.suggested) > MaxSuggested {
+			c.suggested = c.suggested[1:]
+		}
+	case MsgAllowedFast:
+		index, err := GetHaveIndex(msg)
+		if err != nil {
+			return err
+		}
+		if index >= len(t.PieceSHA) {
+			return nil
+		}
+		if c.allowedIn == nil {
+			c.allowedIn = make(map[int]bool)
+		}
+		c.allowedIn[index] = true
+	}
+	return nil
+}
+
+func NewRejectMsg(index, begin, length int) *PeerMsg {
+	msg := NewRequestMsg(index, begin, length)
+	msg.Id = MsgReject
+	return msg
+}
+
+func NewSuggestMsg(index int) *PeerMsg {
+	msg := NewHaveMsg(index)
+	msg.Id = MsgSuggest
+	return msg
+}
+
+func NewAllowedFastMsg(index int) *PeerMsg {
+	msg := NewHaveMsg(index)
+	msg.Id = MsgAllowedFast
+	return msg
+}
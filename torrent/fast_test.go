@@ -0,0 +1,138 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// the reference vectors of BEP 6
+	var infoSHA [SHALEN]byte
+	for i := range infoSHA {
+		infoSHA[i] = 0xaa
+	}
+	ip := net.IPv4(80, 4, 4, 200)
+	got := allowedFastSet(ip, infoSHA, 1313, 7)
+	if want := []int{1059, 431, 808, 1217, 287, 376, 1188}; !slices.Equal(got, want) {
+		t.Errorf("k=7: %v, want %v", got, want)
+	}
+	got = allowedFastSet(ip, infoSHA, 1313, 9)
+	if want := []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}; !slices.Equal(got, want) {
+		t.Errorf("k=9: %v, want %v", got, want)
+	}
+	// small torrents get every piece
+	if got := allowedFastSet(ip, infoSHA, 3, AllowedFastK); len(got) != 3 {
+		t.Errorf("%d pieces allowed out of 3", len(got))
+	}
+
+	// IPv6 peers of the same /48 share a set
+	a := allowedFastSet(net.ParseIP("2001:db8:1::1"), infoSHA, 1313, AllowedFastK)
+	b := allowedFastSet(net.ParseIP("2001:db8:1:ffff::2"), infoSHA, 1313, AllowedFastK)
+	c := allowedFastSet(net.ParseIP("2001:db8:2::1"), infoSHA, 1313, AllowedFastK)
+	if len(a) != AllowedFastK || !slices.Equal(a, b) {
+		t.Errorf("sets of the same /48 differ: %v, %v", a, b)
+	}
+	if slices.Equal(a, c) {
+		t.Error("sets of another /48 are the same")
+	}
+}
+
+func TestHaveAllNone(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 100000)
+	ln := newSeed(t, tf, data, nil)
+	c, err := NewConn(listenerPeer(ln), tf.InfoSHA, [IDLEN]byte{'f'}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if !c.haveAll {
+		t.Error("seed did not send have all")
+	}
+
+	// a torrent without verified pieces sends have none
+	empty, err := Listen(0, [IDLEN]byte{'e'}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	empty.Add(newTorrent(newTestTask(tf, t.TempDir())))
+	c, err = NewConn(listenerPeer(empty), tf.InfoSHA, [IDLEN]byte{'f'}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.haveAll || !bytes.Equal(c.Field, nil) {
+		t.Errorf("have all %v, bitfield %x", c.haveAll, c.Field)
+	}
+
+	// the messages fit the bitfield to the torrent
+	tt := newTorrent(&TorrentTask{PieceSHA: make([][SHALEN]byte, 10)})
+	defer tt.close()
+	c = &PeerConn{}
+	tt.handleFastMsg(c, &PeerMsg{MsgHaveAll, nil})
+	if len(c.Field) != 2 || !c.Field.HasPiece(9) {
+		t.Errorf("bitfield after have all: %x", c.Field)
+	}
+	tt.handleFastMsg(c, &PeerMsg{MsgHaveNone, nil})
+	if c.Field.HasPiece(0) {
+		t.Errorf("bitfield after have none: %x", c.Field)
+	}
+}
+
+// readPieceReply skips the messages sent after the handshake until the
+// answer to a request
+func readPieceReply(t *testing.T, c *PeerConn) *PeerMsg {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetDeadline(time.Time{})
+	for {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != nil && (msg.Id == MsgPiece || msg.Id == MsgReject) {
+			return msg
+		}
+	}
+}
+
+func TestRejectWhileChoked(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 40<<14)
+	ln := newSeed(t, tf, data, nil)
+	c, err := NewConn(listenerPeer(ln), tf.InfoSHA, [IDLEN]byte{'f'}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	allowed := allowedFastSet(c.Peer.Ip, tf.InfoSHA, len(tf.PieceSHA), AllowedFastK)
+	notAllowed := 0
+	for slices.Contains(allowed, notAllowed) {
+		notAllowed++
+	}
+
+	// we are not interested, so the seed keeps choking us
+	c.WriteMsg(NewRequestMsg(notAllowed, 0, 1<<10))
+	msg := readPieceReply(t, c)
+	if msg.Id != MsgReject {
+		t.Fatalf("got message %d, want reject", msg.Id)
+	}
+	index, _, length, err := GetRequest(msg)
+	if err != nil || index != notAllowed || length != 1<<10 {
+		t.Errorf("reject of piece %d length %d, %v", index, length, err)
+	}
+
+	// allowed fast pieces are served anyway
+	c.WriteMsg(NewRequestMsg(allowed[0], 0, 1<<10))
+	msg = readPieceReply(t, c)
+	if msg.Id != MsgPiece {
+		t.Fatalf("got message %d, want piece", msg.Id)
+	}
+	buf := make([]byte, 1<<10)
+	_, err = CopyPieceData(allowed[0], buf, msg)
+	if err != nil || !bytes.Equal(buf, data[allowed[0]<<14:allowed[0]<<14+1<<10]) {
+		t.Errorf("allowed fast block differs, %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FS is the file tree of a torrent as an fs.FS. Sizes and modes come from
+// the metainfo, so the tree is complete before any data is there
+type FS struct {
+	paths   []string // of each file, slash separated
+	lengths []int
+	dirs    map[string][]fs.DirEntry // sorted entries of each directory, "." is the root
+	open    func(index int) (io.ReadSeekCloser, error)
+	close   func() error
+}
+
+// FS returns the files of a running torrent, reads go through a Reader. A
+// read of a piece that is not verified yet waits for it, unless failFast is
+// set, then it fails with ErrNotDownloaded. The Reader is only created by
+// the first read, so opening a file, e.g. to stat it, fetches nothing
+func (t *Torrent) FS(failFast bool) *FS {
+	l := newLayout(t.Files, t.PieceLen, t.FileLen)
+	return newFS(t.FileName, t.Files, t.FileLen, func(index int) (io.ReadSeekCloser, error) {
+		if index < 0 || index >= len(l.files) {
+			return nil, fmt.Errorf("file index out of range: %d", index)
+		}
+		return &lazyReader{size: int64(l.files[index].Length), open: func() (io.ReadSeekCloser, error) {
+			r, err := t.NewReader(index)
+			if err != nil {
+				return nil, err
+			}
+			r.failFast = failFast
+			return r, nil
+		}}, nil
+	}, nil)
+}
+
+// lazyReader opens its reader on the first read, seeks before it are kept
+type lazyReader struct {
+	open func() (io.ReadSeekCloser, error)
+	r    io.ReadSeekCloser
+	pos  int64
+	size int64
+}
+
+func (l *lazyReader) Read(b []byte) (int, error) {
+	if l.r == nil {
+		r, err := l.open()
+		if err != nil {
+			return 0, err
+		}
+		if l.pos != 0 {
+			_, err = r.Seek(l.pos, io.SeekStart)
+			if err != nil {
+				r.Close()
+				return 0, err
+			}
+		}
+		l.r = r
+	}
+	return l.r.Read(b)
+}
+
+func (l *lazyReader) Seek(offset int64, whence int) (int64, error) {
+	if l.r != nil {
+		return l.r.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += l.pos
+	case io.SeekEnd:
+		offset += l.size
+	case io.SeekStart:
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	l.pos = offset
+	return offset, nil
+}
+
+func (l *lazyReader) Close() error {
+	if l.r == nil {
+		return nil
+	}
+	return l.r.Close()
+}
+
+// OpenFS returns the files of a complete torrent below dir read-only, e.g.
+// for tools that check them. Reads of missing files fail. Close it once done
+func OpenFS(tf *TorrentFile, dir string) (*FS, error) {
+	storage, err := OpenFileStorage(filepath.Join(dir, tf.FileName), tf.PieceLen, tf.FileList())
+	if err != nil {
+		return nil, err
+	}
+	l := newLayout(tf.Files, tf.PieceLen, tf.FileLen)
+	return newFS(tf.FileName, tf.Files, tf.FileLen, func(index int) (io.ReadSeekCloser, error) {
+		return &storageReader{
+			storage:  storage,
+			pieceLen: tf.PieceLen,
+			offset:   int64(l.offsets[index]),
+			length:   int64(l.files[index].Length),
+		}, nil
+	}, storage.Close), nil
+}
+
+func newFS(name string, files []FileInfo, totalLen int, open func(int) (io.ReadSeekCloser, error), close func() error) *FS {
+	l := newLayout(files, 0, totalLen)
+	f := &FS{
+		paths: torrentPaths(name, files),
+		dirs:  map[string][]fs.DirEntry{".": nil},
+		open:  open,
+		close: close,
+	}
+	for i, p := range f.paths {
+		f.lengths = append(f.lengths, l.files[i].Length)
+		f.addEntry(p, &fileInfo{name: path.Base(p), size: int64(l.files[i].Length)})
+	}
+	for _, entries := range f.dirs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	}
+	return f
+}
+
+// addEntry adds a file to its directory, and the directories above it
+func (f *FS) addEntry(name string, info *fileInfo) {
+	dir := path.Dir(name)
+	if _, ok := f.dirs[dir]; !ok {
+		f.addEntry(dir, &fileInfo{name: path.Base(dir), dir: true})
+		f.dirs[dir] = nil
+	}
+	f.dirs[dir] = append(f.dirs[dir], fs.FileInfoToDirEntry(info))
+}
+
+// Close closes the storage of an FS from OpenFS, it is a no-op otherwise
+func (f *FS) Close() error {
+	if f.close == nil {
+		return nil
+	}
+	return f.close()
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entries, ok := f.dirs[name]; ok {
+		return &dirFile{info: f.dirInfo(name), entries: entries}, nil
+	}
+	for i, p := range f.paths {
+		if p != name {
+			continue
+		}
+		r, err := f.open(i)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &file{ReadSeekCloser: r, info: &fileInfo{name: path.Base(p), size: int64(f.lengths[i])}}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if _, ok := f.dirs[name]; ok {
+		return f.dirInfo(name), nil
+	}
+	for i, p := range f.paths {
+		if p == name {
+			return &fileInfo{name: path.Base(p), size: int64(f.lengths[i])}, nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, ok := f.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]fs.DirEntry(nil), entries...), nil
+}
+
+func (f *FS) dirInfo(name string) *fileInfo {
+	return &fileInfo{name: path.Base(name), dir: true}
+}
+
+// fileInfo describes a file or directory of the torrent, files are read-only
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) ModTime() time.Time { return time.Time{} }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) Sys() any           { return nil }
+
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type file struct {
+	io.ReadSeekCloser
+	info *fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type dirFile struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *dirFile) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries, all of the rest if n <= 0
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return append([]fs.DirEntry(nil), rest...), nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return append([]fs.DirEntry(nil), rest[:n]...), nil
+}
+
+// storageReader reads a file of a torrent straight from its storage, each
+// read stays within a piece
+type storageReader struct {
+	storage  Storage
+	pieceLen int
+	offset   int64 // of the file in the torrent
+	length   int64
+	pos      int64
+}
+
+func (r *storageReader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	off := r.offset + r.pos
+	index := int(off / int64(r.pieceLen))
+	begin := int(off - int64(index)*int64(r.pieceLen))
+	n := min(len(p), r.pieceLen-begin)
+	if rest := r.length - r.pos; int64(n) > rest {
+		n = int(rest)
+	}
+	n, err := r.storage.ReadAt(index, p[:n], begin)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *storageReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close leaves the storage open, it belongs to the FS
+func (r *storageReader) Close() error {
+	return nil
+}
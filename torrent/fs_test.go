@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// newNestedTorrent returns a torrent of the files sub/x/a, sub/b and c
+func newNestedTorrent(t *testing.T) (*TorrentFile, []byte) {
+	t.Helper()
+	tf, data := newTestTorrent(t, "dir", 1<<10, 1000, 2000, 500)
+	tf.Files[0].Path = []string{"sub", "x", "a"}
+	tf.Files[1].Path = []string{"sub", "b"}
+	tf.Files[2].Path = []string{"c"}
+	return tf, data
+}
+
+func TestOpenFS(t *testing.T) {
+	tf, data := newNestedTorrent(t)
+	dir := t.TempDir()
+	writeFiles(t, tf, data, dir)
+	fsys, err := OpenFS(tf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsys.Close()
+	err = fstest.TestFS(fsys, "sub/x/a", "sub/b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile(fsys, "sub/b")
+	if err != nil || !bytes.Equal(got, data[1000:3000]) {
+		t.Errorf("sub/b differs, %v", err)
+	}
+}
+
+func TestFSTree(t *testing.T) {
+	tf, _ := newNestedTorrent(t)
+	fsys := newFS(tf.FileName, tf.Files, tf.FileLen, nil, nil)
+	entries, err := fsys.ReadDir("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "b" || entries[1].Name() != "x" || !entries[1].IsDir() {
+		t.Errorf("entries of sub: %v", entries)
+	}
+	info, err := fsys.Stat("sub/x/a")
+	if err != nil || info.Size() != 1000 || info.Mode() != 0444 {
+		t.Errorf("stat of sub/x/a: %v, %v", info, err)
+	}
+	info, err = fsys.Stat("sub/x")
+	if err != nil || !info.IsDir() {
+		t.Errorf("stat of sub/x: %v, %v", info, err)
+	}
+	if _, err := fsys.Stat("sub/none"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a missing file: %v", err)
+	}
+	if _, err := fsys.Open("/sub"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("open of an invalid path: %v", err)
+	}
+	d, err := fsys.Open("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	first, err := d.(fs.ReadDirFile).ReadDir(1)
+	if err != nil || len(first) != 1 || first[0].Name() != "b" {
+		t.Errorf("first entry %v, %v", first, err)
+	}
+	if _, err := d.Read(make([]byte, 1)); err == nil {
+		t.Error("read of a directory")
+	}
+}
+
+func TestTorrentFS(t *testing.T) {
+	tf, data := newNestedTorrent(t)
+	ln := newSeed(t, tf, data, nil)
+	tt, err := Start(newTestTask(tf, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+
+	// nothing is verified yet, fail-fast reads do not wait
+	f, err := tt.FS(true).Open("sub/x/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// opening alone does not make the pieces of the file urgent
+	if n := len(tt.readerList()); n != 0 {
+		t.Fatalf("%d readers after open", n)
+	}
+	tt.picker.mu.Lock()
+	prios := append([]Priority(nil), tt.picker.prio...)
+	tt.picker.mu.Unlock()
+	for i, prio := range prios {
+		if prio != PriorityNormal {
+			t.Fatalf("piece %d has priority %d after open", i, prio)
+		}
+	}
+	_, err = f.Read(make([]byte, 10))
+	if n := len(tt.readerList()); n != 1 {
+		t.Errorf("%d readers after read, want 1", n)
+	}
+	f.Close()
+	if !errors.Is(err, ErrNotDownloaded) {
+		t.Fatalf("fail-fast read: %v", err)
+	}
+
+	tt.AddPeers([]PeerInfo{listenerPeer(ln)})
+	fsys := tt.FS(false)
+	got, err := fs.ReadFile(fsys, "c")
+	if err != nil || !bytes.Equal(got, data[3000:]) {
+		t.Fatalf("c differs, %v", err)
+	}
+	err = tt.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fstest.TestFS(fsys, "sub/x/a", "sub/b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ = fsys.Open("sub/b")
+	defer f.Close()
+	f.(io.Seeker).Seek(1500, io.SeekStart)
+	got, _ = io.ReadAll(f)
+	if !bytes.Equal(got, data[2500:3000]) {
+		t.Error("read after seek differs")
+	}
+}
@@ -6,9 +6,10 @@ import (
 )
 
 type HandshakeMsg struct {
-	PreStr  string
-	InfoSHA [SHALEN]byte
-	PeerId  [IDLEN]byte
+	PreStr   string
+	Reserved ReservedBits
+	InfoSHA  [SHALEN]byte
+	PeerId   [IDLEN]byte
 }
 
 const (
@@ -16,12 +17,35 @@ const (
 	HsMsgLen int = Reserved + SHALEN + IDLEN
 )
 
+// ReservedBits announce the extensions supported by a peer, bits are
+// numbered from the right end as in the BEPs
+type ReservedBits [Reserved]byte
+
+const (
+	ExtensionBit int = 20 // BEP 10, reserved[5] & 0x10
+	DHTBit       int = 0  // BEP 5, reserved[7] & 0x01
+	FastBit      int = 2  // BEP 6, reserved[7] & 0x04
+)
+
+func (r ReservedBits) Has(bit int) bool {
+	return r[Reserved-1-bit/8]&(1<<uint(bit%8)) != 0
+}
+
+func (r *ReservedBits) Set(bit int) {
+	r[Reserved-1-bit/8] |= 1 << uint(bit%8)
+}
+
 func NewHandShakeMsg(infoSHA [SHALEN]byte, peerId [IDLEN]byte) *HandshakeMsg {
-	return &HandshakeMsg{
+	msg := &HandshakeMsg{
 		PreStr:  "BitTorrent protocol",
 		InfoSHA: infoSHA,
 		PeerId:  peerId,
 	}
+	msg.Reserved.Set(ExtensionBit)
+	// only torrents with a DHT node send PORT, but we always understand it
+	msg.Reserved.Set(DHTBit)
+	msg.Reserved.Set(FastBit)
+	return msg
 }
 
 // components: 1(length of protocol) + protocol + reserved + info
@@ -30,7 +54,7 @@ func WriteHandShake(w io.Writer, msg *HandshakeMsg) (int, error) {
 	buf[0] = byte(len(msg.PreStr))
 	curr := 1
 	curr += copy(buf[curr:], []byte(msg.PreStr))
-	curr += copy(buf[curr:], make([]byte, Reserved))
+	curr += copy(buf[curr:], msg.Reserved[:])
 	curr += copy(buf[curr:], msg.InfoSHA[:])
 	curr += copy(buf[curr:], msg.PeerId[:])
 	return w.Write(buf)
@@ -55,15 +79,18 @@ func ReadHandshake(r io.Reader) (*HandshakeMsg, error) {
 		return nil, err
 	}
 
+	var reserved ReservedBits
 	var InfoSHA [SHALEN]byte
 	var PeerId	[IDLEN]byte
 
+	copy(reserved[:], msgBuf[prelen : prelen+Reserved])
 	copy(InfoSHA[:], msgBuf[prelen+Reserved : prelen+Reserved+SHALEN])
 	copy(PeerId[:], msgBuf[prelen+Reserved+SHALEN : prelen+Reserved+SHALEN+IDLEN])
 
 
 	return &HandshakeMsg {
 		PreStr: 	string(msgBuf[0:prelen]),
+		Reserved:	reserved,
 		InfoSHA: 	InfoSHA,
 		PeerId: 	PeerId,
 	}, nil
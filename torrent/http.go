@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filePaths returns the slash separated path of each file of the torrent,
+// the base of FileName for a single-file torrent
+func (t *Torrent) filePaths() []string {
+	return torrentPaths(t.FileName, t.Files)
+}
+
+func torrentPaths(name string, files []FileInfo) []string {
+	if len(files) == 0 {
+		return []string{path.Base(filepath.ToSlash(name))}
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = strings.Join(f.Path, "/")
+	}
+	return paths
+}
+
+// Handler serves the files of a torrent over HTTP while it downloads. The
+// root lists them, each file is served at its path
+type Handler struct {
+	t *Torrent
+}
+
+// NewHandler returns a handler for t, use http.StripPrefix to mount it
+// below a path
+func NewHandler(t *Torrent) *Handler {
+	return &Handler{t: t}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if name == "" {
+		h.serveList(w)
+		return
+	}
+	for i, p := range h.t.filePaths() {
+		if p == name {
+			h.serveFile(w, req, i, p)
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+// serveList writes a page linking every file
+func (h *Handler) serveList(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	l := newLayout(h.t.Files, h.t.PieceLen, h.t.FileLen)
+	fmt.Fprintf(w, "<!doctype html>\n<title>%s</title>\n<ul>\n", html.EscapeString(path.Base(filepath.ToSlash(h.t.FileName))))
+	for i, p := range h.t.filePaths() {
+		link := (&url.URL{Path: p}).String()
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> %d</li>\n", html.EscapeString(link), html.EscapeString(p), l.files[i].Length)
+	}
+	fmt.Fprintf(w, "</ul>\n")
+}
+
+// serveFile streams a file, Range and If-Range are handled by
+// http.ServeContent. The ETag names the torrent and the file, as their
+// content never changes
+func (h *Handler) serveFile(w http.ResponseWriter, req *http.Request, index int, name string) {
+	r, err := h.t.NewReader(index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer r.Close()
+	w.Header().Set("ETag", "\""+hex.EncodeToString(h.t.InfoSHA[:])+"-"+strconv.Itoa(index)+"\"")
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	http.ServeContent(w, req, name, time.Time{}, &contextReader{r, req.Context()})
+}
+
+// contextReader gives up its reads once the request is gone
+type contextReader struct {
+	*Reader
+	ctx context.Context
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	return r.ReadContext(r.ctx, p)
+}
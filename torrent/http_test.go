@@ -0,0 +1,130 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<15, 5<<15, 15<<15+77)
+	ln := newSeed(t, tf, data, nil)
+	tt, err := Start(newTestTask(tf, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	srv := httptest.NewServer(http.StripPrefix("/t", NewHandler(tt)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/t/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `href="a"`) || !strings.Contains(string(body), `href="b"`) {
+		t.Errorf("file list %s", body)
+	}
+
+	tt.AddPeers([]PeerInfo{{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Port())}})
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/t/b", nil)
+	req.Header.Set("Range", "bytes=1000-70000")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[5<<15+1000:5<<15+70001]) {
+		t.Fatalf("%s, %d bytes", resp.Status, len(body))
+	}
+
+	// a stale If-Range gets the whole file
+	req.Header.Set("If-Range", `"other"`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data[5<<15:]) {
+		t.Errorf("%s, %d bytes", resp.Status, len(body))
+	}
+
+	resp, err = http.Get(srv.URL + "/t/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file: %s", resp.Status)
+	}
+}
+
+func TestHandlerRequestGone(t *testing.T) {
+	tf, _ := newTestTorrent(t, "file", 1<<15, 3<<15)
+	// nobody has the pieces, reads block until the request is gone
+	tt, err := Start(newTestTask(tf, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(tt))
+	defer srv.Close()
+	// closing the torrent unblocks the handler before the server waits for it
+	defer tt.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/file", nil)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tt.readerList()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("read still blocked after the request went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandlerMethod(t *testing.T) {
+	tf, _ := newTestTorrent(t, "file.txt", 1<<15, 1000)
+	tt, err := Start(newTestTask(tf, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	srv := httptest.NewServer(NewHandler(tt))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/file.txt", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: %s, Allow %q", resp.Status, resp.Header.Get("Allow"))
+	}
+	// HEAD reads nothing, it does not wait for the pieces
+	resp, err = http.Head(srv.URL + "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") || resp.Header.Get("ETag") == "" {
+		t.Errorf("HEAD: %s, %v", resp.Status, resp.Header)
+	}
+}
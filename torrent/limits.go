@@ -0,0 +1,122 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits caps the peer connections and transfer rates of every torrent
+// whose ConnOptions share them, zero means no limit
+type Limits struct {
+	conns chan struct{} // a slot for each connection, nil without a cap
+	down  *rateLimiter
+	up    *rateLimiter
+}
+
+// NewLimits returns limits of maxConns peer connections, and of downRate and
+// upRate bytes per second across all of them
+func NewLimits(maxConns, downRate, upRate int) *Limits {
+	l := &Limits{down: newRateLimiter(downRate), up: newRateLimiter(upRate)}
+	if maxConns > 0 {
+		l.conns = make(chan struct{}, maxConns)
+	}
+	return l
+}
+
+func (o *ConnOptions) limits() *Limits {
+	if o == nil {
+		return nil
+	}
+	return o.Limits
+}
+
+// acquire takes a connection slot, it waits for one until cancel is closed
+// and gives up right away if cancel is nil
+func (l *Limits) acquire(cancel <-chan struct{}) bool {
+	if l == nil || l.conns == nil {
+		return true
+	}
+	if cancel == nil {
+		select {
+		case l.conns <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case l.conns <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// release gives back the slot of a connection that is gone
+func (l *Limits) release() {
+	if l == nil || l.conns == nil {
+		return
+	}
+	<-l.conns
+}
+
+// wrap makes conn share the transfer rates
+func (l *Limits) wrap(conn net.Conn) net.Conn {
+	if l == nil || (l.down == nil && l.up == nil) {
+		return conn
+	}
+	return &limitedConn{conn, l}
+}
+
+type limitedConn struct {
+	net.Conn
+	l *Limits
+}
+
+// Read takes the bytes from the rate once they arrived, so the next read
+// waits for them
+func (c *limitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.l.down.wait(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.l.up.wait(len(p))
+	return c.Conn.Write(p)
+}
+
+// rateLimiter is a token bucket holding up to one second of bytes, a
+// transfer may leave it in debt which the next one waits for
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n bytes and blocks until the bucket is out of debt
+func (r *rateLimiter) wait(n int) {
+	if r == nil || n <= 0 {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*r.rate, r.rate)
+	r.last = now
+	r.tokens -= float64(n)
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.mu.Unlock()
+	time.Sleep(delay)
+}
@@ -0,0 +1,212 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"go-torrent/mse"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Listener accepts connections from peers and serves the torrents that
+// have been added to it
+type Listener struct {
+	net.Listener
+	peerId    [IDLEN]byte
+	opts      *ConnOptions
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	torrents  map[[SHALEN]byte]*Torrent
+}
+
+// Listen accepts peers on the given port, which should be the one
+// announced to the tracker, opts may be nil. The port is opened on both
+// IPv4 and IPv6 where the transport supports it
+func Listen(port int, peerId [IDLEN]byte, opts *ConnOptions) (*Listener, error) {
+	ln, err := opts.transport().Listen(":" + strconv.Itoa(port))
+	if err != nil {
+		fmt.Println("fail to listen on port: " + strconv.Itoa(port))
+		return nil, err
+	}
+	l := &Listener{
+		Listener: ln,
+		peerId:   peerId,
+		opts:     opts,
+		closed:   make(chan struct{}),
+		torrents: make(map[[SHALEN]byte]*Torrent),
+	}
+	go l.serve(ln)
+	if opts != nil && opts.UTP != nil {
+		go l.serve(opts.UTP)
+	}
+	return l, nil
+}
+
+// Add makes the torrent reachable by peers that handshake with its info hash
+func (l *Listener) Add(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.InfoSHA] = t
+}
+
+// Remove stops serving the torrent and drops its connections
+func (l *Listener) Remove(infoSHA [SHALEN]byte) {
+	l.mu.Lock()
+	t, ok := l.torrents[infoSHA]
+	delete(l.torrents, infoSHA)
+	l.mu.Unlock()
+	if ok {
+		t.close()
+	}
+}
+
+// Close stops accepting peers and drops every torrent
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	// the uTP socket is shared, only its accept loop is ours
+	l.closeOnce.Do(func() { close(l.closed) })
+	l.mu.Lock()
+	torrents := l.torrents
+	l.torrents = make(map[[SHALEN]byte]*Torrent)
+	l.mu.Unlock()
+	for _, t := range torrents {
+		t.close()
+	}
+	return err
+}
+
+func (l *Listener) lookup(infoSHA [SHALEN]byte) *Torrent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[infoSHA]
+}
+
+func (l *Listener) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case <-l.closed:
+			conn.Close()
+			return
+		default:
+		}
+		// peers beyond the connection limit are turned away
+		limits := l.opts.limits()
+		if !limits.acquire(nil) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer limits.release()
+			l.handleConn(limits.wrap(conn))
+		}()
+	}
+}
+
+func (l *Listener) handleConn(conn net.Conn) {
+	peer := peerInfoOf(conn.RemoteAddr())
+	enc, skey, err := l.acceptEncryption(conn)
+	if err != nil {
+		fmt.Println("inbound encryption failed, " + err.Error())
+		conn.Close()
+		return
+	}
+	conn = enc
+	t, req, err := l.acceptHandshake(conn, skey)
+	if err != nil {
+		fmt.Println("inbound handshake failed, " + err.Error())
+		conn.Close()
+		return
+	}
+	c := &PeerConn{
+		Conn:        conn,
+		AmChoking:   true,
+		PeerChoking: true,
+		Field:       NewBitfield(len(t.PieceSHA)),
+		Peer:        peer,
+		peerId:      l.peerId,
+		InfoSHA:     t.InfoSHA,
+		Reserved:    req.Reserved,
+		encrypted:   mse.Method(conn) == mse.CryptoRC4,
+	}
+	defer c.Close()
+
+	if !t.addConn(c) {
+		return
+	}
+	fmt.Println("accept peer: " + c.Peer.String())
+	// inbound peers are downloaded from like the ones we dial
+	if t.wantsPeers() {
+		defer t.removeConn(c)
+		t.downloadFrom(c, true)
+		return
+	}
+	t.servePeer(c)
+}
+
+// acceptHandshake answers the handshake of an inbound peer, unlike handshake
+// the info hash is only known once the peer has sent its own, encrypted
+// peers must ask for the torrent of their skey
+func (l *Listener) acceptHandshake(conn net.Conn, skey []byte) (*Torrent, *HandshakeMsg, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.PreStr != "BitTorrent protocol" {
+		return nil, nil, fmt.Errorf("unknown protocol: %q", req.PreStr)
+	}
+	if bytes.Equal(req.PeerId[:], l.peerId[:]) {
+		return nil, nil, fmt.Errorf("connected to ourselves")
+	}
+	if skey != nil && !bytes.Equal(skey, req.InfoSHA[:]) {
+		return nil, nil, fmt.Errorf("info hash does not match the skey")
+	}
+	t := l.lookup(req.InfoSHA)
+	if t == nil {
+		return nil, nil, fmt.Errorf("unknown info hash: %x", req.InfoSHA)
+	}
+	_, err = WriteHandShake(conn, NewHandShakeMsg(t.InfoSHA, l.peerId))
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, req, nil
+}
+
+// peerInfoOf returns the address of an inbound peer, TCP or uTP. IPv4 peers
+// accepted on a dual-stack socket arrive as IPv4-mapped IPv6 addresses and
+// are turned back into IPv4 ones
+func peerInfoOf(addr net.Addr) PeerInfo {
+	var ip net.IP
+	var port int
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	default:
+		return PeerInfo{}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return PeerInfo{Ip: ip, Port: uint16(port)}
+}
+
+// Port returns the port peers can reach us on
+func (l *Listener) Port() int {
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	res, _ := strconv.Atoi(port)
+	return res
+}
@@ -0,0 +1,99 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+)
+
+// newSeed serves tf with data to the peers of a listener
+func newSeed(t *testing.T, tf *TorrentFile, data []byte, opts *ConnOptions) *Listener {
+	t.Helper()
+	ln, err := Listen(0, [IDLEN]byte{'s'}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	st := newTorrent(&TorrentTask{PeerId: [IDLEN]byte{'s'}, InfoSHA: tf.InfoSHA, FileLen: tf.FileLen, PieceLen: tf.PieceLen, PieceSHA: tf.PieceSHA, InfoBytes: tf.InfoBytes})
+	st.setStorage(NewMemoryStorage(data, tf.PieceLen))
+	for i := range tf.PieceSHA {
+		st.markPiece(i)
+	}
+	ln.Add(st)
+	return ln
+}
+
+func listenerPeer(ln *Listener) PeerInfo {
+	return PeerInfo{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Addr().(*net.TCPAddr).Port)}
+}
+
+func TestListenerSeed(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<15, 300000)
+	ln := newSeed(t, tf, data, nil)
+	task := newTestTask(tf, t.TempDir())
+	task.PeerList = []PeerInfo{listenerPeer(ln)}
+	err := Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(task.FileName)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs, %v", err)
+	}
+}
+
+func TestListenerSeedsAfterDownload(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<15, 100000)
+	ln := newSeed(t, tf, data, nil)
+	// the first leecher seeds to the second once it is done
+	mid, err := Listen(0, [IDLEN]byte{'m'}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mid.Close()
+	task := newTestTask(tf, t.TempDir())
+	task.PeerList = []PeerInfo{listenerPeer(ln)}
+	task.Listener = mid
+	err = Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the first leecher is left to download from
+	ln.Remove(tf.InfoSHA)
+
+	task = newTestTask(tf, t.TempDir())
+	task.PeerList = []PeerInfo{listenerPeer(mid)}
+	err = Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(task.FileName)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs, %v", err)
+	}
+}
+
+func TestListenerUnknownTorrent(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<15, 1000)
+	ln := newSeed(t, tf, data, nil)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	WriteHandShake(conn, NewHandShakeMsg([SHALEN]byte{1}, [IDLEN]byte{'x'}))
+	_, err = ReadHandshake(conn)
+	if err == nil {
+		t.Error("handshake for an unknown torrent answered")
+	}
+}
+
+func TestListenerCloseTwice(t *testing.T) {
+	l, err := Listen(0, [IDLEN]byte{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	l.Close()
+}
@@ -0,0 +1,200 @@
+package torrent
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Magnet is a parsed magnet link, everything but the info hash is optional
+type Magnet struct {
+	InfoSHA  [SHALEN]byte
+	Name     string      // dn: display name
+	Trackers []string    // tr: announce URLs
+	WebSeeds []string    // ws: web seeds
+	Peers    []PeerInfo  // x.pe: peers to connect to directly
+	Select   []FileRange // so: files to download
+}
+
+// FileRange is the files First to Last, both included
+type FileRange struct {
+	First, Last int
+}
+
+// ParseMagnet parses magnet:?xt=urn:btih:... links, the info hash may be
+// hex (40 chars) or base32 (32 chars)
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %s", uri)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(Magnet)
+	found := false
+	for _, xt := range q["xt"] {
+		hash, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		m.InfoSHA, err = parseInfoHash(hash)
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("magnet link without btih: %s", uri)
+	}
+
+	m.Name = q.Get("dn")
+	m.Trackers = q["tr"]
+	m.WebSeeds = q["ws"]
+	for _, pe := range q["x.pe"] {
+		host, port, err := net.SplitHostPort(pe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %v", pe, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid peer ip: %q", pe)
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer port: %q", pe)
+		}
+		m.Peers = append(m.Peers, PeerInfo{Ip: ip, Port: uint16(p)})
+	}
+	if so := q.Get("so"); so != "" {
+		m.Select, err = parseSelect(so)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func parseInfoHash(hash string) ([SHALEN]byte, error) {
+	var res [SHALEN]byte
+	var bys []byte
+	var err error
+	switch len(hash) {
+	case 2 * SHALEN:
+		bys, err = hex.DecodeString(hash)
+	case 32:
+		bys, err = base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+	default:
+		return res, fmt.Errorf("invalid info hash length: %d", len(hash))
+	}
+	if err != nil {
+		return res, fmt.Errorf("invalid info hash %q: %v", hash, err)
+	}
+	copy(res[:], bys)
+	return res, nil
+}
+
+// parseSelect parses file indices such as "0,2,4-6", ranges are kept as
+// they are since they may be huge
+func parseSelect(so string) ([]FileRange, error) {
+	var res []FileRange
+	for _, part := range strings.Split(so, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		begin, err := strconv.Atoi(first)
+		if err != nil || begin < 0 {
+			return nil, fmt.Errorf("invalid file index: %q", part)
+		}
+		end := begin
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < begin {
+				return nil, fmt.Errorf("invalid file range: %q", part)
+			}
+		}
+		res = append(res, FileRange{begin, end})
+	}
+	return res, nil
+}
+
+// Selected reports whether the link selects the file, all are without so
+func (m *Magnet) Selected(index int) bool {
+	if len(m.Select) == 0 {
+		return true
+	}
+	for _, r := range m.Select {
+		if index >= r.First && index <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataStats is announced while the metadata is fetched, left is unknown
+// until we have it and any non-zero value tells the tracker we are still
+// downloading
+var metadataStats = AnnounceStats{Left: 1}
+
+// FindPeers asks every tracker of the magnet link for peers, the peers
+// listed in the link come first. It announces PeerPort
+func (m *Magnet) FindPeers(peerId [IDLEN]byte, opts *ConnOptions) []PeerInfo {
+	return m.Announce(context.Background(), peerId, PeerPort, metadataStats, opts)
+}
+
+// Announce is FindPeers announcing the port we listen on and our transfer,
+// it gives up once ctx is done
+func (m *Magnet) Announce(ctx context.Context, peerId [IDLEN]byte, port int, stats AnnounceStats, opts *ConnOptions) []PeerInfo {
+	peers, _ := m.announce(ctx, peerId, port, stats, opts)
+	return append(append([]PeerInfo(nil), m.Peers...), peers...)
+}
+
+// announce asks the trackers of the link only, it also returns the shortest
+// interval they want between announces, 0 when none answered
+func (m *Magnet) announce(ctx context.Context, peerId [IDLEN]byte, port int, stats AnnounceStats, opts *ConnOptions) ([]PeerInfo, int) {
+	var peers []PeerInfo
+	interval := 0
+	for _, tr := range m.Trackers {
+		if ctx.Err() != nil {
+			break
+		}
+		tf := &TorrentFile{Announce: tr, InfoSHA: m.InfoSHA}
+		res, n := announce(ctx, tf, peerId, port, stats, opts)
+		peers = append(peers, res...)
+		if n > 0 && (interval == 0 || n < interval) {
+			interval = n
+		}
+	}
+	return peers, interval
+}
+
+// TorrentFile completes the magnet link with its info dict, the web seeds
+// of the link become its url-list
+func (m *Magnet) TorrentFile(infoBytes []byte) (*TorrentFile, error) {
+	tf, err := ParseInfo(infoBytes)
+	if err != nil {
+		return nil, err
+	}
+	if tf.InfoSHA != m.InfoSHA {
+		return nil, fmt.Errorf("info hash mismatch, expected %x, got %x", m.InfoSHA, tf.InfoSHA)
+	}
+	if len(m.Trackers) > 0 {
+		tf.Announce = m.Trackers[0]
+	}
+	for _, ws := range m.WebSeeds {
+		if !slices.Contains(tf.URLList, ws) {
+			tf.URLList = append(tf.URLList, ws)
+		}
+	}
+	return tf, nil
+}
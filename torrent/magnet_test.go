@@ -0,0 +1,229 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-torrent/bencode"
+	"go-torrent/dht"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseMagnet(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=x&tr=http://t/a&ws=http://w/&x.pe=127.0.0.1:6881&so=0,2-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InfoSHA[0] != 0x01 || m.InfoSHA[19] != 0x67 || m.Name != "x" {
+		t.Errorf("info hash %x, name %q", m.InfoSHA, m.Name)
+	}
+	if len(m.Trackers) != 1 || len(m.WebSeeds) != 1 || len(m.Peers) != 1 || m.Peers[0].Port != 6881 {
+		t.Errorf("trackers %q, web seeds %q, peers %v", m.Trackers, m.WebSeeds, m.Peers)
+	}
+	if !slices.Equal(m.Select, []FileRange{{0, 0}, {2, 4}}) {
+		t.Errorf("select %v", m.Select)
+	}
+	for i, want := range []bool{true, false, true, true, true, false} {
+		if m.Selected(i) != want {
+			t.Errorf("file %d selected %v", i, !want)
+		}
+	}
+
+	for _, uri := range []string{
+		"magnet:?dn=x",
+		"magnet:?xt=urn:btih:0123",
+		"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=4-2",
+		"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=-1",
+		"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&x.pe=host:1",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("%s accepted", uri)
+		}
+	}
+}
+
+func TestParseMagnetHugeRange(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&so=0-4294967295")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Select) != 1 || !m.Selected(1<<31) {
+		t.Errorf("select %v", m.Select)
+	}
+}
+
+func TestMagnetTorrentFile(t *testing.T) {
+	tf, _ := newTestTorrent(t, "file", 1<<14, 100)
+	m := &Magnet{InfoSHA: tf.InfoSHA, Trackers: []string{"http://t/a"}, WebSeeds: []string{"http://w/", "http://w/"}}
+	got, err := m.TorrentFile(tf.InfoBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Announce != "http://t/a" || !slices.Equal(got.URLList, []string{"http://w/"}) {
+		t.Errorf("announce %q, url-list %q", got.Announce, got.URLList)
+	}
+	m.InfoSHA[0]++
+	if _, err := m.TorrentFile(tf.InfoBytes); err == nil {
+		t.Error("info dict of another torrent accepted")
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	// several metadata pieces
+	tf, data := newTestTorrent(t, "file", 1<<10, 3000<<10)
+	ln := newSeed(t, tf, data, nil)
+	m, err := ParseMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x", tf.InfoSHA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Peers = []PeerInfo{listenerPeer(ln)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	got, err := FetchMetadata(ctx, m, [IDLEN]byte{'f'}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.InfoSHA != tf.InfoSHA || len(got.PieceSHA) != len(tf.PieceSHA) {
+		t.Errorf("info hash %x, pieces %d", got.InfoSHA, len(got.PieceSHA))
+	}
+}
+
+func TestFetchMetadataNoPeers(t *testing.T) {
+	m := &Magnet{InfoSHA: [SHALEN]byte{1}}
+	if _, err := FetchMetadata(context.Background(), m, [IDLEN]byte{'f'}, nil); err == nil {
+		t.Error("fetch without peers succeeded")
+	}
+}
+
+func TestMagnetAnnounce(t *testing.T) {
+	ports := make(chan string, 2)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ports <- r.URL.Query().Get("port")
+		res := &TrackerResp{Interval: 60, Peers: string(compactPeer(PeerInfo{Ip: net.IPv4(10, 0, 0, 2), Port: 2}))}
+		bencode.Marshal(w, res)
+	}))
+	defer tracker.Close()
+	m := &Magnet{
+		InfoSHA:  [SHALEN]byte{1},
+		Trackers: []string{tracker.URL},
+		Peers:    []PeerInfo{{Ip: net.IPv4(10, 0, 0, 1), Port: 1}},
+	}
+	peers := m.Announce(context.Background(), [IDLEN]byte{'f'}, 51413, metadataStats, nil)
+	if len(peers) != 2 || peers[0].Port != 1 || peers[1].Port != 2 {
+		t.Errorf("peers %v, want the link peer first", peers)
+	}
+	if port := <-ports; port != "51413" {
+		t.Errorf("announced port %s", port)
+	}
+	// once ctx is done the trackers are not asked
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if peers := m.Announce(ctx, [IDLEN]byte{'f'}, 51413, metadataStats, nil); len(peers) != 1 {
+		t.Errorf("peers %v after cancel", peers)
+	}
+}
+
+func TestClientMagnet(t *testing.T) {
+	tf, data := newTestTorrent(t, "mg", 1<<15, 4<<15, 4<<15+5)
+	seedDir := t.TempDir()
+	os.MkdirAll(filepath.Join(seedDir, "mg"), 0755)
+	os.WriteFile(filepath.Join(seedDir, "mg", "a"), data[:4<<15], 0644)
+	os.WriteFile(filepath.Join(seedDir, "mg", "b"), data[4<<15:], 0644)
+	seeder, err := NewClient(&ClientConfig{DataDir: seedDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	sh, err := seeder.AddTorrent(tf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.Start()
+	if err := sh.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	c, err := NewClient(&ClientConfig{DataDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the range reaches far past the files
+	m, err := ParseMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x&so=1-4294967295&ws=http://w/", tf.InfoSHA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Peers = []PeerInfo{{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(seeder.Port())}}
+	h, err := c.AddMagnet(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	if err := h.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "mg", "b"))
+	if err != nil || !bytes.Equal(got, data[4<<15:]) {
+		t.Errorf("selected file differs, %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mg", "a")); !os.IsNotExist(err) {
+		t.Error("file that is not selected created")
+	}
+	if h.Priorities().File(0) != PrioritySkip {
+		t.Error("file that is not selected not skipped")
+	}
+	if !slices.Equal(h.TorrentFile().URLList, []string{"http://w/"}) {
+		t.Errorf("url-list %q", h.TorrentFile().URLList)
+	}
+}
+
+func TestClientMagnetDHT(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 1<<16)
+	ln := newSeed(t, tf, data, nil)
+	// the seed is only announced in the DHT
+	boot, err := dht.New(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boot.Close()
+	var nodes []*dht.Server
+	for i := 0; i < 2; i++ {
+		s, err := dht.New(dht.Config{Addr: "127.0.0.1:0", BootstrapNodes: []string{boot.Addr().String()}, QueryTimeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := s.Bootstrap(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, s)
+	}
+	if _, err := nodes[0].Announce(context.Background(), dht.ID(tf.InfoSHA), ln.Port()); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	c, err := NewClient(&ClientConfig{DataDir: dir, DHT: nodes[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.AddMagnet(&Magnet{InfoSHA: tf.InfoSHA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	waitHandle(t, h)
+	got, err := os.ReadFile(filepath.Join(dir, "file"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs, %v", err)
+	}
+}
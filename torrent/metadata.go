@@ -0,0 +1,264 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"go-torrent/bencode"
+	"io"
+	"sync"
+	"time"
+)
+
+// BEP 9: the info dict is exchanged in 16 KiB pieces over ut_metadata
+const (
+	UtMetadata        = "ut_metadata"
+	MetadataPieceLen  = 1 << 14
+	MaxMetadataSize   = 1 << 24
+	MetadataFetchers  = 5
+	metadataRequest   = 0
+	metadataData      = 1
+	metadataReject    = 2
+	metadataConnLimit = 30 * time.Second
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// parseMetadataMsg splits the payload into the bencoded dict and the piece
+// data that follows it in data messages
+func parseMetadataMsg(payload []byte) (*metadataMsg, []byte, error) {
+	br := bufio.NewReader(bytes.NewReader(payload))
+	msg := new(metadataMsg)
+	err := bencode.Unmarshal(br, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, data, nil
+}
+
+func writeMetadataMsg(c *PeerConn, msg *metadataMsg, data []byte) error {
+	buf := new(bytes.Buffer)
+	bencode.Marshal(buf, msg)
+	buf.Write(data)
+	return c.WriteExtMsg(UtMetadata, buf.Bytes())
+}
+
+// metadataPieces returns the number of pieces of an info dict of the given size
+func metadataPieces(size int) int {
+	return (size + MetadataPieceLen - 1) / MetadataPieceLen
+}
+
+// serveMetadata answers the ut_metadata requests of peers with our info dict
+func (t *Torrent) serveMetadata(c *PeerConn, payload []byte) error {
+	msg, _, err := parseMetadataMsg(payload)
+	if err != nil {
+		return err
+	}
+	// data and rejects are for fetchers, we already have the metadata
+	if msg.MsgType != metadataRequest {
+		return nil
+	}
+	if msg.Piece < 0 || msg.Piece >= metadataPieces(len(t.InfoBytes)) {
+		return writeMetadataMsg(c, &metadataMsg{MsgType: metadataReject, Piece: msg.Piece}, nil)
+	}
+	begin := msg.Piece * MetadataPieceLen
+	end := begin + MetadataPieceLen
+	if end > len(t.InfoBytes) {
+		end = len(t.InfoBytes)
+	}
+	res := &metadataMsg{MsgType: metadataData, Piece: msg.Piece, TotalSize: len(t.InfoBytes)}
+	return writeMetadataMsg(c, res, t.InfoBytes[begin:end])
+}
+
+// metadataFetch collects the info dict from one peer
+type metadataFetch struct {
+	buf      []byte
+	received []bool
+	left     int
+	err      error
+}
+
+func (f *metadataFetch) handle(c *PeerConn, payload []byte) error {
+	msg, data, err := parseMetadataMsg(payload)
+	if err != nil {
+		return err
+	}
+	switch msg.MsgType {
+	case metadataRequest:
+		// nothing to serve yet
+		return writeMetadataMsg(c, &metadataMsg{MsgType: metadataReject, Piece: msg.Piece}, nil)
+	case metadataReject:
+		f.err = fmt.Errorf("peer rejected metadata piece %d", msg.Piece)
+	case metadataData:
+		if f.buf == nil || msg.Piece < 0 || msg.Piece >= len(f.received) {
+			return fmt.Errorf("unexpected metadata piece %d", msg.Piece)
+		}
+		begin := msg.Piece * MetadataPieceLen
+		end := begin + MetadataPieceLen
+		if end > len(f.buf) {
+			end = len(f.buf)
+		}
+		if len(data) != end-begin {
+			return fmt.Errorf("metadata piece %d has length %d, expected %d", msg.Piece, len(data), end-begin)
+		}
+		if !f.received[msg.Piece] {
+			copy(f.buf[begin:end], data)
+			f.received[msg.Piece] = true
+			f.left--
+		}
+	}
+	return nil
+}
+
+// request asks for every piece once the peer told us the size of the info dict
+func (f *metadataFetch) request(c *PeerConn) error {
+	size := c.ExtHandshake().MetadataSize
+	if size <= 0 || size > MaxMetadataSize {
+		return fmt.Errorf("invalid metadata size: %d", size)
+	}
+	f.buf = make([]byte, size)
+	f.received = make([]bool, metadataPieces(size))
+	f.left = len(f.received)
+	for i := range f.received {
+		err := writeMetadataMsg(c, &metadataMsg{MsgType: metadataRequest, Piece: i}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchMetadata downloads the info dict from a single peer
+func fetchMetadata(ctx context.Context, peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte, opts *ConnOptions) ([]byte, error) {
+	c, err := NewConn(peer, infoSHA, peerId, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if !c.SupportsExtensions() {
+		return nil, ErrExtNotSupported
+	}
+	// unblock the read loop once another peer has been faster
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+	defer stop()
+	c.SetDeadline(time.Now().Add(metadataConnLimit))
+
+	// fast peers expect our bitfield first, we have nothing yet
+	if c.SupportsFast() {
+		_, err = c.WriteMsg(&PeerMsg{MsgHaveNone, nil})
+		if err != nil {
+			return nil, err
+		}
+	}
+	f := new(metadataFetch)
+	exts := NewExtensions()
+	exts.Register(UtMetadata, f.handle)
+	err = c.WriteExtHandshake(&ExtHandshake{M: exts.ids(), V: ClientVersion, Reqq: MAXQUEUED})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if f.buf == nil && c.ExtHandshake() != nil {
+			if c.extId(UtMetadata) == 0 {
+				return nil, ErrExtNotSupported
+			}
+			err = f.request(c)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if f.buf != nil && f.left == 0 {
+			break
+		}
+		msg, err := c.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.Id != MsgExtended {
+			continue
+		}
+		err = exts.handle(c, msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+	}
+
+	sha := sha1.Sum(f.buf)
+	if !bytes.Equal(sha[:], infoSHA[:]) {
+		return nil, fmt.Errorf("metadata from %s does not match the info hash", peer.String())
+	}
+	return f.buf, nil
+}
+
+// FetchMetadata gets the info dict of a magnet link from its peers and the
+// peers of its trackers, several peers are tried at once and the first
+// verified info dict wins
+func FetchMetadata(ctx context.Context, m *Magnet, peerId [IDLEN]byte, opts *ConnOptions) (*TorrentFile, error) {
+	return fetchMetadataFrom(ctx, m, m.Announce(ctx, peerId, PeerPort, metadataStats, opts), peerId, opts)
+}
+
+// fetchMetadataFrom gets the info dict from the given peers
+func fetchMetadataFrom(ctx context.Context, m *Magnet, peers []PeerInfo, peerId [IDLEN]byte, opts *ConnOptions) (*TorrentFile, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to fetch the metadata from")
+	}
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan PeerInfo, len(peers))
+	for _, peer := range peers {
+		queue <- peer
+	}
+	close(queue)
+
+	var once sync.Once
+	var infoBytes []byte
+	var wg sync.WaitGroup
+	for i := 0; i < MetadataFetchers && i < len(peers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for peer := range queue {
+				if fetchCtx.Err() != nil {
+					return
+				}
+				res, err := fetchMetadata(fetchCtx, peer, m.InfoSHA, peerId, opts)
+				if err != nil {
+					fmt.Println("fail to fetch metadata from " + peer.String() + ", " + err.Error())
+					continue
+				}
+				once.Do(func() {
+					infoBytes = res
+					cancel()
+				})
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	if infoBytes == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("no peer sent the metadata")
+	}
+	return m.TorrentFile(infoBytes)
+}
@@ -2,11 +2,14 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"go-torrent/mse"
 	"io"
 	"net"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +25,7 @@ const (
 	MsgRequest			MsgId = 6
 	MsgPiece			MsgId = 7
 	MsgCancel			MsgId = 8
+	MsgPort				MsgId = 9 // listen port of the DHT node of the peer
 )
 
 type PeerMsg struct {
@@ -31,15 +35,50 @@ type PeerMsg struct {
 
 type PeerConn struct {
 	net.Conn
-	Choked		bool
+	AmChoking		bool // we choke the peer, guarded by mu
+	AmInterested	bool // we want pieces of the peer
+	PeerChoking		bool // the peer chokes us
+	PeerInterested	bool // the peer wants pieces of ours, guarded by mu
 	Field		Bitfield
 	Peer		PeerInfo
 	peerId		[IDLEN]byte
 	InfoSHA		[SHALEN]byte
+	Reserved	ReservedBits // extensions announced in the handshake of the peer
+	Ext			*ExtHandshake // extended handshake of the peer, guarded by mu
+	t			*Torrent
+	up			*uploader
+	outbound	bool // we dialed the peer, so it is reachable at Peer
+	encrypted	bool // the stream is RC4 encrypted
+	pex			pexState
+	haveAll		bool // the peer sent Have All before we knew the piece count
+	unread		*PeerMsg // returned by the next ReadMsg
+	allowedIn	map[int]bool // pieces the peer serves us while choking us
+	allowedOut	map[int]bool // pieces we serve the peer while choking it
+	suggested	[]int // pieces the peer suggested, oldest first
+	announced	bool // our bitfield has been sent, guarded by the mutex of t
+	counted		bool // Field is part of the piece availability of t
+	mu			sync.Mutex
+	wmu			sync.Mutex // messages are written by both the downloader and the uploader
+	downloaded	atomic.Int64 // piece bytes received, used by the choker
+	uploaded	atomic.Int64 // piece bytes sent
+	queueDepth	atomic.Int64 // requests we keep pending with the peer
+	webSeed		bool // an HTTP server, nothing is written to it
+}
+
+func (c *PeerConn) isAmChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.AmChoking
+}
+
+func (c *PeerConn) isPeerInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.PeerInterested
 }
 
 // 1. handshake: TCP, and check the infoSHA
-func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) error {
+func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) (*HandshakeMsg, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 	// create Msg
@@ -47,20 +86,20 @@ func handshake(conn net.Conn, infoSHA [SHALEN]byte, peerId [IDLEN]byte) error {
 	_, err := WriteHandShake(conn, req)
 	if err != nil {
 		fmt.Println("send handshake failed")
-		return err
+		return nil, err
 	}
 
 	res, err := ReadHandshake(conn)
 	if err != nil {
 		fmt.Println("read handshake failed")
-		return err
+		return nil, err
 	}
 
 	if !bytes.Equal(res.InfoSHA[:], infoSHA[:]){
 		fmt.Println("check handshake failed")
-		return fmt.Errorf("handshake msg error: " + string(res.InfoSHA[:]))
+		return nil, fmt.Errorf("handshake msg error: %x", res.InfoSHA)
 	}
-	return nil
+	return res, nil
 }
 
 // 2. pieces info (bit map)
@@ -69,22 +108,55 @@ func fillBitfield(c *PeerConn) error {
 	defer c.SetDeadline(time.Time{})
 
 	msg, err := c.ReadMsg()
+	if isTimeout(err) && !c.SupportsFast() {
+		// a peer with nothing may wait for us without sending anything
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	if msg == nil {
-		return fmt.Errorf("expected bitfield")
+	// the extended handshake may come first
+	if msg != nil && msg.Id == MsgExtended && c.SupportsExtensions() &&
+		len(msg.Payload) > 0 && msg.Payload[0] == ExtHandshakeId {
+		err = c.readExtHandshake(msg.Payload[1:])
+		if err != nil {
+			return err
+		}
+		msg, err = c.ReadMsg()
+		if isTimeout(err) && !c.SupportsFast() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
-	if msg.Id != MsgBitfield {
-		return fmt.Errorf("expected bitfield, get " + strconv.Itoa(int(msg.Id)))
-
+	switch {
+	case msg != nil && msg.Id == MsgBitfield:
+		c.Field = msg.Payload
+	case msg != nil && msg.Id == MsgHaveAll && c.SupportsFast():
+		c.haveAll = true
+	case msg != nil && msg.Id == MsgHaveNone && c.SupportsFast():
+	case c.SupportsFast():
+		return fmt.Errorf("expected bitfield, have all or have none")
+	default:
+		// the bitfield is optional for peers that have nothing
+		c.unread = msg
 	}
-	fmt.Println("fill bitfield : " + c.Peer.Ip.String())
-	c.Field = msg.Payload
+	fmt.Println("fill bitfield : " + c.Peer.String())
 	return nil
 }
 
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
+	if c.unread != nil {
+		msg := c.unread
+		c.unread = nil
+		return msg, nil
+	}
 	// read msg length
 	lenBuf := make([]byte, 4)
 	_, err := io.ReadFull(c, lenBuf)
@@ -97,8 +169,18 @@ func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
 		return nil, nil
 	}
 
+	// the length is checked before anything is allocated for it
+	var id [1]byte
+	_, err = io.ReadFull(c, id[:])
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxMsgLen && (MsgId(id[0]) != MsgBitfield || length-1 > uint32(c.maxFieldLen())) {
+		return nil, fmt.Errorf("message %d too long: %d bytes", id[0], length)
+	}
 	msgBuf := make([]byte, length)
-	_, err = io.ReadFull(c, msgBuf)
+	msgBuf[0] = id[0]
+	_, err = io.ReadFull(c, msgBuf[1:])
 	if err != nil {
 		return nil, err
 	}
@@ -111,16 +193,36 @@ func (c *PeerConn) ReadMsg() (*PeerMsg, error) {
 
 const LenBytes uint32 = 4
 
+// MaxMsgLen is the longest message a peer may send, a piece message with the
+// largest block we serve, which also fits a metadata piece and its dict. Only
+// a bitfield may be longer
+const MaxMsgLen uint32 = 1 + 8 + MAXREQUEST
+
+// MaxFieldLen is the longest bitfield accepted before the piece count is known
+const MaxFieldLen = 1 << 20
+
+// maxFieldLen is the size of the bitfield of the torrent of the connection
+func (c *PeerConn) maxFieldLen() int {
+	if c.t == nil || len(c.t.PieceSHA) == 0 {
+		return MaxFieldLen
+	}
+	return (len(c.t.PieceSHA) + 7) / 8
+}
+
 func(c *PeerConn) WriteMsg(m *PeerMsg) (int, error) {
 	var buf []byte
 	if m == nil {
+		// heartbeat
 		buf = make([]byte, LenBytes)
+	} else {
+		length := uint32(len(m.Payload) + 1) // Id: 1
+		buf = make([]byte, LenBytes+length)
+		binary.BigEndian.PutUint32(buf[0:LenBytes], length)
+		buf[LenBytes] = byte(m.Id)
+		copy(buf[LenBytes+1:], m.Payload)
 	}
-	length := uint32(len(m.Payload) + 1) // Id: 1
-	buf = make([]byte, LenBytes+length)
-	binary.BigEndian.PutUint32(buf[0:LenBytes], length)
-	buf[LenBytes] = byte(m.Id)
-	copy(buf[LenBytes+1:], m.Payload)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 	return c.Write(buf)
 }
 
@@ -142,14 +244,15 @@ func CopyPieceData(index int, buf []byte, msg *PeerMsg) (int, error) {
 	}
 	data := msg.Payload[8:]
 	if offset+len(data) > len(buf) {
-		return 0, fmt.Errorf("data too large [%d] for offest %d", len(data), offset, len(buf))
+		return 0, fmt.Errorf("data too large [%d] for offest %d with length %d", len(data), offset, len(buf))
 	}
 	copy(buf[offset:], data)
 	return len(data), nil
 }
 
+// GetHaveIndex also parses MsgSuggest and MsgAllowedFast, which carry the same payload
 func GetHaveIndex(msg *PeerMsg) (int, error) {
-	if msg.Id != MsgHave {
+	if msg.Id != MsgHave && msg.Id != MsgSuggest && msg.Id != MsgAllowedFast {
 		return 0, fmt.Errorf("expected MsgHave (Id %d), got Id %d", MsgHave, msg.Id)
 	}
 	if len(msg.Payload) != 4 {
@@ -168,15 +271,98 @@ func NewRequestMsg(index, offset, length int) *PeerMsg {
 	return &PeerMsg{MsgRequest, payload}
 }
 
-func NewConn(peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte) (*PeerConn, error) {
-	addr := net.JoinHostPort(peer.Ip.String(), strconv.Itoa(int(peer.Port)))
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+// NewCancelMsg withdraws a request, e.g. a block that another peer sent first
+func NewCancelMsg(index, offset, length int) *PeerMsg {
+	msg := NewRequestMsg(index, offset, length)
+	msg.Id = MsgCancel
+	return msg
+}
+
+const DialTimeout = 5 * time.Second
+
+// dial connects to a peer, the connection shares the rate limits of opts
+func dial(addr string, opts *ConnOptions) (net.Conn, error) {
+	conn, err := dialConn(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return opts.limits().wrap(conn), nil
+}
+
+// dialConn races the transport and uTP when a uTP socket is set, the first
+// connection wins and the other one is closed. A proxy for peers replaces both
+func dialConn(addr string, opts *ConnOptions) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	if p := opts.proxy(); p.Peers() {
+		return p.Dial(ctx, addr)
+	}
+	transport := opts.transport()
+	if opts == nil || opts.UTP == nil {
+		return transport.Dial(ctx, addr)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	go func() {
+		conn, err := transport.Dial(ctx, addr)
+		results <- result{conn, err}
+	}()
+	go func() {
+		conn, err := opts.UTP.Dial(ctx, addr)
+		results <- result{conn, err}
+	}()
+	var err error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		if i == 0 {
+			go func() {
+				if res := <-results; res.err == nil {
+					res.conn.Close()
+				}
+			}()
+		}
+		return res.conn, nil
+	}
+	return nil, err
+}
+
+// NewConn dials the peer, opts may be nil
+func NewConn(peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte, opts *ConnOptions) (*PeerConn, error) {
+	addr := peer.Addr()
+	conn, err := dial(addr, opts)
 	if err != nil {
 		fmt.Println("set tcp conn failed: " + addr)
 		return nil, err
 	}
 
-	err = handshake(conn, infoSHA, peerId)
+	if policy := opts.encryption(); policy != EncryptionDisabled {
+		enc, err := encrypt(conn, infoSHA, policy)
+		switch {
+		case err == nil:
+			conn = enc
+		case policy == EncryptionPrefer && refusedEncryption(err):
+			// the peer does not know MSE, try again in plaintext
+			conn.Close()
+			conn, err = dial(addr, opts)
+			if err != nil {
+				fmt.Println("set tcp conn failed: " + addr)
+				return nil, err
+			}
+		default:
+			fmt.Println("encryption failed: " + err.Error())
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	res, err := handshake(conn, infoSHA, peerId)
 	if err != nil {
 		fmt.Println("handshake failed")
 		conn.Close()
@@ -184,15 +370,20 @@ func NewConn(peer PeerInfo, infoSHA [SHALEN]byte, peerId [IDLEN]byte) (*PeerConn
 	}
 	c := &PeerConn{
 		Conn: 		conn,
-		Choked: 	true,
+		AmChoking:	true,
+		PeerChoking: true,
 		Peer:		peer,
 		peerId: 	peerId,
 		InfoSHA: 	infoSHA,
+		Reserved:	res.Reserved,
+		outbound:	true,
+		encrypted:	mse.Method(conn) == mse.CryptoRC4,
 	}
 
 	err = fillBitfield(c)
 	if err != nil {
 		fmt.Println("fill bitfield failed, " + err.Error())
+		conn.Close()
 		return nil, err
 	}
 	return c, nil
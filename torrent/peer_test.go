@@ -0,0 +1,156 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go-torrent/utp"
+	"net"
+	"os"
+	"testing"
+)
+
+// downloadFile downloads the single file of tf from peer and returns it
+func downloadFile(t *testing.T, tf *TorrentFile, peer PeerInfo, opts *ConnOptions) []byte {
+	t.Helper()
+	task := newTestTask(tf, t.TempDir())
+	task.PeerList = []PeerInfo{peer}
+	task.ConnOptions = opts
+	err := Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(task.FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestNewConnUTP(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<15, 300000)
+	// the seeder is only reachable over uTP, its TCP port is another one
+	sock, err := utp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	newSeed(t, tf, data, &ConnOptions{UTP: sock, Encryption: EncryptionPrefer})
+	peer := PeerInfo{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(sock.Addr().(*net.UDPAddr).Port)}
+
+	lsock, err := utp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsock.Close()
+	opts := &ConnOptions{UTP: lsock, Encryption: EncryptionRequire}
+	c, err := NewConn(peer, tf.InfoSHA, [IDLEN]byte{'l'}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RemoteAddr().Network() != "udp" || !c.encrypted {
+		t.Errorf("connected over %s, encrypted %v", c.RemoteAddr().Network(), c.encrypted)
+	}
+	c.Close()
+	if !bytes.Equal(downloadFile(t, tf, peer, opts), data) {
+		t.Error("downloaded data differs")
+	}
+}
+
+func TestDownloadSeveralPeers(t *testing.T) {
+	// pieces of several blocks, shared between the peers
+	tf, data := newTestTorrent(t, "file", 1<<16, 300000)
+	task := newTestTask(tf, t.TempDir())
+	for i := 0; i < 3; i++ {
+		task.PeerList = append(task.PeerList, listenerPeer(newSeed(t, tf, data, nil)))
+	}
+	err := Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(task.FileName)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs, %v", err)
+	}
+}
+
+// sendMsg writes a message with the given length prefix, followed by the id
+// and as much payload as fits
+func sendMsg(conn net.Conn, length uint32, id MsgId, payload []byte) {
+	buf := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, length)
+	buf[4] = byte(id)
+	conn.Write(append(buf, payload...))
+}
+
+func TestReadMsgTooLong(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &PeerConn{Conn: a}
+	go sendMsg(b, 1<<32-1, MsgPiece, nil)
+	_, err := c.ReadMsg()
+	if err == nil {
+		t.Fatal("message of 4 GiB accepted")
+	}
+}
+
+func TestReadMsgBitfield(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &PeerConn{Conn: a}
+	field := make([]byte, MaxMsgLen)
+	go sendMsg(b, uint32(len(field))+1, MsgBitfield, field)
+	msg, err := c.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != MsgBitfield || len(msg.Payload) != len(field) {
+		t.Fatalf("got message %d of %d bytes", msg.Id, len(msg.Payload))
+	}
+
+	// once the piece count is known the bitfield may not be longer
+	c.t = &Torrent{TorrentTask: &TorrentTask{PieceSHA: make([][SHALEN]byte, 8)}}
+	go sendMsg(b, uint32(len(field))+1, MsgBitfield, nil)
+	_, err = c.ReadMsg()
+	if err == nil {
+		t.Fatal("bitfield longer than the piece count accepted")
+	}
+}
+
+func TestReadMsgLargestBlock(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &PeerConn{Conn: a}
+	// we serve blocks up to MAXREQUEST, so peers may send them too
+	payload := make([]byte, 8+MAXREQUEST)
+	go sendMsg(b, uint32(len(payload))+1, MsgPiece, payload)
+	msg, err := c.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Payload) != len(payload) {
+		t.Fatalf("got %d bytes, want %d", len(msg.Payload), len(payload))
+	}
+	go sendMsg(b, uint32(len(payload))+2, MsgPiece, append(payload, 0))
+	if _, err := c.ReadMsg(); err == nil {
+		t.Error("block longer than MAXREQUEST accepted")
+	}
+}
+
+func TestReadMsgPiece(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &PeerConn{Conn: a}
+	payload := make([]byte, 8+BLOCKSIZE)
+	go sendMsg(b, uint32(len(payload))+1, MsgPiece, payload)
+	msg, err := c.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != MsgPiece || len(msg.Payload) != len(payload) {
+		t.Fatalf("got message %d of %d bytes", msg.Id, len(msg.Payload))
+	}
+}
@@ -0,0 +1,192 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"go-torrent/bencode"
+	"time"
+)
+
+// BEP 11: peers we are connected to are exchanged over ut_pex, at most once a
+// minute and at most 50 added and 50 dropped peers per message
+const (
+	UtPex       = "ut_pex"
+	PexInterval = time.Minute
+	PexMaxPeers = 50
+)
+
+// flags of added.f
+const (
+	PexEncryption byte = 0x01
+	PexSeed       byte = 0x02
+	PexUTP        byte = 0x04
+	PexHolepunch  byte = 0x08
+	PexReachable  byte = 0x10
+)
+
+type pexMsg struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// pexState is what we last told a peer, so the next message only carries the difference
+type pexState struct {
+	sent     map[string]PeerInfo
+	sentAt   time.Time
+	recvAt   time.Time
+	received bool
+}
+
+// pexAddr returns the address other peers can dial c at, inbound peers are
+// only reachable on the port of their extended handshake
+func (c *PeerConn) pexAddr() (PeerInfo, bool) {
+	if c.outbound {
+		return c.Peer, true
+	}
+	hs := c.ExtHandshake()
+	if hs == nil || hs.P <= 0 || hs.P > 65535 {
+		return PeerInfo{}, false
+	}
+	return PeerInfo{Ip: c.Peer.Ip, Port: uint16(hs.P)}, true
+}
+
+func (c *PeerConn) pexFlags() byte {
+	var flags byte
+	if c.outbound {
+		flags |= PexReachable
+	}
+	if c.encrypted {
+		flags |= PexEncryption
+	}
+	if c.RemoteAddr().Network() == "udp" {
+		flags |= PexUTP
+	}
+	return flags
+}
+
+// compactPeer is the 6 byte form of IPv4 peers, or the 18 byte one of IPv6 peers
+func compactPeer(p PeerInfo) []byte {
+	ip := p.Ip.To4()
+	if ip == nil {
+		ip = p.Ip.To16()
+	}
+	buf := make([]byte, len(ip)+PortLen)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.Port)
+	return buf
+}
+
+// sendPex tells the peer which peers we connected to and dropped since the
+// last message
+func (t *Torrent) sendPex(c *PeerConn, current map[string]PeerInfo, flags map[string]byte) error {
+	if time.Since(c.pex.sentAt) < PexInterval {
+		return nil
+	}
+	msg := new(pexMsg)
+	var added, addedF, added6, added6F, dropped, dropped6 bytes.Buffer
+	sent := make(map[string]PeerInfo, len(c.pex.sent))
+	for addr, p := range c.pex.sent {
+		sent[addr] = p
+	}
+	self, _ := c.pexAddr()
+	nAdded := 0
+	for addr, p := range current {
+		if _, ok := sent[addr]; ok || addr == self.Addr() || nAdded >= PexMaxPeers {
+			continue
+		}
+		nAdded++
+		sent[addr] = p
+		if p.Ip.To4() != nil {
+			added.Write(compactPeer(p))
+			addedF.WriteByte(flags[addr])
+		} else {
+			added6.Write(compactPeer(p))
+			added6F.WriteByte(flags[addr])
+		}
+	}
+	nDropped := 0
+	for addr, p := range c.pex.sent {
+		if _, ok := current[addr]; ok || nDropped >= PexMaxPeers {
+			continue
+		}
+		nDropped++
+		delete(sent, addr)
+		if p.Ip.To4() != nil {
+			dropped.Write(compactPeer(p))
+		} else {
+			dropped6.Write(compactPeer(p))
+		}
+	}
+	if nAdded == 0 && nDropped == 0 {
+		return nil
+	}
+	msg.Added, msg.AddedF = added.String(), addedF.String()
+	msg.Added6, msg.Added6F = added6.String(), added6F.String()
+	msg.Dropped, msg.Dropped6 = dropped.String(), dropped6.String()
+
+	buf := new(bytes.Buffer)
+	bencode.Marshal(buf, msg)
+	err := c.WriteExtMsg(UtPex, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	c.pex.sent = sent
+	c.pex.sentAt = time.Now()
+	return nil
+}
+
+// handlePex dials the peers a peer told us about
+func (t *Torrent) handlePex(c *PeerConn, payload []byte) error {
+	// messages faster than allowed are ignored
+	if c.pex.received && time.Since(c.pex.recvAt) < PexInterval/2 {
+		return nil
+	}
+	c.pex.received = true
+	c.pex.recvAt = time.Now()
+
+	msg := new(pexMsg)
+	err := bencode.Unmarshal(bytes.NewReader(payload), msg)
+	if err != nil {
+		return err
+	}
+	peers := buildPeerInfo([]byte(msg.Added), IpLen)
+	peers = append(peers, buildPeerInfo([]byte(msg.Added6), Ip6Len)...)
+	if len(peers) > 2*PexMaxPeers {
+		peers = peers[:2*PexMaxPeers]
+	}
+	t.AddPeers(peers)
+	return nil
+}
+
+// pexRoutine sends ut_pex messages to every peer that supports it, private
+// torrents never run it
+func (t *Torrent) pexRoutine() {
+	ticker := time.NewTicker(PexInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		conns := t.connList()
+		current := make(map[string]PeerInfo, len(conns))
+		flags := make(map[string]byte, len(conns))
+		for _, c := range conns {
+			if p, ok := c.pexAddr(); ok {
+				current[p.Addr()] = p
+				flags[p.Addr()] = c.pexFlags()
+			}
+		}
+		for _, c := range conns {
+			if c.extId(UtPex) == 0 {
+				continue
+			}
+			t.sendPex(c, current, flags)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"go-torrent/bencode"
+	"net"
+	"testing"
+)
+
+// newPexConn returns a peer that supports ut_pex, the messages written to it
+// are sent on the returned channel
+func newPexConn(t *testing.T, peer PeerInfo) (*PeerConn, <-chan *pexMsg) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close() })
+	c := &PeerConn{Conn: a, Peer: peer, outbound: true, Ext: &ExtHandshake{M: map[string]int{UtPex: 3}}}
+	msgs := make(chan *pexMsg, 1)
+	go func() {
+		defer close(msgs)
+		r := &PeerConn{Conn: b}
+		for {
+			msg, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			if msg.Id != MsgExtended || msg.Payload[0] != 3 {
+				t.Errorf("unexpected message %d", msg.Id)
+				return
+			}
+			res := new(pexMsg)
+			err = bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), res)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msgs <- res
+		}
+	}()
+	return c, msgs
+}
+
+func pexPeers(peers ...PeerInfo) map[string]PeerInfo {
+	res := make(map[string]PeerInfo, len(peers))
+	for _, p := range peers {
+		res[p.Addr()] = p
+	}
+	return res
+}
+
+func TestPexAddedDropped(t *testing.T) {
+	tt := newTorrent(&TorrentTask{PieceSHA: make([][SHALEN]byte, 1)})
+	defer tt.close()
+	p4 := PeerInfo{Ip: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}
+	p6 := PeerInfo{Ip: net.ParseIP("2001:db8::1"), Port: 6882}
+	c, msgs := newPexConn(t, PeerInfo{Ip: net.IPv4(10, 0, 0, 9), Port: 1})
+
+	err := tt.sendPex(c, pexPeers(p4, p6), map[string]byte{p4.Addr(): PexSeed | PexReachable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	if msg.Added != string(compactPeer(p4)) || msg.AddedF != string([]byte{PexSeed | PexReachable}) {
+		t.Errorf("added %x, added.f %x", msg.Added, msg.AddedF)
+	}
+	if msg.Added6 != string(compactPeer(p6)) || len(msg.Added6F) != 1 {
+		t.Errorf("added6 %x, added6.f %x", msg.Added6, msg.Added6F)
+	}
+	got := buildPeerInfo([]byte(msg.Added6), Ip6Len)
+	if len(got) != 1 || !got[0].Ip.Equal(p6.Ip) || got[0].Port != p6.Port {
+		t.Errorf("added6 parsed as %v", got)
+	}
+
+	// nothing is sent again before the interval
+	err = tt.sendPex(c, pexPeers(p6), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.pex.sentAt = c.pex.sentAt.Add(-PexInterval)
+	err = tt.sendPex(c, pexPeers(p6), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = <-msgs
+	if msg.Added != "" || msg.Added6 != "" || msg.Dropped != string(compactPeer(p4)) {
+		t.Errorf("added %x, added6 %x, dropped %x", msg.Added, msg.Added6, msg.Dropped)
+	}
+}
+
+func TestPexMaxPeers(t *testing.T) {
+	tt := newTorrent(&TorrentTask{PieceSHA: make([][SHALEN]byte, 1)})
+	defer tt.close()
+	var peers []PeerInfo
+	for i := 0; i < 2*PexMaxPeers+10; i++ {
+		peers = append(peers, PeerInfo{Ip: net.IPv4(10, 0, byte(i>>8), byte(i)).To4(), Port: 6881})
+	}
+	c, msgs := newPexConn(t, PeerInfo{Ip: net.IPv4(10, 1, 0, 1), Port: 1})
+	err := tt.sendPex(c, pexPeers(peers...), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	if n := len(msg.Added) / PeerLen; n != PexMaxPeers {
+		t.Errorf("%d peers added, want %d", n, PexMaxPeers)
+	}
+	// the rest follows with the next message
+	c.pex.sentAt = c.pex.sentAt.Add(-PexInterval)
+	err = tt.sendPex(c, pexPeers(peers...), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = <-msgs
+	if n := len(msg.Added) / PeerLen; n != PexMaxPeers {
+		t.Errorf("%d peers added, want %d", n, PexMaxPeers)
+	}
+}
+
+func TestPexRateLimit(t *testing.T) {
+	tt := newTorrent(&TorrentTask{PieceSHA: make([][SHALEN]byte, 1)})
+	defer tt.close()
+	tt.startDownload()
+	c := &PeerConn{}
+	pexPayload := func(peers ...PeerInfo) []byte {
+		var added bytes.Buffer
+		for _, p := range peers {
+			added.Write(compactPeer(p))
+		}
+		buf := new(bytes.Buffer)
+		bencode.Marshal(buf, &pexMsg{Added: added.String()})
+		return buf.Bytes()
+	}
+	known := func() int {
+		tt.mu.Lock()
+		defer tt.mu.Unlock()
+		return len(tt.known)
+	}
+	// nothing listens on port 1, the dials fail at once
+	err := tt.handlePex(c, pexPayload(PeerInfo{Ip: net.IPv4(127, 0, 0, 1).To4(), Port: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known() != 1 {
+		t.Fatalf("%d peers known, want 1", known())
+	}
+	// a second message right away is ignored
+	err = tt.handlePex(c, pexPayload(PeerInfo{Ip: net.IPv4(127, 0, 0, 2).To4(), Port: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known() != 1 {
+		t.Errorf("%d peers known after a flood, want 1", known())
+	}
+	c.pex.recvAt = c.pex.recvAt.Add(-PexInterval)
+	err = tt.handlePex(c, pexPayload(PeerInfo{Ip: net.IPv4(127, 0, 0, 2).To4(), Port: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known() != 2 {
+		t.Errorf("%d peers known, want 2", known())
+	}
+}
+
+func TestPexPrivate(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		tt := newTorrent(&TorrentTask{PieceSHA: make([][SHALEN]byte, 1), Private: private})
+		_, ok := tt.extHandshake(&PeerConn{}).M[UtPex]
+		tt.close()
+		if ok == private {
+			t.Errorf("private %v, ut_pex advertised %v", private, ok)
+		}
+	}
+}
+
+func TestParsePrivate(t *testing.T) {
+	info := fmt.Sprintf("d6:lengthi1e4:name1:x12:piece lengthi1e6:pieces20:%s7:privatei1ee", make([]byte, SHALEN))
+	tf, err := ParseInfo([]byte(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tf.Private {
+		t.Error("private flag not parsed")
+	}
+}
@@ -0,0 +1,565 @@
+package torrent
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// the first pieces are picked at random, a rare piece takes longer to get
+// and we want something to trade quickly
+const RandomFirstPieces = 4
+
+const (
+	pieceNeeded    = iota
+	pieceActive    // its blocks are being requested
+	pieceVerifying // every block arrived, the hash is being checked
+	pieceDone      // verified
+)
+
+// blockState is a block of an active piece, it is needed while it has
+// neither arrived nor been requested from any peer
+type blockState struct {
+	received bool
+	owners   []*PeerConn // peers the block is requested from
+}
+
+type activePiece struct {
+	data     []byte
+	blocks   []blockState
+	received int
+	sender   *PeerConn // the peer every block came from so far
+	mixed    bool      // blocks came from several peers
+}
+
+// piecePicker decides which block a peer downloads next: blocks of pieces
+// already started first, so several peers finish a piece together, then
+// blocks of a piece the peer suggested, then blocks of the rarest piece
+// among the connected peers. In the endgame every
+// block is requested already, so blocks are requested again from other peers
+type piecePicker struct {
+	mu       sync.Mutex
+	avail    []int // connected peers that have each piece
+	state    []int
+	prio     []Priority
+	active   map[int]*activePiece
+	done     int
+	left     int   // wanted pieces that are not done
+	wasted   int64 // bytes of blocks received more than once
+	pieceLen int
+	totalLen int
+	changed  chan struct{}     // closed once blocks can be picked again
+	senders  map[int]*PeerConn // the single peer each verifying piece came from
+	paused   bool              // no block is picked
+	finished bool              // every wanted piece was done, the download is over
+}
+
+func newPiecePicker(numPieces, pieceLen, totalLen int) *piecePicker {
+	return &piecePicker{
+		avail:    make([]int, numPieces),
+		state:    make([]int, numPieces),
+		prio:     make([]Priority, numPieces),
+		active:   make(map[int]*activePiece),
+		left:     numPieces,
+		pieceLen: pieceLen,
+		totalLen: totalLen,
+		changed:  make(chan struct{}),
+		senders:  make(map[int]*PeerConn),
+	}
+}
+
+// addField counts the pieces of a peer, delta is 1 for a new peer and -1
+// for a peer that is gone
+func (p *piecePicker) addField(field Bitfield, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.avail {
+		if field.HasPiece(i) {
+			p.avail[i] += delta
+		}
+	}
+}
+
+func (p *piecePicker) have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.avail) {
+		p.avail[index]++
+	}
+}
+
+func (p *piecePicker) length(index int) int {
+	end := (index + 1) * p.pieceLen
+	if end > p.totalLen {
+		end = p.totalLen
+	}
+	return end - index*p.pieceLen
+}
+
+// block returns the request for the i-th block of a piece
+func (p *piecePicker) block(index, i int) blockRequest {
+	begin := i * BLOCKSIZE
+	length := p.length(index) - begin
+	if length > BLOCKSIZE {
+		length = BLOCKSIZE
+	}
+	return blockRequest{index, begin, length}
+}
+
+// nextBlock picks a needed block to request from c, ok tells which pieces c
+// may be asked for. The block stays requested until it arrives or is released
+func (p *piecePicker) nextBlock(c *PeerConn, ok func(index int) bool) (blockRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return blockRequest{}, false
+	}
+	index := p.best(ok, func(index int) bool {
+		return p.state[index] == pieceActive && p.active[index].needed() >= 0
+	})
+	// started pieces come first, unless a piece of a higher priority is needed
+	next := p.best(ok, func(index int) bool {
+		return p.state[index] == pieceNeeded
+	})
+	if s := p.suggested(c, ok); s >= 0 && (next < 0 || p.prio[s] >= p.prio[next]) {
+		next = s
+	}
+	if next >= 0 && (index < 0 || p.prio[next] > p.prio[index]) {
+		index = next
+		length := p.length(index)
+		p.state[index] = pieceActive
+		p.active[index] = &activePiece{
+			data:   make([]byte, length),
+			blocks: make([]blockState, (length+BLOCKSIZE-1)/BLOCKSIZE),
+		}
+	}
+	if index < 0 {
+		return p.duplicate(c, ok)
+	}
+	piece := p.active[index]
+	i := piece.needed()
+	piece.blocks[i].owners = append(piece.blocks[i].owners, c)
+	return p.block(index, i), true
+}
+
+// duplicate requests a block that is already requested from other peers,
+// once nothing is needed anymore. The block with the fewest peers is chosen
+func (p *piecePicker) duplicate(c *PeerConn, ok func(index int) bool) (blockRequest, bool) {
+	if !p.endgame() {
+		return blockRequest{}, false
+	}
+	var best *blockState
+	var req blockRequest
+	for index, piece := range p.active {
+		if !ok(index) || p.prio[index] == PrioritySkip {
+			continue
+		}
+		for i := range piece.blocks {
+			b := &piece.blocks[i]
+			if b.received || b.owns(c) {
+				continue
+			}
+			if best == nil || len(b.owners) < len(best.owners) {
+				best, req = b, p.block(index, i)
+			}
+		}
+	}
+	if best == nil {
+		return blockRequest{}, false
+	}
+	best.owners = append(best.owners, c)
+	return req, true
+}
+
+// endgame reports whether every missing block we want is requested
+func (p *piecePicker) endgame() bool {
+	for i, s := range p.state {
+		if s == pieceNeeded && p.prio[i] != PrioritySkip {
+			return false
+		}
+	}
+	for index, piece := range p.active {
+		if piece.needed() >= 0 && p.prio[index] != PrioritySkip {
+			return false
+		}
+	}
+	return true
+}
+
+// best returns the piece of the highest priority both filters accept, the
+// rarest one among them, -1 if there is none. Skipped pieces are never
+// returned. Ties are broken at random, and rarity does not count while the
+// first pieces are picked
+func (p *piecePicker) best(ok, want func(index int) bool) int {
+	best, ties := -1, 0
+	for i := range p.state {
+		if p.prio[i] == PrioritySkip || !want(i) || !ok(i) {
+			continue
+		}
+		cmp := 0
+		if best >= 0 {
+			cmp = int(p.prio[best] - p.prio[i])
+		}
+		if cmp == 0 && best >= 0 && p.done >= RandomFirstPieces {
+			cmp = p.avail[i] - p.avail[best]
+		}
+		switch {
+		case best < 0 || cmp < 0:
+			best, ties = i, 1
+		case cmp == 0:
+			// reservoir sampling, every tie is equally likely
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// suggested returns the needed piece of the highest priority c suggested,
+// the newest one among ties, -1 if there is none. The peer likely has it
+// cached, so it is served quickly
+func (p *piecePicker) suggested(c *PeerConn, ok func(index int) bool) int {
+	best := -1
+	for i := len(c.suggested) - 1; i >= 0; i-- {
+		index := c.suggested[i]
+		if p.state[index] != pieceNeeded || p.prio[index] == PrioritySkip || !ok(index) {
+			continue
+		}
+		if best < 0 || p.prio[index] > p.prio[best] {
+			best = index
+		}
+	}
+	return best
+}
+
+// needed returns the first block nobody has been asked for, -1 if there is none
+func (a *activePiece) needed() int {
+	for i, b := range a.blocks {
+		if !b.received && len(b.owners) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// blockAt returns the block of an active piece at begin, nil if there is none
+func (p *piecePicker) blockAt(index, begin int) *blockState {
+	piece := p.active[index]
+	if piece == nil || begin%BLOCKSIZE != 0 || begin/BLOCKSIZE >= len(piece.blocks) {
+		return nil
+	}
+	return &piece.blocks[begin/BLOCKSIZE]
+}
+
+// received stores a block from c, whichever peer it was requested from.
+// The other peers it was requested from are returned, to be cancelled. Once
+// the last block of the piece arrived its data is returned as well and the
+// piece is verifying
+func (p *piecePicker) received(c *PeerConn, index, begin int, data []byte) ([]byte, []*PeerConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.blockAt(index, begin)
+	if b == nil || b.received {
+		// a duplicate, unless we never needed it
+		if b != nil || index >= 0 && index < len(p.state) && p.state[index] != pieceNeeded {
+			p.wasted += int64(len(data))
+		}
+		return nil, nil, nil
+	}
+	if req := p.block(index, begin/BLOCKSIZE); len(data) != req.length {
+		return nil, nil, fmt.Errorf("block %d of piece %d has length %d, expected %d", begin, index, len(data), req.length)
+	}
+	b.drop(c)
+	var cancel []*PeerConn
+	if len(b.owners) > 0 {
+		// the other peers get their slots back
+		cancel = b.owners
+		p.notify()
+	}
+	piece := p.active[index]
+	b.received = true
+	b.owners = nil
+	copy(piece.data[begin:], data)
+	piece.received++
+	if piece.sender == nil {
+		piece.sender = c
+	} else if piece.sender != c {
+		piece.mixed = true
+	}
+	if piece.received < len(piece.blocks) {
+		return nil, cancel, nil
+	}
+	delete(p.active, index)
+	// skipped meanwhile, it is not written
+	if p.prio[index] == PrioritySkip {
+		p.state[index] = pieceNeeded
+		return nil, cancel, nil
+	}
+	p.state[index] = pieceVerifying
+	if !piece.mixed {
+		p.senders[index] = piece.sender
+	}
+	return piece.data, cancel, nil
+}
+
+// requested reports whether the block is still requested from c, it is not
+// once another peer sent it
+func (p *piecePicker) requested(c *PeerConn, req blockRequest) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.blockAt(req.index, req.begin)
+	return b != nil && b.owns(c)
+}
+
+// release gives up the request of a block from c, e.g. after a reject or a
+// timeout, so other peers may pick it
+func (p *piecePicker) release(c *PeerConn, req blockRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b := p.blockAt(req.index, req.begin); b != nil {
+		b.drop(c)
+	}
+	p.notify()
+}
+
+// releaseAll gives up every request of a peer that is gone
+func (p *piecePicker) releaseAll(c *PeerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, piece := range p.active {
+		for i := range piece.blocks {
+			piece.blocks[i].drop(c)
+		}
+	}
+	p.notify()
+}
+
+func (b *blockState) owns(c *PeerConn) bool {
+	for _, owner := range b.owners {
+		if owner == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blockState) drop(c *PeerConn) {
+	for i, owner := range b.owners {
+		if owner == c {
+			b.owners = append(b.owners[:i], b.owners[i+1:]...)
+			return
+		}
+	}
+}
+
+// failed puts back a piece whose hash did not match, all of it is requested
+// again. It returns the peer that sent all of it, nil if several did
+func (p *piecePicker) failed(index int) *PeerConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] != pieceVerifying {
+		return nil
+	}
+	sender := p.senders[index]
+	delete(p.senders, index)
+	p.state[index] = pieceNeeded
+	p.notify()
+	return sender
+}
+
+// finish records a verified piece
+func (p *piecePicker) finish(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == pieceDone {
+		return
+	}
+	p.state[index] = pieceDone
+	delete(p.active, index)
+	delete(p.senders, index)
+	p.done++
+	if p.prio[index] != PrioritySkip {
+		p.left--
+	}
+	if p.left == 0 {
+		p.finished = true
+		p.notify()
+	}
+}
+
+// setPriorities replaces the priority of every piece, files are the
+// priorities of the files alone, nil if prios are. Once the download is over
+// the pieces only a reader waits for are not wanted, the peers that would
+// fetch them are gone, but a file that is no longer skipped is wanted again
+func (p *piecePicker) setPriorities(prios, files []Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if files == nil {
+		files = prios
+	}
+	copy(p.prio, prios)
+	if p.finished {
+		for i, s := range p.state {
+			if s != pieceDone && files[i] != PrioritySkip && files[i] < priorityReader {
+				p.finished = false
+				break
+			}
+		}
+	}
+	p.left = 0
+	if p.finished {
+		p.notify()
+		return
+	}
+	for i, s := range p.state {
+		if s != pieceDone && p.prio[i] != PrioritySkip {
+			p.left++
+		}
+	}
+	p.notify()
+}
+
+// setPaused stops or resumes picking blocks, requests already sent are
+// still received
+func (p *piecePicker) setPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+	p.notify()
+}
+
+// progress returns how many of the wanted pieces are done
+func (p *piecePicker) progress() (done, wanted int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.state {
+		if p.prio[i] == PrioritySkip {
+			continue
+		}
+		wanted++
+		if s == pieceDone {
+			done++
+		}
+	}
+	return done, wanted
+}
+
+// partialPiece is what arrived of an active piece
+type partialPiece struct {
+	index    int
+	received []bool
+	data     []byte
+}
+
+// partials returns a copy of the active pieces that have blocks
+func (p *piecePicker) partials() []partialPiece {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var partials []partialPiece
+	for index, piece := range p.active {
+		if piece.received == 0 {
+			continue
+		}
+		received := make([]bool, len(piece.blocks))
+		for i, b := range piece.blocks {
+			received[i] = b.received
+		}
+		data := append([]byte(nil), piece.data...)
+		partials = append(partials, partialPiece{index, received, data})
+	}
+	return partials
+}
+
+// restore starts a needed piece with the blocks received before a restart
+func (p *piecePicker) restore(index int, received []bool, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] != pieceNeeded || len(received) != (len(data)+BLOCKSIZE-1)/BLOCKSIZE {
+		return
+	}
+	piece := &activePiece{data: data, blocks: make([]blockState, len(received))}
+	for i, ok := range received {
+		if ok {
+			piece.blocks[i].received = true
+			piece.received++
+		}
+	}
+	if piece.received == 0 || piece.received == len(piece.blocks) {
+		return
+	}
+	p.state[index] = pieceActive
+	p.active[index] = piece
+}
+
+func (p *piecePicker) addWasted(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.wasted += n
+}
+
+// stats returns the wasted bytes and whether the endgame started
+func (p *piecePicker) stats() (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wasted, p.left > 0 && p.endgame()
+}
+
+// leftBytes returns the bytes of the pieces we want that are not done
+func (p *piecePicker) leftBytes() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return 0
+	}
+	var n int64
+	for i, s := range p.state {
+		if s != pieceDone && p.prio[i] != PrioritySkip {
+			n += int64(p.length(i))
+		}
+	}
+	return n
+}
+
+// complete reports whether every piece we want is done
+func (p *piecePicker) complete() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left == 0
+}
+
+// wait returns a channel that is closed once nextBlock may find something new
+func (p *piecePicker) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changed
+}
+
+func (p *piecePicker) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// peerHave records a Have of the peer
+func (t *Torrent) peerHave(c *PeerConn, index int) {
+	if index < 0 || index >= len(t.PieceSHA) || c.Field.HasPiece(index) {
+		return
+	}
+	c.Field.SetPiece(index)
+	if c.counted {
+		t.picker.have(index)
+	}
+}
+
+// setPeerField replaces the bitfield of the peer, Have All is applied by sizeField
+func (t *Torrent) setPeerField(c *PeerConn, field Bitfield) {
+	if c.counted {
+		t.picker.addField(c.Field, -1)
+	}
+	c.Field = field
+	c.sizeField(len(t.PieceSHA))
+	if c.counted {
+		t.picker.addField(c.Field, 1)
+	}
+}
@@ -0,0 +1,281 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+// newTestPicker returns a picker of n pieces of a block each, past the
+// random first pieces
+func newTestPicker(n int) *piecePicker {
+	p := newPiecePicker(n, BLOCKSIZE, n*BLOCKSIZE)
+	p.done = RandomFirstPieces
+	return p
+}
+
+func anyPiece(int) bool { return true }
+
+func TestPickerRarest(t *testing.T) {
+	p := newTestPicker(4)
+	p.addField(Bitfield{0xf0}, 1)
+	p.addField(Bitfield{0xb0}, 1)
+	p.addField(Bitfield{0x90}, 1)
+	p.have(0)
+	// availability 4, 1, 2, 3
+	c := &PeerConn{}
+	for _, want := range []int{1, 2, 3, 0} {
+		req, ok := p.nextBlock(c, anyPiece)
+		if !ok || req.index != want {
+			t.Fatalf("picked %d, want %d", req.index, want)
+		}
+	}
+	if req, ok := p.nextBlock(c, anyPiece); ok {
+		t.Errorf("picked requested block of piece %d", req.index)
+	}
+}
+
+func TestPickerPriority(t *testing.T) {
+	p := newTestPicker(3)
+	p.avail = []int{1, 2, 3}
+	p.setPriorities([]Priority{PrioritySkip, PriorityNormal, PriorityHigh}, nil)
+	c := &PeerConn{}
+	req, ok := p.nextBlock(c, anyPiece)
+	if !ok || req.index != 2 {
+		t.Fatalf("picked %d, want the high priority piece", req.index)
+	}
+	req, ok = p.nextBlock(c, anyPiece)
+	if !ok || req.index != 1 {
+		t.Fatalf("picked %d, want 1", req.index)
+	}
+	// the skipped piece is never picked, not even in the endgame
+	if req, ok := p.nextBlock(&PeerConn{}, func(index int) bool { return index == 0 }); ok {
+		t.Fatalf("picked skipped piece %d", req.index)
+	}
+}
+
+func TestPickerSkipped(t *testing.T) {
+	p := newTestPicker(2)
+	c := &PeerConn{}
+	req, _ := p.nextBlock(c, func(index int) bool { return index == 1 })
+	p.setPriorities([]Priority{PriorityNormal, PrioritySkip}, nil)
+	if p.complete() {
+		t.Fatal("complete with a wanted piece left")
+	}
+	// the piece was skipped while its block was on the way
+	data, _, err := p.received(c, req.index, req.begin, make([]byte, req.length))
+	if err != nil || data != nil {
+		t.Fatalf("skipped piece returned for verifying, %v", err)
+	}
+	p.finish(0)
+	if !p.complete() {
+		t.Error("not complete with every wanted piece done")
+	}
+	if done, wanted := p.progress(); done != 1 || wanted != 1 {
+		t.Errorf("progress %d of %d, want 1 of 1", done, wanted)
+	}
+}
+
+func TestPickerSuggested(t *testing.T) {
+	p := newTestPicker(6)
+	p.avail = []int{1, 5, 5, 5, 5, 5}
+	c := &PeerConn{suggested: []int{3, 4}}
+	req, ok := p.nextBlock(c, anyPiece)
+	if !ok || req.index != 4 {
+		t.Fatalf("picked %d, want the newest suggestion", req.index)
+	}
+	req, ok = p.nextBlock(c, anyPiece)
+	if !ok || req.index != 3 {
+		t.Fatalf("picked %d, want the other suggestion", req.index)
+	}
+	// nothing suggested is needed anymore, the rarest is next
+	req, ok = p.nextBlock(c, anyPiece)
+	if !ok || req.index != 0 {
+		t.Fatalf("picked %d, want the rarest", req.index)
+	}
+
+	// a suggestion the peer may not be asked for, or of a lower priority,
+	// is passed over
+	p = newTestPicker(3)
+	p.setPriorities([]Priority{PriorityNormal, PriorityLow, PriorityNormal}, nil)
+	c = &PeerConn{suggested: []int{1, 2}}
+	req, ok = p.nextBlock(c, func(index int) bool { return index != 2 })
+	if !ok || req.index != 0 {
+		t.Fatalf("picked %d, want 0", req.index)
+	}
+}
+
+func TestPickerPeerGone(t *testing.T) {
+	p := newTestPicker(2)
+	p.addField(Bitfield{0xc0}, 1)
+	p.addField(Bitfield{0x80}, 1)
+	p.addField(Bitfield{0x80}, -1)
+	p.have(1)
+	// piece 0 is left with one peer, piece 1 has two
+	if req, _ := p.nextBlock(&PeerConn{}, anyPiece); req.index != 0 {
+		t.Errorf("picked %d, want 0", req.index)
+	}
+}
+
+func TestPickerSharedPiece(t *testing.T) {
+	p := newPiecePicker(2, 2*BLOCKSIZE, 3*BLOCKSIZE+10)
+	p.done = RandomFirstPieces
+	p.avail = []int{2, 1}
+	a, b := &PeerConn{}, &PeerConn{}
+	ra, _ := p.nextBlock(a, anyPiece)
+	// the piece a started is finished by b before a new one is started
+	rb, _ := p.nextBlock(b, anyPiece)
+	if ra.index != 1 || rb.index != 1 || ra.begin != 0 || rb.begin != BLOCKSIZE {
+		t.Fatalf("picked %v and %v", ra, rb)
+	}
+	if rb.length != 10 {
+		t.Errorf("last block of %d bytes, want 10", rb.length)
+	}
+	rc, _ := p.nextBlock(a, anyPiece)
+	if rc.index != 0 {
+		t.Errorf("picked %d, want 0", rc.index)
+	}
+}
+
+func TestPickerRelease(t *testing.T) {
+	p := newTestPicker(2)
+	a, b := &PeerConn{}, &PeerConn{}
+	ra, _ := p.nextBlock(a, func(index int) bool { return index == 0 })
+	if _, ok := p.nextBlock(b, func(index int) bool { return index == 0 }); ok {
+		t.Fatal("block requested twice")
+	}
+	// a rejected block goes to the next peer
+	changed := p.wait()
+	p.release(a, ra)
+	select {
+	case <-changed:
+	default:
+		t.Error("waiters not woken up by a release")
+	}
+	rb, ok := p.nextBlock(b, func(index int) bool { return index == 0 })
+	if !ok || rb != ra {
+		t.Fatalf("picked %v, want %v", rb, ra)
+	}
+	// and so do the blocks of a peer that is gone
+	p.releaseAll(b)
+	if req, ok := p.nextBlock(a, func(index int) bool { return index == 0 }); !ok || req != ra {
+		t.Errorf("picked %v, want %v", req, ra)
+	}
+}
+
+func TestPickerReceived(t *testing.T) {
+	p := newPiecePicker(1, 2*BLOCKSIZE, 2*BLOCKSIZE)
+	c := &PeerConn{}
+	r0, _ := p.nextBlock(c, anyPiece)
+	r1, _ := p.nextBlock(c, anyPiece)
+	block := bytes.Repeat([]byte{1}, BLOCKSIZE)
+	if _, _, err := p.received(c, 0, r1.begin, block[:10]); err == nil {
+		t.Error("short block accepted")
+	}
+	data, _, err := p.received(c, 0, r1.begin, block)
+	if err != nil || data != nil {
+		t.Fatalf("complete %v, %v", data != nil, err)
+	}
+	// a block arriving twice is only stored once
+	data, _, _ = p.received(c, 0, r1.begin, block)
+	if data != nil {
+		t.Fatal("piece completed by a duplicate")
+	}
+	if wasted, _ := p.stats(); wasted != BLOCKSIZE {
+		t.Errorf("%d bytes wasted, want %d", wasted, BLOCKSIZE)
+	}
+	data, _, err = p.received(c, 0, r0.begin, make([]byte, BLOCKSIZE))
+	if err != nil || data == nil || !bytes.Equal(data[BLOCKSIZE:], block) {
+		t.Fatalf("complete %v, %v", data != nil, err)
+	}
+
+	// a piece that fails the hash check is requested again
+	p.failed(0)
+	if req, ok := p.nextBlock(c, anyPiece); !ok || req != r0 {
+		t.Errorf("picked %v, want %v", req, r0)
+	}
+}
+
+func TestPickerFinish(t *testing.T) {
+	p := newPiecePicker(2, BLOCKSIZE, 2*BLOCKSIZE)
+	changed := p.wait()
+	c := &PeerConn{}
+	for i := 0; i < 2; i++ {
+		req, _ := p.nextBlock(c, anyPiece)
+		p.received(c, req.index, req.begin, make([]byte, req.length))
+		p.finish(req.index)
+	}
+	if !p.complete() {
+		t.Fatal("picker not complete")
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("waiters not woken up once complete")
+	}
+	if req, ok := p.nextBlock(c, anyPiece); ok {
+		t.Errorf("picked finished piece %d", req.index)
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	p := newPiecePicker(2, BLOCKSIZE, 2*BLOCKSIZE)
+	a, b := &PeerConn{}, &PeerConn{}
+	r1, _ := p.nextBlock(a, anyPiece)
+	if _, endgame := p.stats(); endgame {
+		t.Fatal("endgame with a block left")
+	}
+	r2, _ := p.nextBlock(a, anyPiece)
+	if _, endgame := p.stats(); !endgame {
+		t.Fatal("no endgame with every block requested")
+	}
+	req, ok := p.nextBlock(b, anyPiece)
+	if !ok || (req != r1 && req != r2) {
+		t.Fatalf("got %v in the endgame", req)
+	}
+	if !p.requested(a, req) || !p.requested(b, req) {
+		t.Fatal("block not requested from both peers")
+	}
+	data, cancel, err := p.received(b, req.index, req.begin, make([]byte, req.length))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data == nil || len(cancel) != 1 || cancel[0] != a {
+		t.Fatalf("piece %v, cancel %v", data != nil, cancel)
+	}
+	if p.requested(a, req) {
+		t.Error("block still requested once received")
+	}
+	// the late copy of a is wasted
+	p.received(a, req.index, req.begin, make([]byte, req.length))
+	if wasted, _ := p.stats(); wasted != int64(req.length) {
+		t.Errorf("%d bytes wasted, want %d", wasted, req.length)
+	}
+}
+
+func TestPickerFinished(t *testing.T) {
+	p := newTestPicker(2)
+	p.setPriorities([]Priority{PriorityNormal, PrioritySkip}, nil)
+	p.finish(0)
+	if !p.complete() {
+		t.Fatal("not complete with every wanted piece done")
+	}
+	// the download is over, a reader wanting the skipped piece does not
+	// revive it
+	p.setPriorities([]Priority{PriorityNormal, priorityReader}, []Priority{PriorityNormal, PrioritySkip})
+	if !p.complete() {
+		t.Error("finished download wants a piece again")
+	}
+
+	// a file that is no longer skipped is wanted again, even while read
+	p.setPriorities([]Priority{PriorityNormal, priorityReader}, []Priority{PriorityNormal, PriorityNormal})
+	if p.complete() {
+		t.Fatal("unskipped piece not wanted after the download finished")
+	}
+	if done, wanted := p.progress(); done != 1 || wanted != 2 {
+		t.Errorf("progress %d of %d, want 1 of 2", done, wanted)
+	}
+	p.finish(1)
+	if !p.complete() {
+		t.Error("not complete once the unskipped piece is done")
+	}
+}
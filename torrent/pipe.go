@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PipeNetwork is an in-memory Transport, peers on it are connected with
+// net.Pipe, e.g. to run a swarm inside a test. Addresses are ip:port like on
+// TCP, an empty host listens on 127.0.0.1 and port 0 picks a free one.
+type PipeNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+	nextPort  int
+}
+
+func NewPipeNetwork() *PipeNetwork {
+	return &PipeNetwork{
+		listeners: make(map[string]*pipeListener),
+		nextPort:  10000,
+	}
+}
+
+func (n *PipeNetwork) freeAddr(ip net.IP) *net.TCPAddr {
+	for {
+		n.nextPort++
+		addr := &net.TCPAddr{IP: ip, Port: n.nextPort}
+		if _, ok := n.listeners[addr.String()]; !ok {
+			return addr
+		}
+	}
+}
+
+func (n *PipeNetwork) Listen(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid pipe address: %s", addr)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	local := &net.TCPAddr{IP: ip, Port: p}
+	if p == 0 {
+		local = n.freeAddr(ip)
+	}
+	if _, ok := n.listeners[local.String()]; ok {
+		return nil, fmt.Errorf("address in use: %s", local)
+	}
+	l := &pipeListener{
+		n:      n,
+		addr:   local,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	n.listeners[local.String()] = l
+	return l, nil
+}
+
+func (n *PipeNetwork) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	l := n.listeners[raddr.String()]
+	local := n.freeAddr(net.IPv4(127, 0, 0, 1))
+	n.mu.Unlock()
+	if l == nil {
+		return nil, fmt.Errorf("connection refused: %s", addr)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- newPipeConn(server, l.addr, local):
+		return newPipeConn(client, local, l.addr), nil
+	case <-l.closed:
+		return nil, fmt.Errorf("connection refused: %s", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeListener struct {
+	n      *PipeNetwork
+	addr   *net.TCPAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.n.mu.Lock()
+		delete(l.n.listeners, l.addr.String())
+		l.n.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipeFlush is how long Close waits for the other side to read what was written
+const pipeFlush = time.Second
+
+// pipeConn buffers writes, net.Pipe blocks a writer until the other side
+// reads, which deadlocks peers that write at the same time like on TCP
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+	mu            sync.Mutex
+	cond          *sync.Cond
+	buf           []byte
+	closed        bool
+}
+
+func newPipeConn(conn net.Conn, local, remote net.Addr) *pipeConn {
+	c := &pipeConn{Conn: conn, local: local, remote: remote}
+	c.cond = sync.NewCond(&c.mu)
+	go c.writeLoop()
+	return c
+}
+
+func (c *pipeConn) writeLoop() {
+	for {
+		c.mu.Lock()
+		for len(c.buf) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		buf := c.buf
+		c.buf = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if len(buf) == 0 && closed {
+			c.Conn.Close()
+			return
+		}
+		_, err := c.Conn.Write(buf)
+		if err != nil {
+			// the other side is gone, later writes fail
+			c.mu.Lock()
+			c.closed = true
+			c.buf = nil
+			c.mu.Unlock()
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.buf = append(c.buf, b...)
+	c.cond.Signal()
+	return len(b), nil
+}
+
+// Close lets the written data drain for up to pipeFlush
+func (c *pipeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.cond.Signal()
+	time.AfterFunc(pipeFlush, func() {
+		c.Conn.Close()
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline only applies to reads, writes never block
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package torrent
+
+import (
+	"math"
+	"time"
+)
+
+// MAXPIPELINE caps the requests outstanding with a peer that does not
+// announce reqq in its extended handshake
+const MAXPIPELINE = 250
+
+// pipeline sizes the request queue of a peer from the bandwidth-delay
+// product: the bytes in flight during one round trip at the measured rate.
+// The queue is kept at twice that, so a faster link is noticed as the rate
+// keeps up with the deeper queue, and shrinks again once the rate does not
+type pipeline struct {
+	depth     int
+	rtt       time.Duration // lowest block latency seen, before any queueing
+	rate      float64       // bytes per second, smoothed
+	lastBytes int64
+	lastTick  time.Time
+}
+
+func newPipeline() pipeline {
+	return pipeline{depth: MAXBLOCK, lastTick: time.Now()}
+}
+
+// sample records the latency of a block, from its request to its arrival
+func (p *pipeline) sample(latency time.Duration) {
+	if p.rtt == 0 || latency < p.rtt {
+		p.rtt = latency
+	}
+}
+
+// adjust updates the rate from the bytes received so far and resizes the
+// queue, max is the most requests the peer accepts
+func (p *pipeline) adjust(downloaded int64, max int) {
+	now := time.Now()
+	elapsed := now.Sub(p.lastTick).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	p.rate = (p.rate + float64(downloaded-p.lastBytes)/elapsed) / 2
+	p.lastBytes, p.lastTick = downloaded, now
+	if p.rtt > 0 {
+		bdp := p.rate * p.rtt.Seconds() / BLOCKSIZE
+		p.depth = int(math.Ceil(2 * bdp))
+	}
+	if p.depth < MAXBLOCK {
+		p.depth = MAXBLOCK
+	}
+	if p.depth > max {
+		p.depth = max
+	}
+}
+
+// maxRequests returns how many requests the peer accepts at once, its reqq
+// if it announced one
+func (c *PeerConn) maxRequests() int {
+	if hs := c.ExtHandshake(); hs != nil && hs.Reqq > 0 && hs.Reqq < MAXPIPELINE {
+		return hs.Reqq
+	}
+	return MAXPIPELINE
+}
@@ -0,0 +1,72 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+)
+
+// tick adjusts p as if blocks arrived during the last second
+func tick(p *pipeline, blocks int, max int) {
+	p.lastTick = time.Now().Add(-time.Second)
+	p.adjust(p.lastBytes+int64(blocks*BLOCKSIZE), max)
+}
+
+func TestPipelineDepth(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rtt    time.Duration
+		rate   int // blocks per second before the tick
+		blocks int // blocks received during the tick
+		max    int
+		want   int
+	}{
+		{"no rtt yet", 0, 0, 1000, MAXPIPELINE, MAXBLOCK},
+		{"idle", 100 * time.Millisecond, 0, 0, MAXPIPELINE, MAXBLOCK},
+		{"steady", 100 * time.Millisecond, 100, 100, MAXPIPELINE, 20},
+		{"ramp up", 100 * time.Millisecond, 0, 100, MAXPIPELINE, 10},
+		{"long rtt", time.Second, 100, 100, MAXPIPELINE, 200},
+		{"capped", time.Second, 1000, 1000, MAXPIPELINE, MAXPIPELINE},
+		{"reqq", time.Second, 1000, 1000, 100, 100},
+	} {
+		p := newPipeline()
+		p.rtt = tc.rtt
+		p.rate = float64(tc.rate * BLOCKSIZE)
+		tick(&p, tc.blocks, tc.max)
+		if p.depth != tc.want {
+			t.Errorf("%s: depth %d, want %d", tc.name, p.depth, tc.want)
+		}
+	}
+}
+
+func TestPipelineSlowDown(t *testing.T) {
+	p := newPipeline()
+	p.sample(300 * time.Millisecond)
+	p.sample(100 * time.Millisecond)
+	p.sample(200 * time.Millisecond)
+	if p.rtt != 100*time.Millisecond {
+		t.Fatalf("rtt %v, want the lowest latency", p.rtt)
+	}
+	p.rate = 100 * BLOCKSIZE
+	// the peer drops to 10 blocks a second, the queue follows the smoothed rate
+	for _, want := range []int{11, 7, 5, 5} {
+		tick(&p, 10, MAXPIPELINE)
+		if p.depth != want {
+			t.Errorf("depth %d, want %d", p.depth, want)
+		}
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	c := &PeerConn{}
+	if n := c.maxRequests(); n != MAXPIPELINE {
+		t.Errorf("%d requests without handshake, want %d", n, MAXPIPELINE)
+	}
+	c.Ext = &ExtHandshake{Reqq: 16}
+	if n := c.maxRequests(); n != 16 {
+		t.Errorf("%d requests, want the reqq of 16", n)
+	}
+	c.Ext = &ExtHandshake{Reqq: 10000}
+	if n := c.maxRequests(); n != MAXPIPELINE {
+		t.Errorf("%d requests, want at most %d", n, MAXPIPELINE)
+	}
+}
@@ -0,0 +1,136 @@
+package torrent
+
+import "sync"
+
+// Priority orders the pieces to download, higher ones are picked first
+type Priority int
+
+const (
+	PrioritySkip   Priority = -2 // not downloaded at all
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// Priorities select the files of a torrent to download and in which order,
+// pieces may override the priority of their files. They may be changed while
+// the download runs
+type Priorities struct {
+	mu      sync.Mutex
+	files   []Priority
+	pieces  map[int]Priority
+	changed func() // set by the torrent that uses them
+}
+
+// NewPriorities returns normal priorities for a torrent with numFiles files,
+// a single-file torrent has one
+func NewPriorities(numFiles int) *Priorities {
+	return &Priorities{
+		files:  make([]Priority, numFiles),
+		pieces: make(map[int]Priority),
+	}
+}
+
+func (p *Priorities) File(index int) Priority {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index < 0 || index >= len(p.files) {
+		return PriorityNormal
+	}
+	return p.files[index]
+}
+
+func (p *Priorities) SetFile(index int, prio Priority) {
+	p.mu.Lock()
+	if index < 0 || index >= len(p.files) {
+		p.mu.Unlock()
+		return
+	}
+	p.files[index] = prio
+	changed := p.changed
+	p.mu.Unlock()
+	if changed != nil {
+		changed()
+	}
+}
+
+// SetPiece overrides the priority of the files of a piece
+func (p *Priorities) SetPiece(index int, prio Priority) {
+	p.mu.Lock()
+	p.pieces[index] = prio
+	changed := p.changed
+	p.mu.Unlock()
+	if changed != nil {
+		changed()
+	}
+}
+
+// ClearPiece makes a piece follow its files again
+func (p *Priorities) ClearPiece(index int) {
+	p.mu.Lock()
+	delete(p.pieces, index)
+	changed := p.changed
+	p.mu.Unlock()
+	if changed != nil {
+		changed()
+	}
+}
+
+func (p *Priorities) watch(changed func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.changed = changed
+}
+
+// pieceList returns the priority of each piece: its override, or the highest of
+// the files it touches. Only pieces whose files are all skipped are skipped
+func (p *Priorities) pieceList(l *layout, numPieces int) []Priority {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prios := make([]Priority, numPieces)
+	for i := range prios {
+		if prio, ok := p.pieces[i]; ok {
+			prios[i] = prio
+			continue
+		}
+		prio := PrioritySkip
+		for _, s := range l.spans(i) {
+			if s.file < len(p.files) && p.files[s.file] > prio {
+				prio = p.files[s.file]
+			}
+		}
+		prios[i] = prio
+	}
+	return prios
+}
+
+// priorityReader is the lowest priority of a piece a reader waits for, the
+// next piece it reads gets the highest
+const priorityReader = PriorityHigh + 1
+
+// applyPriorities hands the current priorities to the picker, the pieces
+// ahead of each reader come first, even those of skipped files
+func (t *Torrent) applyPriorities() {
+	t.prioMu.Lock()
+	defer t.prioMu.Unlock()
+	var prios []Priority
+	if t.Priorities != nil {
+		l := newLayout(t.Files, t.PieceLen, t.FileLen)
+		prios = t.Priorities.pieceList(l, len(t.PieceSHA))
+	} else {
+		prios = make([]Priority, len(t.PieceSHA))
+	}
+	files := append([]Priority(nil), prios...)
+	for _, r := range t.readerList() {
+		first, last, ok := r.window()
+		if !ok {
+			continue
+		}
+		for i := first; i <= last; i++ {
+			if prio := priorityReader + Priority(last-i); prio > prios[i] {
+				prios[i] = prio
+			}
+		}
+	}
+	t.picker.setPriorities(prios, files)
+}
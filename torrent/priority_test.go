@@ -0,0 +1,50 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPieceList(t *testing.T) {
+	// pieces 0 and 1 lie in a, piece 2 spans a and b, 3 and 4 lie in b
+	l := newLayout([]FileInfo{{[]string{"a"}, 2500}, {[]string{"b"}, 2500}}, 1<<10, 5000)
+	prios := NewPriorities(2)
+	prios.SetFile(0, PrioritySkip)
+	prios.SetFile(1, PriorityLow)
+	prios.SetPiece(4, PriorityHigh)
+	got := prios.pieceList(l, 5)
+	want := []Priority{PrioritySkip, PrioritySkip, PriorityLow, PriorityLow, PriorityHigh}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("priorities %v, want %v", got, want)
+	}
+	prios.ClearPiece(4)
+	if got := prios.pieceList(l, 5); got[4] != PriorityLow {
+		t.Errorf("cleared piece has priority %d", got[4])
+	}
+}
+
+func TestDownloadSkipFile(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<14, 100000, 50000, 100000)
+	ln := newSeed(t, tf, data, nil)
+	task := newTestTask(tf, t.TempDir())
+	task.PeerList = []PeerInfo{listenerPeer(ln)}
+	task.Priorities = NewPriorities(3)
+	task.Priorities.SetFile(1, PrioritySkip)
+	err := Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.ReadFile(filepath.Join(task.FileName, "a"))
+	c, _ := os.ReadFile(filepath.Join(task.FileName, "c"))
+	if !bytes.Equal(a, data[:100000]) || !bytes.Equal(c, data[150000:]) {
+		t.Error("wanted files differ")
+	}
+	// b lies within the pieces shared with a and c, but is not created
+	// by itself
+	if b, err := os.ReadFile(filepath.Join(task.FileName, "b")); err == nil && bytes.Equal(b, data[100000:150000]) {
+		t.Error("skipped file downloaded in full")
+	}
+}
@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultReadahead is how many bytes ahead of a reader are fetched first
+const DefaultReadahead = 4 << 20
+
+// ErrNotDownloaded is returned for a read of a piece that is not verified
+// and will not be, e.g. once the download stopped
+var ErrNotDownloaded = errors.New("piece not downloaded")
+
+var errReaderClosed = errors.New("reader closed")
+
+// Reader reads a file of a torrent while it downloads. A read blocks until
+// the piece it needs is verified, the pieces from the position of the reader
+// on are downloaded in order before any other
+type Reader struct {
+	t      *Torrent
+	offset int64 // of the file in the torrent
+	length int64
+	closed chan struct{}
+	once   sync.Once
+	// reads of pieces that are not verified fail instead of waiting
+	failFast bool
+
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+}
+
+// NewReader opens the file at index in the file list of the torrent, 0 for
+// a single-file torrent. It reads DefaultReadahead ahead
+func (t *Torrent) NewReader(file int) (*Reader, error) {
+	l := newLayout(t.Files, t.PieceLen, t.FileLen)
+	if file < 0 || file >= len(l.files) {
+		return nil, fmt.Errorf("file index out of range: %d", file)
+	}
+	r := &Reader{
+		t:         t,
+		offset:    int64(l.offsets[file]),
+		length:    int64(l.files[file].Length),
+		closed:    make(chan struct{}),
+		readahead: DefaultReadahead,
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("torrent closed")
+	}
+	t.readers[r] = struct{}{}
+	t.mu.Unlock()
+	t.applyPriorities()
+	return r, nil
+}
+
+// readerList returns the open readers
+func (t *Torrent) readerList() []*Reader {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	readers := make([]*Reader, 0, len(t.readers))
+	for r := range t.readers {
+		readers = append(readers, r)
+	}
+	return readers
+}
+
+// SetReadahead sets how many bytes from the position on are fetched first,
+// the piece at the position always is
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	r.readahead = max(n, 0)
+	r.mu.Unlock()
+	r.t.applyPriorities()
+}
+
+// window returns the pieces from the position to the end of the readahead,
+// false at the end of the file
+func (r *Reader) window() (first, last int, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pos >= r.length {
+		return 0, 0, false
+	}
+	end := min(r.pos+max(r.readahead, 1), r.length)
+	first = int((r.offset + r.pos) / int64(r.t.PieceLen))
+	last = int((r.offset + end - 1) / int64(r.t.PieceLen))
+	return first, last, true
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.ReadContext(context.Background(), p)
+}
+
+// ReadContext is Read giving up once ctx is done. It reads at most up to the
+// end of the piece at the position
+func (r *Reader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, errReaderClosed
+	default:
+	}
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+	if pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	off := r.offset + pos
+	index := int(off / int64(r.t.PieceLen))
+	if r.failFast && !r.t.hasPiece(index) {
+		return 0, fmt.Errorf("%w: %d", ErrNotDownloaded, index)
+	}
+	err := r.t.waitPiece(ctx, index, r.closed)
+	if err != nil {
+		return 0, err
+	}
+	pieceBegin, pieceEnd := r.t.getPieceBound(index)
+	begin := int(off) - pieceBegin
+	n := min(len(p), pieceEnd-int(off))
+	if rest := r.length - pos; int64(n) > rest {
+		n = int(rest)
+	}
+	r.t.mu.Lock()
+	storage := r.t.storage
+	r.t.mu.Unlock()
+	if storage == nil {
+		return 0, fmt.Errorf("torrent closed")
+	}
+	n, err = storage.ReadAt(index, p[:n], begin)
+	if err != nil {
+		return n, err
+	}
+
+	r.mu.Lock()
+	// a seek meanwhile wins
+	moved := r.pos == pos
+	if moved {
+		r.pos += int64(n)
+	}
+	next := int((r.offset + r.pos) / int64(r.t.PieceLen))
+	r.mu.Unlock()
+	if moved && next != index {
+		r.t.applyPriorities()
+	}
+	return n, nil
+}
+
+// Seek moves the position, the pieces from there on are fetched first right
+// away
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		r.mu.Unlock()
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		r.mu.Unlock()
+		return 0, fmt.Errorf("negative position: %d", offset)
+	}
+	r.pos = offset
+	r.mu.Unlock()
+	r.t.applyPriorities()
+	return offset, nil
+}
+
+// Close unblocks pending reads, its pieces are no longer fetched first
+func (r *Reader) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.t.mu.Lock()
+		delete(r.t.readers, r)
+		r.t.mu.Unlock()
+		r.t.applyPriorities()
+	})
+	return nil
+}
+
+// waitPiece blocks until the piece is verified. It fails once ctx is done,
+// cancel is closed, the torrent is closed, or the download stopped without it
+func (t *Torrent) waitPiece(ctx context.Context, index int, cancel <-chan struct{}) error {
+	for {
+		t.mu.Lock()
+		has := t.field.HasPiece(index)
+		verified := t.verified
+		closed := t.closed
+		t.mu.Unlock()
+		if has {
+			return nil
+		}
+		if closed {
+			return fmt.Errorf("torrent closed")
+		}
+		select {
+		case <-t.stopped:
+			return fmt.Errorf("%w: %d", ErrNotDownloaded, index)
+		default:
+		}
+		select {
+		case <-verified:
+		case <-t.stopped:
+		case <-t.done:
+		case <-cancel:
+			return errReaderClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
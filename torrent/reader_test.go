@@ -0,0 +1,145 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<15, 10<<15, 30<<15+500)
+	ln := newSeed(t, tf, data, nil)
+	tt, err := Start(newTestTask(tf, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	r, err := tt.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.SetReadahead(2 << 15)
+	_, err = r.Seek(20<<15+100, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pieces ahead of the reader come first, the nearest one before all
+	tt.picker.mu.Lock()
+	prios := append([]Priority(nil), tt.picker.prio[30:34]...)
+	tt.picker.mu.Unlock()
+	if !(prios[0] > prios[1] && prios[1] > prios[2] && prios[2] > PriorityHigh && prios[3] == PriorityNormal) {
+		t.Errorf("priorities %v from the position on", prios)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = r.ReadContext(ctx, make([]byte, 1000))
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("read without peers: %v", err)
+	}
+
+	tt.AddPeers([]PeerInfo{{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Port())}})
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data[30<<15+100:]) {
+		t.Fatalf("read from the position differs, %v", err)
+	}
+	r.Seek(0, io.SeekStart)
+	got, err = io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data[10<<15:]) {
+		t.Fatalf("read from the start differs, %v", err)
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	tf, _ := newTestTorrent(t, "file", 1<<15, 4<<15)
+	tt, err := Start(newTestTask(tf, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error)
+	r, _ := tt.NewReader(0)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	r.Close()
+	if err := <-errs; err != errReaderClosed {
+		t.Errorf("read of a closed reader: %v", err)
+	}
+
+	r, _ = tt.NewReader(0)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	tt.Close()
+	if err := <-errs; err == nil {
+		t.Error("read of a closed torrent succeeded")
+	}
+}
+
+func TestReaderSkipped(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<15, 4<<15, 4<<15)
+	ln := newSeed(t, tf, data, nil)
+	task := newTestTask(tf, t.TempDir())
+	task.Priorities = NewPriorities(2)
+	task.Priorities.SetFile(0, PrioritySkip)
+	tt, err := Start(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// while downloading, reading a skipped file fetches its pieces
+	r, _ := tt.NewReader(0)
+	r.SetReadahead(0)
+	buf := make([]byte, 1<<15)
+	tt.AddPeers([]PeerInfo{{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Port())}})
+	_, err = io.ReadFull(&contextReader{r, ctx}, buf)
+	if err != nil || !bytes.Equal(buf, data[:1<<15]) {
+		t.Fatalf("read of a skipped file: %v", err)
+	}
+	r.Close()
+
+	// once the download is over it fails right away
+	err = tt.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ = tt.NewReader(0)
+	defer r.Close()
+	r.Seek(3<<15, io.SeekStart)
+	_, err = r.ReadContext(ctx, buf)
+	if !errors.Is(err, ErrNotDownloaded) {
+		t.Errorf("read after the download: %v", err)
+	}
+}
+
+func TestStartClose(t *testing.T) {
+	tf, _ := newTestTorrent(t, "file", 1<<15, 4<<15)
+	tt, err := Start(newTestTask(tf, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no peers, the download cannot finish before it is closed
+	tt.Close()
+	done := make(chan error)
+	go func() { done <- tt.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("closed download finished")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait blocked after Close")
+	}
+}
@@ -0,0 +1,271 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"go-torrent/bencode"
+	"os"
+	"time"
+)
+
+// ResumeInterval is how often the resume file is saved while a torrent runs
+const ResumeInterval = 30 * time.Second
+
+// the resume file is a bencoded dict, bitfields are kept as strings
+type resumeState struct {
+	InfoHash   string        `bencode:"info-hash"`
+	Pieces     string        `bencode:"pieces"` // verified pieces
+	Files      []resumeFile  `bencode:"files"`
+	Partial    []resumePiece `bencode:"partial"`
+	Downloaded int           `bencode:"downloaded"`
+	Uploaded   int           `bencode:"uploaded"`
+	Wasted     int           `bencode:"wasted"`
+}
+
+// resumeFile tells whether a file changed since the resume file was saved
+type resumeFile struct {
+	Length int    `bencode:"length"`
+	MTime  string `bencode:"mtime"` // RFC 3339 with nanoseconds
+}
+
+// resumePiece is an active piece. Its received blocks are not verified yet,
+// so they are kept here rather than in the storage
+type resumePiece struct {
+	Index  int    `bencode:"index"`
+	Blocks string `bencode:"blocks"`
+	Data   string `bencode:"data"` // the received blocks one after another
+}
+
+func loadResume(path string) (*resumeState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	state := new(resumeState)
+	err = bencode.Unmarshal(f, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// saveResumeFile writes the resume state of a torrent
+func saveResumeFile(path string, state *resumeState) error {
+	return bencode.WriteFile(path, state)
+}
+
+// resumePath returns where the resume file of the task is kept, none for a
+// storage of its own unless ResumeFile is set
+func (task *TorrentTask) resumePath() string {
+	if task.ResumeFile != "" || task.Storage != nil {
+		return task.ResumeFile
+	}
+	return task.FileName + ".resume"
+}
+
+// storageFiles returns the sizes and mtimes of the files of a storage, nil
+// for storages without files. Files not created yet have no mtime
+func storageFiles(s Storage) ([]resumeFile, error) {
+	fs, ok := fileStorage(s)
+	if !ok {
+		return nil, nil
+	}
+	files := make([]resumeFile, 0, len(fs.files))
+	for i := range fs.files {
+		f, err := fs.file(i, false)
+		if errors.Is(err, os.ErrNotExist) {
+			files = append(files, resumeFile{})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, resumeFile{int(stat.Size()), stat.ModTime().UTC().Format(time.RFC3339Nano)})
+	}
+	return files, nil
+}
+
+// filesKept reports whether the files saved in the resume file still have
+// their size, files created since may have any
+func filesKept(saved, now []resumeFile) bool {
+	if len(saved) != len(now) {
+		return false
+	}
+	for i := range saved {
+		if saved[i].MTime != "" && (now[i].MTime == "" || now[i].Length != saved[i].Length) {
+			return false
+		}
+	}
+	return true
+}
+
+func filesMatch(a, b []resumeFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// restore applies the resume file before any peer is contacted. Its pieces
+// are trusted while the files kept their size, the other pieces are checked
+// once the files changed since it was saved, e.g. pieces verified after the
+// last save before a crash. Once a file is gone or resized every piece is
+// checked
+func (t *Torrent) restore() {
+	state, err := loadResume(t.resume)
+	if os.IsNotExist(err) {
+		// data copied from elsewhere is seeded or repaired, not downloaded again
+		if fs, ok := fileStorage(t.storage); ok && fs.existed {
+			t.recheck(nil)
+		}
+		return
+	}
+	if err == nil && state.InfoHash != string(t.InfoSHA[:]) {
+		err = fmt.Errorf("info hash mismatch")
+	}
+	if err != nil {
+		fmt.Println("fail to load resume file, checking every piece: " + err.Error())
+		t.recheck(nil)
+		return
+	}
+	t.downloaded.Store(int64(state.Downloaded))
+	t.uploaded.Store(int64(state.Uploaded))
+	t.picker.addWasted(int64(state.Wasted))
+
+	files, err := storageFiles(t.storage)
+	field := Bitfield(state.Pieces)
+	if err != nil || !filesKept(state.Files, files) || len(field) != len(t.field) {
+		fmt.Println("files removed or resized since the resume file was saved, checking every piece")
+		t.recheck(nil)
+		return
+	}
+	var others []int
+	for i := range t.PieceSHA {
+		if field.HasPiece(i) {
+			t.markPiece(i)
+		} else {
+			others = append(others, i)
+		}
+	}
+	if !filesMatch(files, state.Files) && len(others) > 0 {
+		fmt.Println("files written since the resume file was saved, checking the other pieces")
+		t.recheck(others)
+	}
+	for _, p := range state.Partial {
+		t.restorePartial(p)
+	}
+}
+
+// recheck verifies the given pieces in the storage, every piece if indexes
+// is nil, it returns how many are there
+func (t *Torrent) recheck(indexes []int) int {
+	count := 0
+	l := newLayout(t.Files, t.PieceLen, t.FileLen)
+	checks := checkPieces(t.storage, t.PieceSHA, l, indexes, nil)
+	for _, res := range checks {
+		if res.valid {
+			t.markPiece(res.index)
+			count++
+		}
+	}
+	fmt.Printf("recheck finished, %d of %d pieces present\n", count, len(checks))
+	return count
+}
+
+// restorePartial hands the received blocks of an active piece back to the
+// picker, so only the others are requested
+func (t *Torrent) restorePartial(p resumePiece) {
+	if p.Index < 0 || p.Index >= len(t.PieceSHA) || t.hasPiece(p.Index) {
+		return
+	}
+	blocks := Bitfield(p.Blocks)
+	data := make([]byte, t.picker.length(p.Index))
+	received := make([]bool, (len(data)+BLOCKSIZE-1)/BLOCKSIZE)
+	rest := p.Data
+	for i := range received {
+		if !blocks.HasPiece(i) {
+			continue
+		}
+		block := t.picker.block(p.Index, i)
+		if len(rest) < block.length {
+			return
+		}
+		copy(data[block.begin:], rest[:block.length])
+		rest = rest[block.length:]
+		received[i] = true
+	}
+	if len(rest) != 0 {
+		return
+	}
+	t.picker.restore(p.Index, received, data)
+}
+
+// saveResume writes the resume file, the received blocks of active pieces
+// go along since they may not be written to the storage before verified
+func (t *Torrent) saveResume() error {
+	if t.resume == "" {
+		return nil
+	}
+	t.mu.Lock()
+	storage := t.storage
+	field := make(Bitfield, len(t.field))
+	copy(field, t.field)
+	t.mu.Unlock()
+	if storage == nil {
+		return nil
+	}
+	wasted, _ := t.picker.stats()
+	state := &resumeState{
+		InfoHash:   string(t.InfoSHA[:]),
+		Pieces:     string(field),
+		Downloaded: int(t.downloaded.Load()),
+		Uploaded:   int(t.uploaded.Load()),
+		Wasted:     int(wasted),
+	}
+	for _, p := range t.picker.partials() {
+		blocks := NewBitfield(len(p.received))
+		var data []byte
+		for i, ok := range p.received {
+			if !ok {
+				continue
+			}
+			block := t.picker.block(p.index, i)
+			data = append(data, p.data[block.begin:block.begin+block.length]...)
+			blocks.SetPiece(i)
+		}
+		state.Partial = append(state.Partial, resumePiece{p.index, string(blocks), string(data)})
+	}
+	files, err := storageFiles(storage)
+	if err != nil {
+		return err
+	}
+	state.Files = files
+	return saveResumeFile(t.resume, state)
+}
+
+// resumeRoutine saves the resume file every ResumeInterval until the torrent is closed
+func (t *Torrent) resumeRoutine() {
+	ticker := time.NewTicker(ResumeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			err := t.saveResume()
+			if err != nil {
+				fmt.Println("fail to save resume file: " + err.Error())
+			}
+		}
+	}
+}
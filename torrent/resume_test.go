@@ -0,0 +1,288 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newResumeTorrent opens tf below dir with its default storage and resume file
+func newResumeTorrent(t *testing.T, tf *TorrentFile, dir string) *Torrent {
+	t.Helper()
+	task := newTestTask(tf, dir)
+	storage, err := task.openStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := newTorrent(task)
+	tt.setStorage(storage)
+	tt.resume = task.resumePath()
+	return tt
+}
+
+// pieces returns the verified pieces of tt
+func pieces(tt *Torrent) []bool {
+	res := make([]bool, len(tt.PieceSHA))
+	for i := range res {
+		res[i] = tt.hasPiece(i)
+	}
+	return res
+}
+
+func TestResumeRestart(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<14, 3<<14, 2<<14)
+	dir := t.TempDir()
+	tt := newResumeTorrent(t, tf, dir)
+	writeAll(t, tt.storage, data, tf.PieceLen)
+	tt.markPiece(0)
+	tt.markPiece(3)
+	tt.uploaded.Store(100)
+	tt.close()
+
+	// only the pieces of the resume file count, nothing is read
+	tt = newResumeTorrent(t, tf, dir)
+	defer tt.close()
+	tt.restore()
+	want := []bool{true, false, false, true, false}
+	for i, ok := range pieces(tt) {
+		if ok != want[i] {
+			t.Errorf("piece %d verified %v after restart", i, ok)
+		}
+	}
+	if tt.uploaded.Load() != 100 {
+		t.Errorf("uploaded %d, want 100", tt.uploaded.Load())
+	}
+}
+
+func TestResumeChangedFile(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<14, 3<<14, 2<<14)
+	dir := t.TempDir()
+	tt := newResumeTorrent(t, tf, dir)
+	writeAll(t, tt.storage, data, tf.PieceLen)
+	tt.markPiece(0)
+	tt.close()
+
+	// the second file was edited since, the pieces not in the resume file
+	// are checked
+	b := filepath.Join(dir, "dir", "b")
+	f, err := os.OpenFile(b, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("x"), 1<<14)
+	f.Close()
+	os.Chtimes(b, time.Now(), time.Now().Add(time.Hour))
+
+	tt = newResumeTorrent(t, tf, dir)
+	defer tt.close()
+	tt.restore()
+	want := []bool{true, true, true, true, false}
+	for i, ok := range pieces(tt) {
+		if ok != want[i] {
+			t.Errorf("piece %d verified %v after recheck", i, ok)
+		}
+	}
+}
+
+func TestResumeCrash(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<14, 3<<14, 2<<14)
+	dir := t.TempDir()
+	tt := newResumeTorrent(t, tf, dir)
+	writeAll(t, tt.storage, data[:1<<14], tf.PieceLen)
+	tt.markPiece(0)
+	if err := tt.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(tt.resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more pieces are written, then we crash before the next save
+	writeAll(t, tt.storage, data, tf.PieceLen)
+	for i := 1; i < len(tf.PieceSHA); i++ {
+		tt.markPiece(i)
+	}
+	tt.close()
+	os.WriteFile(tt.resume, saved, 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "dir", "a"), later, later)
+
+	tt = newResumeTorrent(t, tf, dir)
+	defer tt.close()
+	tt.restore()
+	for i, ok := range pieces(tt) {
+		if !ok {
+			t.Errorf("piece %d written before the crash not verified", i)
+		}
+	}
+}
+
+func TestResumeRemovedFile(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<14, 3<<14, 2<<14)
+	dir := t.TempDir()
+	tt := newResumeTorrent(t, tf, dir)
+	writeAll(t, tt.storage, data, tf.PieceLen)
+	for i := range tf.PieceSHA {
+		tt.markPiece(i)
+	}
+	tt.close()
+
+	// the pieces of a removed file are not trusted anymore
+	os.Remove(filepath.Join(dir, "dir", "b"))
+	tt = newResumeTorrent(t, tf, dir)
+	defer tt.close()
+	tt.restore()
+	want := []bool{true, true, true, false, false}
+	for i, ok := range pieces(tt) {
+		if ok != want[i] {
+			t.Errorf("piece %d verified %v after removing a file", i, ok)
+		}
+	}
+}
+
+func TestResumeSave(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 2*BLOCKSIZE, 4*BLOCKSIZE)
+	dir := t.TempDir()
+	tt := newResumeTorrent(t, tf, dir)
+	defer tt.close()
+	writeAll(t, tt.storage, data[:tf.PieceLen], tf.PieceLen)
+	tt.markPiece(0)
+	tt.downloaded.Store(3 * BLOCKSIZE)
+	c := &PeerConn{}
+	req, _ := tt.picker.nextBlock(c, func(index int) bool { return index == 1 })
+	begin := tf.PieceLen + req.begin
+	tt.picker.received(c, req.index, req.begin, data[begin:begin+req.length])
+	if err := tt.saveResume(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadResume(tt.resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.InfoHash != string(tf.InfoSHA[:]) || state.Downloaded != 3*BLOCKSIZE {
+		t.Errorf("saved info hash %x, downloaded %d", state.InfoHash, state.Downloaded)
+	}
+	if field := Bitfield(state.Pieces); !field.HasPiece(0) || field.HasPiece(1) {
+		t.Errorf("saved pieces %x", state.Pieces)
+	}
+	if len(state.Partial) != 1 || state.Partial[0].Index != 1 || state.Partial[0].Data != string(data[begin:begin+req.length]) {
+		t.Fatalf("saved partial pieces %v", state.Partial)
+	}
+	if len(state.Files) != 1 || state.Files[0].Length != len(data) || state.Files[0].MTime == "" {
+		t.Errorf("saved files %v", state.Files)
+	}
+}
+
+func TestResumeInfoHashMismatch(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 2<<14)
+	other, _ := newTestTorrent(t, "other", 1<<14, 2<<14)
+	dir := t.TempDir()
+	tt := newResumeTorrent(t, tf, dir)
+	writeAll(t, tt.storage, data, tf.PieceLen)
+	tt.close()
+	// the resume file of another torrent at the same place is not trusted
+	os.Rename(filepath.Join(dir, "file.resume"), filepath.Join(dir, "other.resume"))
+	tt = newResumeTorrent(t, other, dir)
+	defer tt.close()
+	tt.restore()
+	for i, ok := range pieces(tt) {
+		if ok {
+			t.Errorf("piece %d of another torrent verified", i)
+		}
+	}
+}
+
+func TestResumePartial(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 4*BLOCKSIZE, 8*BLOCKSIZE)
+	dir := t.TempDir()
+	tt := newResumeTorrent(t, tf, dir)
+	c := &PeerConn{}
+	var reqs []blockRequest
+	for i := 0; i < 4; i++ {
+		req, _ := tt.picker.nextBlock(c, func(index int) bool { return index == 1 })
+		reqs = append(reqs, req)
+	}
+	// two blocks of piece 1 arrived before the stop
+	for _, req := range reqs[1:3] {
+		begin := tf.PieceLen + req.begin
+		tt.picker.received(c, req.index, req.begin, data[begin:begin+req.length])
+	}
+	tt.close()
+	// the blocks are not verified yet, they are kept out of the file
+	if got, _ := os.ReadFile(filepath.Join(dir, "file")); len(got) > 0 && !bytes.Equal(got, make([]byte, len(got))) {
+		t.Error("unverified blocks written to the file")
+	}
+
+	tt = newResumeTorrent(t, tf, dir)
+	defer tt.close()
+	tt.restore()
+	var got []blockRequest
+	for {
+		req, ok := tt.picker.nextBlock(c, func(index int) bool { return index == 1 })
+		if !ok {
+			break
+		}
+		got = append(got, req)
+	}
+	if len(got) != 2 || got[0] != reqs[0] || got[1] != reqs[3] {
+		t.Fatalf("requested %v after restart, want the missing blocks", got)
+	}
+	for _, req := range got {
+		begin := tf.PieceLen + req.begin
+		piece, _, err := tt.picker.received(c, req.index, req.begin, data[begin:begin+req.length])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if piece != nil && !bytes.Equal(piece, data[tf.PieceLen:2*tf.PieceLen]) {
+			t.Error("restored piece differs")
+		}
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 100000)
+	ln := newSeed(t, tf, data, nil)
+	dir := t.TempDir()
+	task := newTestTask(tf, dir)
+	task.PeerList = []PeerInfo{listenerPeer(ln)}
+	err := Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second run has nothing left to download, no peer is needed
+	task = newTestTask(tf, dir)
+	done := make(chan error, 1)
+	go func() {
+		done <- Download(task)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("finished download not resumed")
+	}
+	got, err := os.ReadFile(task.FileName)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("file differs after resuming, %v", err)
+	}
+}
+
+func TestResumeCopiedData(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 3<<14)
+	dir := t.TempDir()
+	writeFiles(t, tf, data, dir)
+	// no resume file yet, the data copied in place is checked
+	tt := newResumeTorrent(t, tf, dir)
+	defer tt.close()
+	tt.restore()
+	for i, ok := range pieces(tt) {
+		if !ok {
+			t.Errorf("copied piece %d not verified", i)
+		}
+	}
+}
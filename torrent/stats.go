@@ -0,0 +1,41 @@
+package torrent
+
+// Stats is a snapshot of the transfer of a torrent
+type Stats struct {
+	Downloaded int64 // piece bytes received, duplicates included
+	Uploaded   int64 // piece bytes sent
+	Wasted     int64 // bytes of blocks received more than once, e.g. in the endgame
+	Endgame    bool  // every missing block is requested, some from several peers
+	Peers      []PeerStats
+}
+
+// PeerStats is a snapshot of one connected peer
+type PeerStats struct {
+	Addr       string
+	Downloaded int64 // piece bytes received from the peer
+	Uploaded   int64 // piece bytes sent to the peer
+	QueueDepth int   // requests kept pending with the peer, sized from its rate and round trip
+}
+
+func (t *Torrent) Stats() Stats {
+	stats := Stats{Downloaded: t.downloaded.Load(), Uploaded: t.uploaded.Load()}
+	stats.Wasted, stats.Endgame = t.picker.stats()
+	for _, c := range t.connList() {
+		stats.Peers = append(stats.Peers, PeerStats{
+			Addr:       c.Peer.String(),
+			Downloaded: c.downloaded.Load(),
+			Uploaded:   c.uploaded.Load(),
+			QueueDepth: int(c.queueDepth.Load()),
+		})
+	}
+	return stats
+}
+
+// announceStats is what we tell trackers about our transfer
+func (t *Torrent) announceStats() AnnounceStats {
+	return AnnounceStats{
+		Uploaded:   t.uploaded.Load(),
+		Downloaded: t.downloaded.Load(),
+		Left:       t.picker.leftBytes(),
+	}
+}
@@ -0,0 +1,296 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Storage keeps the data of a torrent, offsets are within a piece. Pieces
+// are written once they are verified and read to serve peers
+type Storage interface {
+	ReadAt(index int, p []byte, begin int) (int, error)
+	WriteAt(index int, p []byte, begin int) (int, error)
+	// MarkComplete records a verified piece whose data has been written
+	MarkComplete(index int) error
+	Close() error
+}
+
+// pieceSpan returns where the block of a piece lies in the torrent
+func pieceSpan(pieceLen, totalLen, index, begin, length int) (int64, error) {
+	if index < 0 || begin < 0 || length < 0 {
+		return 0, fmt.Errorf("invalid block, index: %d, begin: %d, length: %d", index, begin, length)
+	}
+	start := index*pieceLen + begin
+	end := (index + 1) * pieceLen
+	if end > totalLen {
+		end = totalLen
+	}
+	if begin+length > pieceLen || start+length > end {
+		return 0, fmt.Errorf("block out of piece bound, index: %d, begin: %d, length: %d", index, begin, length)
+	}
+	return int64(start), nil
+}
+
+// MemoryStorage keeps the torrent in a byte slice, e.g. for tests
+type MemoryStorage struct {
+	mu       sync.RWMutex
+	data     []byte
+	pieceLen int
+}
+
+// NewMemoryStorage stores the torrent in data, which holds all of it
+func NewMemoryStorage(data []byte, pieceLen int) *MemoryStorage {
+	return &MemoryStorage{data: data, pieceLen: pieceLen}
+}
+
+func (s *MemoryStorage) ReadAt(index int, p []byte, begin int) (int, error) {
+	off, err := pieceSpan(s.pieceLen, len(s.data), index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copy(p, s.data[off:]), nil
+}
+
+func (s *MemoryStorage) WriteAt(index int, p []byte, begin int) (int, error) {
+	off, err := pieceSpan(s.pieceLen, len(s.data), index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copy(s.data[off:], p), nil
+}
+
+func (s *MemoryStorage) MarkComplete(index int) error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// FileInfo is a file of a multi-file torrent, Path is relative to the
+// directory named after the torrent
+type FileInfo struct {
+	Path   []string
+	Length int
+}
+
+type storageFile struct {
+	*os.File // nil for a file that does not exist yet
+	name     string
+	offset   int64 // in the torrent
+	length   int64
+}
+
+// FileStorage keeps the torrent in its files on disk, a block may span
+// several of them. Files are created once data is written to them, so the
+// files of skipped pieces never are
+type FileStorage struct {
+	mu       sync.Mutex // guards opening files
+	files    []storageFile
+	pieceLen int
+	totalLen int
+	existed  bool                                  // some file had data before it was opened
+	create   func(string, int64) (*os.File, error) // nil for a read-only storage
+}
+
+// NewFileStorage opens the files of a torrent, missing ones are created when
+// written. A single-file torrent is stored at path, the files of a
+// multi-file torrent below it
+func NewFileStorage(path string, pieceLen int, files []FileInfo) (*FileStorage, error) {
+	return newFileStorage(path, pieceLen, files, openFile)
+}
+
+// OpenFileStorage opens the files of a torrent read-only, e.g. to verify
+// them. Nothing is created, reads from missing files fail
+func OpenFileStorage(path string, pieceLen int, files []FileInfo) (*FileStorage, error) {
+	return newFileStorage(path, pieceLen, files, nil)
+}
+
+func newFileStorage(path string, pieceLen int, files []FileInfo, create func(string, int64) (*os.File, error)) (*FileStorage, error) {
+	s := &FileStorage{pieceLen: pieceLen, create: create}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("torrent without files")
+	}
+	for _, info := range files {
+		name, err := filePath(path, info.Path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		var f *os.File
+		stat, err := os.Stat(name)
+		if err == nil && stat.Size() > 0 {
+			s.existed = true
+		}
+		// empty files get no data, they are created right away
+		if err == nil || (info.Length == 0 && create != nil) {
+			f, err = s.open(name, int64(info.Length))
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		s.files = append(s.files, storageFile{f, name, int64(s.totalLen), int64(info.Length)})
+		s.totalLen += info.Length
+	}
+	return s, nil
+}
+
+// open opens an existing file, or creates it unless the storage is read-only
+func (s *FileStorage) open(name string, length int64) (*os.File, error) {
+	if s.create == nil {
+		return os.Open(name)
+	}
+	return s.create(name, length)
+}
+
+// filePath joins the path of a file to the torrent directory, a path that
+// would leave it is refused
+func filePath(root string, path []string) (string, error) {
+	for _, elem := range path {
+		if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, `/\`) {
+			return "", fmt.Errorf("invalid file path: %q", path)
+		}
+	}
+	return filepath.Join(append([]string{root}, path...)...), nil
+}
+
+// openFile keeps the data of an existing file, so a download can go on. A
+// shorter file is extended, a longer one is refused rather than truncated,
+// it is not one of ours since we create files at their full length
+func openFile(name string, length int64) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err == nil && stat.Size() > length {
+		err = fmt.Errorf("%s: has %d bytes, the torrent expects %d", name, stat.Size(), length)
+	} else if err == nil && stat.Size() < length {
+		err = f.Truncate(length)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// file returns the i-th file, a missing one is created if create is set
+func (s *FileStorage) file(i int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := &s.files[i]
+	if f.File == nil && create && s.create != nil {
+		file, err := s.create(f.name, f.length)
+		if err != nil {
+			return nil, err
+		}
+		f.File = file
+	}
+	if f.File == nil {
+		return nil, fmt.Errorf("%s: %w", f.name, os.ErrNotExist)
+	}
+	return f.File, nil
+}
+
+// span calls fn for each file the bytes of the torrent from off on overlap
+func (s *FileStorage) span(p []byte, off int64, write bool, fn func(f *os.File, p []byte, off int64) (int, error)) (int, error) {
+	n := 0
+	for i, f := range s.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= f.offset+f.length || f.length == 0 {
+			continue
+		}
+		chunk := p
+		if rest := f.offset + f.length - off; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		file, err := s.file(i, write)
+		if err != nil {
+			return n, err
+		}
+		m, err := fn(file, chunk, off-f.offset)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+		off += int64(m)
+	}
+	return n, nil
+}
+
+func (s *FileStorage) ReadAt(index int, p []byte, begin int) (int, error) {
+	off, err := pieceSpan(s.pieceLen, s.totalLen, index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.span(p, off, false, func(f *os.File, p []byte, off int64) (int, error) {
+		return f.ReadAt(p, off)
+	})
+}
+
+func (s *FileStorage) WriteAt(index int, p []byte, begin int) (int, error) {
+	off, err := pieceSpan(s.pieceLen, s.totalLen, index, begin, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return s.span(p, off, true, func(f *os.File, p []byte, off int64) (int, error) {
+		return f.WriteAt(p, off)
+	})
+}
+
+// MarkComplete has nothing to record, the files only hold the data
+func (s *FileStorage) MarkComplete(index int) error {
+	return nil
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, f := range s.files {
+		if f.File == nil {
+			continue
+		}
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// fileStorage returns the FileStorage s is, or wraps for a Client
+func fileStorage(s Storage) (*FileStorage, bool) {
+	if d, ok := s.(*diskStorage); ok {
+		s = d.Storage
+	}
+	fs, ok := s.(*FileStorage)
+	return fs, ok
+}
+
+// openStorage returns the storage of the task, files named after it by default
+func (task *TorrentTask) openStorage() (Storage, error) {
+	if task.Storage != nil {
+		return task.Storage, nil
+	}
+	files := task.Files
+	if len(files) == 0 {
+		files = []FileInfo{{Length: task.FileLen}}
+	}
+	return NewFileStorage(task.FileName, task.PieceLen, files)
+}
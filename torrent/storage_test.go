@@ -0,0 +1,179 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAll writes data to the storage piece by piece
+func writeAll(t *testing.T, s Storage, data []byte, pieceLen int) {
+	t.Helper()
+	for i := 0; i*pieceLen < len(data); i++ {
+		piece := data[i*pieceLen : min((i+1)*pieceLen, len(data))]
+		n, err := s.WriteAt(i, piece, 0)
+		if err != nil || n != len(piece) {
+			t.Fatalf("piece %d: wrote %d bytes, %v", i, n, err)
+		}
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "t")
+	files := []FileInfo{{[]string{"a"}, 10}, {[]string{"sub", "b"}, 0}, {[]string{"sub", "c"}, 25}}
+	s, err := NewFileStorage(dir, 16, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 35)
+	rand.Read(data)
+	writeAll(t, s, data, 16)
+	// a block spanning two files
+	buf := make([]byte, 8)
+	_, err = s.ReadAt(0, buf, 6)
+	if err != nil || !bytes.Equal(buf, data[6:14]) {
+		t.Errorf("read %x, %v", buf, err)
+	}
+	_, err = s.ReadAt(2, make([]byte, 4), 0)
+	if err == nil {
+		t.Error("read past the end of the torrent")
+	}
+	s.Close()
+
+	a, _ := os.ReadFile(filepath.Join(dir, "a"))
+	c, _ := os.ReadFile(filepath.Join(dir, "sub", "c"))
+	if !bytes.Equal(append(a, c...), data) {
+		t.Error("files hold other data")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "b")); err != nil {
+		t.Error(err)
+	}
+
+	// the data is still there once reopened
+	s, err = NewFileStorage(dir, 16, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf = make([]byte, 3)
+	_, err = s.ReadAt(2, buf, 0)
+	if err != nil || !bytes.Equal(buf, data[32:]) {
+		t.Errorf("read %x after reopening, %v", buf, err)
+	}
+}
+
+func TestFileStorageSingleFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+	s, err := NewFileStorage(name, 16, []FileInfo{{nil, 40}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 40)
+	rand.Read(data)
+	writeAll(t, s, data, 16)
+	s.Close()
+	got, err := os.ReadFile(name)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("file holds other data, %v", err)
+	}
+}
+
+func TestFileStoragePathTraversal(t *testing.T) {
+	for _, path := range [][]string{{"..", "x"}, {"a/b"}, {""}, {"."}} {
+		_, err := NewFileStorage(t.TempDir(), 16, []FileInfo{{path, 1}})
+		if err == nil {
+			t.Errorf("path %q accepted", path)
+		}
+	}
+}
+
+func TestFileStorageCreatesOnWrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir, 1<<10, []FileInfo{{[]string{"a"}, 1000}, {[]string{"b"}, 1000}, {[]string{"c"}, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(filepath.Join(dir, "c")); err != nil {
+		t.Error("empty file not created")
+	}
+	if _, err := s.WriteAt(0, make([]byte, 100), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); err != nil {
+		t.Error("file not created on write")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Error("file created without data")
+	}
+	if _, err := s.ReadAt(1, make([]byte, 100), 0); err == nil {
+		t.Error("read from a file never written")
+	}
+}
+
+func TestFileStorageExistingSize(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, []byte("abc"), 0644)
+	s, err := NewFileStorage(short, 16, []FileInfo{{Length: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	data, _ := os.ReadFile(short)
+	if string(data) != "abc\x00\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("extended file holds %q", data)
+	}
+
+	// a longer file is not ours, it is left alone
+	long := filepath.Join(dir, "long")
+	os.WriteFile(long, []byte("0123456789abcdef"), 0644)
+	_, err = NewFileStorage(long, 16, []FileInfo{{Length: 10}})
+	if err == nil {
+		t.Fatal("longer file accepted")
+	}
+	data, _ = os.ReadFile(long)
+	if string(data) != "0123456789abcdef" {
+		t.Errorf("longer file changed to %q", data)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	data := make([]byte, 40)
+	s := NewMemoryStorage(data, 16)
+	block := []byte("block")
+	_, err := s.WriteAt(2, block, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[35:], block) {
+		t.Errorf("data %x", data)
+	}
+	_, err = s.WriteAt(2, make([]byte, 9), 0)
+	if err == nil {
+		t.Error("wrote past the end of the torrent")
+	}
+	_, err = s.ReadAt(0, make([]byte, 4), 14)
+	if err == nil {
+		t.Error("read past the end of the piece")
+	}
+}
+
+func TestDownloadMultiFile(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<15, 100000, 200000)
+	ln := newSeed(t, tf, data, nil)
+	task := newTestTask(tf, t.TempDir())
+	task.PeerList = []PeerInfo{{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Port())}}
+	err := Download(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := os.ReadFile(filepath.Join(task.FileName, "a"))
+	b, _ := os.ReadFile(filepath.Join(task.FileName, "b"))
+	if !bytes.Equal(append(a, b...), data) {
+		t.Error("downloaded data differs")
+	}
+}
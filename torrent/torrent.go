@@ -0,0 +1,384 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Torrent is the runtime state of one torrent, shared by all of its peer
+// connections whether we dialed them or they dialed us
+type Torrent struct {
+	*TorrentTask
+	mu      sync.Mutex
+	field   Bitfield // verified pieces, the only ones we serve
+	storage Storage  // where verified pieces are written and read from, closed with the torrent
+	conns   map[*PeerConn]struct{}
+	picker  *piecePicker
+	choker  *choker
+	exts    *Extensions
+	closed  bool
+	done    chan struct{} // closed with the torrent
+
+	verified chan struct{}        // closed and replaced whenever a piece is verified
+	readers  map[*Reader]struct{} // open readers, their pieces are fetched first
+	prioMu   sync.Mutex           // orders the priorities handed to the picker
+
+	downloaded atomic.Int64 // piece bytes received from all peers, duplicates included
+	uploaded   atomic.Int64 // piece bytes sent to all peers
+	resume     string       // where the resume file is saved, none if empty
+
+	// set while downloading, new peers get a peerRoutine
+	downloading bool
+	known       map[string]struct{} // peers dialed or accepted so far, by address
+	resultQueue chan *pieceResult
+	stopped     chan struct{} // closed once Download reads no more results
+	finished    chan struct{} // closed once the pieces we want are done or the download failed
+	err         error         // why the download failed, set before finished is closed
+}
+
+func newTorrent(task *TorrentTask) *Torrent {
+	t := &Torrent{
+		TorrentTask: task,
+		field:       NewBitfield(len(task.PieceSHA)),
+		conns:       make(map[*PeerConn]struct{}),
+		picker:      newPiecePicker(len(task.PieceSHA), task.PieceLen, task.FileLen),
+		exts:        task.Extensions.clone(),
+		done:        make(chan struct{}),
+		known:       make(map[string]struct{}),
+		stopped:     make(chan struct{}),
+		finished:    make(chan struct{}),
+		verified:    make(chan struct{}),
+		readers:     make(map[*Reader]struct{}),
+	}
+	if len(task.InfoBytes) > 0 {
+		t.exts.Register(UtMetadata, t.serveMetadata)
+	}
+	// peers of private torrents only come from the tracker
+	if !task.Private {
+		t.exts.Register(UtPex, t.handlePex)
+		go t.pexRoutine()
+	}
+	if task.Priorities != nil {
+		task.Priorities.watch(t.applyPriorities)
+		t.applyPriorities()
+	}
+	t.choker = newChoker(t, task.UploadSlots)
+	go t.choker.run()
+	return t
+}
+
+// bitfield returns a copy of the verified pieces, safe to send to a peer
+func (t *Torrent) bitfield() Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	field := make(Bitfield, len(t.field))
+	copy(field, t.field)
+	return field
+}
+
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.field.HasPiece(index)
+}
+
+// complete reports whether every piece is verified, i.e. we are seeding
+func (t *Torrent) complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.PieceSHA {
+		if !t.field.HasPiece(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// connList returns the peers our bitfield has been sent to, no other
+// message may reach a peer before it
+func (t *Torrent) connList() []*PeerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]*PeerConn, 0, len(t.conns))
+	for c := range t.conns {
+		if c.announced {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// setStorage switches the storage of piece data, the old one is closed
+func (t *Torrent) setStorage(storage Storage) {
+	t.mu.Lock()
+	old := t.storage
+	t.storage = storage
+	t.mu.Unlock()
+	if old != nil && old != storage {
+		old.Close()
+	}
+}
+
+// markPiece records a verified piece and announces it to every connected peer
+func (t *Torrent) markPiece(index int) {
+	t.mu.Lock()
+	t.field.SetPiece(index)
+	close(t.verified)
+	t.verified = make(chan struct{})
+	t.mu.Unlock()
+	t.picker.finish(index)
+
+	msg := NewHaveMsg(index)
+	for _, c := range t.connList() {
+		c.WriteMsg(msg)
+	}
+}
+
+// addConn starts serving uploads on c, it returns false once the torrent is closed
+func (t *Torrent) addConn(c *PeerConn) bool {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return false
+	}
+	t.conns[c] = struct{}{}
+	t.known[c.Peer.Addr()] = struct{}{}
+	c.t = t
+	c.sizeField(len(t.PieceSHA))
+	t.picker.addField(c.Field, 1)
+	c.counted = true
+	if c.SupportsFast() {
+		c.allowedOut = make(map[int]bool)
+		for _, index := range allowedFastSet(c.Peer.Ip, t.InfoSHA, len(t.PieceSHA), AllowedFastK) {
+			c.allowedOut[index] = true
+		}
+	}
+	c.up = newUploader(t, c)
+	t.mu.Unlock()
+
+	field := t.bitfield()
+	err := t.sendBitfield(c, field)
+	if err != nil {
+		fmt.Println("fail to send bitfield: " + err.Error())
+	}
+	// pieces verified meanwhile are announced here, later ones by markPiece
+	t.mu.Lock()
+	c.announced = true
+	var missed []int
+	for i := range t.PieceSHA {
+		if t.field.HasPiece(i) && !field.HasPiece(i) {
+			missed = append(missed, i)
+		}
+	}
+	t.mu.Unlock()
+	for _, index := range missed {
+		c.WriteMsg(NewHaveMsg(index))
+	}
+	go c.up.run()
+
+	if c.SupportsExtensions() {
+		err := c.WriteExtHandshake(t.extHandshake(c))
+		if err != nil {
+			fmt.Println("fail to send extended handshake: " + err.Error())
+		}
+	}
+	t.sendAllowedFast(c)
+	if t.DHT != nil && c.Reserved.Has(DHTBit) {
+		c.WriteMsg(NewPortMsg(t.dhtPort()))
+	}
+	return true
+}
+
+func (t *Torrent) startDownload() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.downloading = !t.closed
+}
+
+// stopDownload makes AddPeers a no-op, existing peerRoutines end once every
+// piece we want is verified
+func (t *Torrent) stopDownload() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.downloading = false
+	select {
+	case <-t.stopped:
+	default:
+		close(t.stopped)
+	}
+}
+
+// AddPeers dials the peers we are not connected to yet, e.g. peers found in
+// the DHT, they are ignored unless the torrent is downloading
+func (t *Torrent) AddPeers(peers []PeerInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.downloading {
+		return
+	}
+	for _, peer := range peers {
+		addr := peer.Addr()
+		if _, ok := t.known[addr]; ok {
+			continue
+		}
+		t.known[addr] = struct{}{}
+		go t.peerRoutine(peer)
+	}
+}
+
+// rememberPeer keeps AddPeers from dialing a peer we are connected to, e.g.
+// an inbound one at the port of its extended handshake
+func (t *Torrent) rememberPeer(peer PeerInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.known[peer.Addr()] = struct{}{}
+}
+
+// extHandshake builds our extended handshake for the given peer
+func (t *Torrent) extHandshake(c *PeerConn) *ExtHandshake {
+	hs := &ExtHandshake{
+		M:            t.exts.ids(),
+		V:            ClientVersion,
+		Reqq:         MAXQUEUED,
+		MetadataSize: len(t.InfoBytes),
+	}
+	if t.Listener != nil {
+		hs.P = t.Listener.Port()
+	}
+	if ip := c.Peer.Ip.To4(); ip != nil {
+		hs.YourIp = string(ip)
+	} else if ip := c.Peer.Ip.To16(); ip != nil {
+		hs.YourIp = string(ip)
+	}
+	return hs
+}
+
+func (t *Torrent) removeConn(c *PeerConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+	if c.counted {
+		t.picker.addField(c.Field, -1)
+		c.counted = false
+	}
+	if c.up != nil {
+		c.up.stop()
+	}
+}
+
+// readBlock returns a block of a verified piece
+func (t *Torrent) readBlock(index, begin, length int) ([]byte, error) {
+	if index < 0 || index >= len(t.PieceSHA) {
+		return nil, fmt.Errorf("piece index out of range: %d", index)
+	}
+	if length <= 0 || length > MAXREQUEST {
+		return nil, fmt.Errorf("invalid block length: %d", length)
+	}
+	pieceBegin, pieceEnd := t.getPieceBound(index)
+	if begin < 0 || pieceBegin+begin+length > pieceEnd {
+		return nil, fmt.Errorf("block out of piece bound, index: %d, begin: %d, length: %d", index, begin, length)
+	}
+
+	t.mu.Lock()
+	has := t.field.HasPiece(index)
+	storage := t.storage
+	t.mu.Unlock()
+	if !has || storage == nil {
+		return nil, fmt.Errorf("piece not available: %d", index)
+	}
+	buf := make([]byte, length)
+	_, err := storage.ReadAt(index, buf, begin)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// servePeer reads messages from a peer that only needs to be served, it
+// returns once the connection fails
+func (t *Torrent) servePeer(c *PeerConn) {
+	defer t.removeConn(c)
+	for {
+		msg, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		err = t.serveMsg(c, msg)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serveMsg handles a message of a peer we do not download from
+func (t *Torrent) serveMsg(c *PeerConn, msg *PeerMsg) error {
+	// heartbeat
+	if msg == nil {
+		return nil
+	}
+	switch msg.Id {
+	case MsgHave:
+		index, err := GetHaveIndex(msg)
+		if err != nil {
+			return err
+		}
+		t.peerHave(c, index)
+	case MsgBitfield:
+		t.setPeerField(c, msg.Payload)
+	case MsgHaveAll, MsgHaveNone, MsgSuggest, MsgAllowedFast:
+		return t.handleFastMsg(c, msg)
+	case MsgReject:
+		// we never request from peers that only need to be served
+	case MsgExtended:
+		err := t.exts.handle(c, msg.Payload)
+		if err != nil {
+			fmt.Println("extension message failed: " + err.Error())
+			return err
+		}
+	case MsgPort:
+		return t.handlePort(c, msg)
+	default:
+		err := c.up.handle(msg)
+		if err != nil {
+			fmt.Println("serve peer failed: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// wantsPeers reports whether new peers are downloaded from, inbound ones
+// included
+func (t *Torrent) wantsPeers() bool {
+	t.mu.Lock()
+	downloading := t.downloading
+	t.mu.Unlock()
+	return downloading && !t.picker.complete()
+}
+
+// close drops every connection and closes the storage
+func (t *Torrent) close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	t.downloading = false
+	close(t.done)
+	conns := make([]*PeerConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+	t.choker.stop()
+	for _, c := range conns {
+		c.Close()
+	}
+	err := t.saveResume()
+	if err != nil {
+		fmt.Println("fail to save resume file: " + err.Error())
+	}
+	t.setStorage(nil)
+}
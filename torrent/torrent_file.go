@@ -2,24 +2,27 @@ package torrent
 
 import (
 	"bytes"
-	"crypto/shal"
+	"crypto/sha1"
 	"fmt"
 	"go-torrent/bencode"
 	"io"
 )
 
 // torrent file: announce + info(name, length, pieces, piece length)
-// 3 structs with tags: 1.rawFile(2) 2.info(5) 3.torrentFile(6)
-type rawFile struct{
-	Announce	string	 `bencode:"announce"`
-	Info	 	rawInfo	 `bencode:"info"`
-}
-
+// the info dict is kept raw, its SHA-1 is the info hash and peers fetching
+// the metadata get it byte for byte
 type rawInfo struct {
 	Name		string	 `bencode:"name"`	
 	Length		int		`bencode:"length"`
+	Files		[]rawFile `bencode:"files"` // multi-file torrents, instead of length
 	Pieces		string	 `bencode:"pieces"`
 	PieceLength	int `bencode:"piece length"`
+	Private		int `bencode:"private"`
+}
+
+type rawFile struct {
+	Length	int		 `bencode:"length"`
+	Path	[]string `bencode:"path"`
 }
 
 const SHALEN int = 20
@@ -27,39 +30,96 @@ const SHALEN int = 20
 type TorrentFile struct {
 	Announce	string
 	InfoSHA		[SHALEN]byte // <- tracker
-	FileName	string
-	FileLen		int
+	InfoBytes	[]byte // bencoded info dict
+	FileName	string // directory of a multi-file torrent
+	FileLen		int // of all files together
+	Files		[]FileInfo // multi-file torrents only
 	PieceLen	int
 	PieceSHA	[][SHALEN]byte
+	Private		bool // BEP 27, peers only come from the tracker
+	URLList		[]string // BEP 19 web seeds
+}
+
+// FileList returns the files of the torrent, a single-file torrent has one
+// with an empty path
+func (tf *TorrentFile) FileList() []FileInfo {
+	if len(tf.Files) > 0 {
+		return tf.Files
+	}
+	return []FileInfo{{Length: tf.FileLen}}
 }
 
 func ParseFile(r io.Reader) (*TorrentFile, error) {
-	raw := new(rawFile)
-	err := bencode.Unmarshal(r, raw)
+	o, err := bencode.Parse(r)
 	if err != nil {
 		fmt.Println("Fail to parse torrent file")
 		return nil, err
 	}
-	// raw file -> torrent file
-	res := new(TorrentFile)
-	res.Announce = raw.Announce
-	res.FileName = raw.Info.Name
-	res.FileLen = raw.Info.Length
-	res.PieceLen = raw.Info.PieceLength
-
-	// SHA-1
-	// TAG NOT USED?
+	dict, err := o.Dict()
+	if err != nil {
+		fmt.Println("Fail to parse torrent file")
+		return nil, err
+	}
+	info := dict["info"]
+	if info == nil {
+		return nil, fmt.Errorf("torrent file without info dict")
+	}
+	// keys are written sorted, so a well-formed info dict is encoded back
+	// to the same bytes
 	buf := new(bytes.Buffer)
-	wlen := bencode.Marshal(buf, raw.Info)
-	// encodes raw.Info into the Bencode format and writes it into the buffer
+	wlen := info.Bencode(buf)
 	if wlen == 0 {
 		fmt.Println("raw file into error")
 	}
-	res.InfoSHA = shal.Sum(buf.Bytes())
-	// The buf.Bytes() method returns the byte slice of the buffer
-	// computes the SHA-1 hash of these bytes
+	res, err := ParseInfo(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if announce := dict["announce"]; announce != nil {
+		res.Announce, _ = announce.Str()
+	}
+	// url-list is a single URL or a list of them
+	if urls := dict["url-list"]; urls != nil {
+		if url, err := urls.Str(); err == nil && url != "" {
+			res.URLList = []string{url}
+		}
+		list, _ := urls.List()
+		for _, o := range list {
+			if url, err := o.Str(); err == nil && url != "" {
+				res.URLList = append(res.URLList, url)
+			}
+		}
+	}
+	return res, nil
+}
 
-	bys := []byte(raw.Info.Pieces)
+// ParseInfo builds a torrent file from a bencoded info dict, e.g. one
+// fetched from peers for a magnet link, the announce URL is left empty
+func ParseInfo(infoBytes []byte) (*TorrentFile, error) {
+	raw := new(rawInfo)
+	err := bencode.Unmarshal(bytes.NewReader(infoBytes), raw)
+	if err != nil {
+		fmt.Println("Fail to parse info dict")
+		return nil, err
+	}
+	// raw info -> torrent file
+	res := new(TorrentFile)
+	res.FileName = raw.Name
+	res.FileLen = raw.Length
+	for _, f := range raw.Files {
+		res.Files = append(res.Files, FileInfo{f.Path, f.Length})
+		res.FileLen += f.Length
+	}
+	res.PieceLen = raw.PieceLength
+	res.Private = raw.Private == 1
+	res.InfoBytes = infoBytes
+	// SHA-1 of the raw info dict
+	res.InfoSHA = sha1.Sum(infoBytes)
+
+	bys := []byte(raw.Pieces)
+	if len(bys)%SHALEN != 0 {
+		return nil, fmt.Errorf("malformed pieces, length %d", len(bys))
+	}
 	cnt := len(bys) / SHALEN
 	// calculates how many SHA-1 hashes are contained within bys
 	hashes := make([][SHALEN]byte, cnt)
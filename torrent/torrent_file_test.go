@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"go-torrent/bencode"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestTorrent returns the metainfo of random data, a single file of
+// name for one length, a directory of files named by their index otherwise
+func newTestTorrent(t *testing.T, name string, pieceLen int, lengths ...int) (*TorrentFile, []byte) {
+	t.Helper()
+	info := rawInfo{Name: name, PieceLength: pieceLen}
+	total := 0
+	for i, length := range lengths {
+		total += length
+		if len(lengths) > 1 {
+			info.Files = append(info.Files, rawFile{length, []string{string(rune('a' + i))}})
+		}
+	}
+	if len(lengths) == 1 {
+		info.Length = total
+	}
+	data := make([]byte, total)
+	rand.Read(data)
+	var pieces []byte
+	for i := 0; i < len(data); i += pieceLen {
+		sum := sha1.Sum(data[i:min(i+pieceLen, len(data))])
+		pieces = append(pieces, sum[:]...)
+	}
+	info.Pieces = string(pieces)
+	buf := new(bytes.Buffer)
+	bencode.Marshal(buf, info)
+	tf, err := ParseInfo(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf, data
+}
+
+func TestParseInfo(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<14, 1<<15, 100)
+	if tf.FileName != "dir" || tf.FileLen != len(data) || tf.PieceLen != 1<<14 {
+		t.Fatalf("got %s of %d bytes in pieces of %d", tf.FileName, tf.FileLen, tf.PieceLen)
+	}
+	if len(tf.PieceSHA) != 3 {
+		t.Errorf("%d pieces, want 3", len(tf.PieceSHA))
+	}
+	if len(tf.Files) != 2 || tf.Files[0].Length != 1<<15 || tf.Files[1].Path[0] != "b" {
+		t.Errorf("files: %+v", tf.Files)
+	}
+	if tf.InfoSHA != sha1.Sum(tf.InfoBytes) {
+		t.Error("info hash is not the hash of the info dict")
+	}
+}
+
+// newTestTask returns a task downloading tf below dir
+func newTestTask(tf *TorrentFile, dir string) *TorrentTask {
+	return &TorrentTask{
+		PeerId:    [IDLEN]byte{'t'},
+		InfoSHA:   tf.InfoSHA,
+		FileName:  filepath.Join(dir, tf.FileName),
+		FileLen:   tf.FileLen,
+		Files:     tf.Files,
+		PieceLen:  tf.PieceLen,
+		PieceSHA:  tf.PieceSHA,
+		InfoBytes: tf.InfoBytes,
+	}
+}
+
+func TestParseFileInfoBytes(t *testing.T) {
+	info, _ := newTestTorrent(t, "file", 1<<14, 40000)
+	tf, err := ParseFile(strings.NewReader("d8:announce8:http://t4:info" + string(info.InfoBytes) + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the info hash is the one of the raw info dict
+	if tf.InfoSHA != info.InfoSHA || string(tf.InfoBytes) != string(info.InfoBytes) {
+		t.Errorf("info hash %x, want %x", tf.InfoSHA, info.InfoSHA)
+	}
+	if tf.Announce != "http://t" || tf.FileLen != 40000 || len(tf.PieceSHA) != 3 {
+		t.Errorf("announce %q, length %d, pieces %d", tf.Announce, tf.FileLen, len(tf.PieceSHA))
+	}
+}
+
+func TestParseURLList(t *testing.T) {
+	info := "d6:lengthi5e4:name1:x12:piece lengthi16e6:pieces20:aaaaaaaaaaaaaaaaaaaae"
+	tf, err := ParseFile(strings.NewReader("d8:url-list12:http://a/b/c4:info" + info + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tf.URLList) != 1 || tf.URLList[0] != "http://a/b/c" {
+		t.Errorf("url-list %q", tf.URLList)
+	}
+	tf, err = ParseFile(strings.NewReader("d8:url-listl8:http://a8:http://be4:info" + info + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tf.URLList) != 2 || tf.URLList[1] != "http://b" {
+		t.Errorf("url-list %q", tf.URLList)
+	}
+}
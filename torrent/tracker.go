@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"go-torrent/bencode"
@@ -8,14 +9,17 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	PeerPort	int = 3456
 	IpLen		int = 4
+	Ip6Len		int = 16
 	PortLen		int = 2
 	PeerLen		int = IpLen + PortLen 
+	Peer6Len	int = Ip6Len + PortLen
 )
 
 const IDLEN int = 20
@@ -25,12 +29,29 @@ type PeerInfo struct {
 	Port	uint16
 }
 
+// Addr returns the address to dial the peer at, IPv6 hosts in brackets
+func (p PeerInfo) Addr() string {
+	return net.JoinHostPort(p.Ip.String(), strconv.Itoa(int(p.Port)))
+}
+
+func (p PeerInfo) String() string {
+	return p.Addr()
+}
+
+// AnnounceStats is our transfer as the tracker is told about it
+type AnnounceStats struct {
+	Uploaded	int64
+	Downloaded	int64
+	Left		int64	// bytes we still want, 0 once seeding
+}
+
 type TrackerResp struct {
 	Interval	int		`bencode:"interval"`
 	Peers		string	`bencode:"peers"`
+	Peers6		string	`bencode:"peers6"`
 }
 
-func buildUrl(tf *TorrentFile, peerId [IDLEN]byte) (string, error) {
+func buildUrl(tf *TorrentFile, peerId [IDLEN]byte, port int, stats AnnounceStats) (string, error) {
 	base, err := url.Parse(tf.Announce)
 	if err != nil {
 		fmt.Println("Announce error: " + tf.Announce)
@@ -40,46 +61,120 @@ func buildUrl(tf *TorrentFile, peerId [IDLEN]byte) (string, error) {
 	params := url.Values {
 		"info_hash":	[]string{string(tf.InfoSHA[:])},
 		"peer_id":	[]string{string(peerId[:])},
-		"port":		[]string{strconv.Itoa(PeerPort)},
-		// "uploaded"
-		// "downloaded"
-		// "compact"
-		"left":		[]string{strconv.Itoa(tf.FileLen)},
+		"port":		[]string{strconv.Itoa(port)},
+		"uploaded":	[]string{strconv.FormatInt(stats.Uploaded, 10)},
+		"downloaded":	[]string{strconv.FormatInt(stats.Downloaded, 10)},
+		"left":		[]string{strconv.FormatInt(stats.Left, 10)},
+		// BEP 23, we only parse compact peers
+		"compact":	[]string{"1"},
+	}
+	// BEP 7: a dual-stack tracker only sees one of our addresses
+	if ip := localIPv6(); ip != nil {
+		params.Set("ipv6", ip.String())
 	}
 
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func buildPeerInfo(peers []byte) []PeerInfo {
-	num := len(peers) / PeerLen
-	if len(peers)%PeerLen != 0 {
+// localIPv6 returns an IPv6 address of this host, public ones before unique
+// local ones, nil if it has none
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var res net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if !ipnet.IP.IsPrivate() {
+			return ipnet.IP
+		}
+		if res == nil {
+			res = ipnet.IP
+		}
+	}
+	return res
+}
+
+// buildPeerInfo parses compact peers, ipLen is IpLen for peers and Ip6Len for peers6
+func buildPeerInfo(peers []byte, ipLen int) []PeerInfo {
+	peerLen := ipLen + PortLen
+	num := len(peers) / peerLen
+	if len(peers)%peerLen != 0 {
 		fmt.Println("Received malformed peers")
 		return nil
 	}
 	infos := make([]PeerInfo, num)
 	for i := 0; i < num; i++ {
-		offset := i * PeerLen
-		infos[i].Ip = net.IP(peers[offset : offset+IpLen])
-		infos[i].Port = binary.BigEndian.Uint16(peers[offset+IpLen : offset+PeerLen])
+		offset := i * peerLen
+		infos[i].Ip = make(net.IP, ipLen)
+		copy(infos[i].Ip, peers[offset : offset+ipLen])
+		infos[i].Port = binary.BigEndian.Uint16(peers[offset+ipLen : offset+peerLen])
 	}
 	return infos
 }
 
-func FindPeers(tf *TorrentFile, peerId [IDLEN]byte) []PeerInfo {
+// httpClient sends tracker and web seed requests, through the proxy if it
+// carries tracker traffic
+func httpClient(opts *ConnOptions) *http.Client {
+	cli := &http.Client{Timeout: 15 * time.Second}
+	if p := opts.proxy(); p.Trackers() {
+		cli.Transport = &http.Transport{Proxy: http.ProxyURL(p.URL())}
+	}
+	return cli
+}
+
+// FindPeers announces to the tracker of tf over HTTP or UDP, opts may be nil.
+// It announces PeerPort and nothing transferred yet, Announce takes the port
+// we listen on and our transfer
+func FindPeers(tf *TorrentFile, peerId [IDLEN]byte, opts *ConnOptions) []PeerInfo {
+	return Announce(context.Background(), tf, peerId, PeerPort, AnnounceStats{Left: int64(tf.FileLen)}, opts)
+}
+
+// how often we announce to trackers that do not say
+const DefaultAnnounceInterval = 30 * time.Minute
+
+// Announce tells the tracker of tf that we accept peers on port and how much
+// we transferred, it returns its peers and gives up once ctx is done
+func Announce(ctx context.Context, tf *TorrentFile, peerId [IDLEN]byte, port int, stats AnnounceStats, opts *ConnOptions) []PeerInfo {
+	peers, _ := announce(ctx, tf, peerId, port, stats, opts)
+	return peers
+}
+
+// announce is Announce also returning the seconds the tracker wants between
+// announces, 0 when it failed
+func announce(ctx context.Context, tf *TorrentFile, peerId [IDLEN]byte, port int, stats AnnounceStats, opts *ConnOptions) ([]PeerInfo, int) {
+	if strings.HasPrefix(tf.Announce, "udp://") {
+		peers, interval, err := findPeersUDP(ctx, tf, peerId, port, stats, opts)
+		if err != nil {
+			fmt.Println("UDP tracker error: " + err.Error())
+			return nil, 0
+		}
+		return peers, interval
+	}
+
 	// request
-	url, err := buildUrl(tf, peerId)
+	url, err := buildUrl(tf, peerId, port, stats)
 	if err != nil {
 		fmt.Println("Build tracker url error: " + err.Error())
-		return nil
+		return nil, 0
 	}
 
 	// http GET
-	cli := &http.Client{Timeout: 15 * time.Second}
-	resp, err := cli.Get(url)
+	cli := httpClient(opts)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		fmt.Println("Build tracker request error: " + err.Error())
+		return nil, 0
+	}
+	resp, err := cli.Do(req)
 	if err != nil {
 		fmt.Println("Fail to connect to track: " + err.Error())
-		return nil
+		return nil, 0
 	}
 	defer resp.Body.Close()
 
@@ -87,8 +182,9 @@ func FindPeers(tf *TorrentFile, peerId [IDLEN]byte) []PeerInfo {
 	err = bencode.Unmarshal(resp.Body, trackResp)
 	if err != nil {
 		fmt.Println("Tracker response error: " + err.Error())
-		return nil
+		return nil, 0
 	}
 
-	return buildPeerInfo([]byte(trackResp.Peers))
-}
\ No newline at end of file
+	peers := buildPeerInfo([]byte(trackResp.Peers), IpLen)
+	return append(peers, buildPeerInfo([]byte(trackResp.Peers6), Ip6Len)...), trackResp.Interval
+}
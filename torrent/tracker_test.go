@@ -0,0 +1,255 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"go-torrent/bencode"
+	"go-torrent/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpTracker is a UDP tracker stand-in answering every announce with peer,
+// which must be of the address family of host
+func udpTracker(t *testing.T, host string, peer PeerInfo) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		const connId = 0xdeadbeef
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			tid := buf[12:16]
+			res := new(bytes.Buffer)
+			switch action {
+			case actionConnect:
+				binary.Write(res, binary.BigEndian, actionConnect)
+				res.Write(tid)
+				binary.Write(res, binary.BigEndian, uint64(connId))
+			case actionAnnounce:
+				if binary.BigEndian.Uint64(buf[0:8]) != connId {
+					binary.Write(res, binary.BigEndian, actionError)
+					res.Write(tid)
+					res.WriteString("unknown connection id")
+					break
+				}
+				binary.Write(res, binary.BigEndian, actionAnnounce)
+				res.Write(tid)
+				binary.Write(res, binary.BigEndian, [3]uint32{1800, 0, 1})
+				res.Write(compactPeer(peer))
+			}
+			pc.WriteTo(res.Bytes(), from)
+		}
+	}()
+	return "udp://" + pc.LocalAddr().String() + "/announce"
+}
+
+// trackerHandler answers every announce with peer
+func trackerHandler(peer PeerInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := &TrackerResp{Interval: 1800}
+		if peer.Ip.To4() != nil {
+			res.Peers = string(compactPeer(peer))
+		} else {
+			res.Peers6 = string(compactPeer(peer))
+		}
+		bencode.Marshal(w, res)
+	})
+}
+
+func TestFindPeersHTTP(t *testing.T) {
+	peer := PeerInfo{Ip: net.IPv4(10, 1, 2, 3), Port: 6881}
+	tracker := httptest.NewServer(trackerHandler(peer))
+	defer tracker.Close()
+	peers := FindPeers(&TorrentFile{Announce: tracker.URL, FileLen: 1}, [IDLEN]byte{}, nil)
+	if len(peers) != 1 || peers[0].String() != "10.1.2.3:6881" {
+		t.Errorf("peers %v", peers)
+	}
+}
+
+func TestFindPeersUDP(t *testing.T) {
+	peer := PeerInfo{Ip: net.IPv4(10, 1, 2, 3), Port: 6881}
+	tf := &TorrentFile{Announce: udpTracker(t, "127.0.0.1", peer), FileLen: 1}
+	peers := FindPeers(tf, [IDLEN]byte{}, nil)
+	if len(peers) != 1 || peers[0].String() != "10.1.2.3:6881" {
+		t.Errorf("peers %v", peers)
+	}
+}
+
+func TestFindPeersHTTP6(t *testing.T) {
+	peer := PeerInfo{Ip: net.ParseIP("2001:db8::1"), Port: 6881}
+	tracker := httptest.NewServer(trackerHandler(peer))
+	defer tracker.Close()
+	peers := FindPeers(&TorrentFile{Announce: tracker.URL, FileLen: 1}, [IDLEN]byte{}, nil)
+	if len(peers) != 1 || peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("peers %v", peers)
+	}
+}
+
+func TestFindPeersUDP6(t *testing.T) {
+	// a tracker reached over IPv6 answers with 18 byte peers
+	peer := PeerInfo{Ip: net.ParseIP("2001:db8::1"), Port: 6881}
+	tf := &TorrentFile{Announce: udpTracker(t, "::1", peer), FileLen: 1}
+	peers := FindPeers(tf, [IDLEN]byte{}, nil)
+	if len(peers) != 1 || peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("peers %v", peers)
+	}
+}
+
+func TestFindPeersProxyPolicy(t *testing.T) {
+	peer := PeerInfo{Ip: net.IPv4(10, 1, 2, 3), Port: 6881}
+	tf := &TorrentFile{Announce: udpTracker(t, "127.0.0.1", peer), FileLen: 1}
+	// nothing listens on the proxy, trackers behind it are unreachable
+	down := &proxy.Proxy{Type: proxy.SOCKS5, Addr: "127.0.0.1:1"}
+	if peers := FindPeers(tf, [IDLEN]byte{}, &ConnOptions{Proxy: down}); peers != nil {
+		t.Errorf("tracker reached around the proxy: %v", peers)
+	}
+	peersOnly := *down
+	peersOnly.Policy = proxy.PeersOnly
+	if peers := FindPeers(tf, [IDLEN]byte{}, &ConnOptions{Proxy: &peersOnly}); len(peers) != 1 {
+		t.Errorf("tracker not reached directly: %v", peers)
+	}
+}
+
+func TestFindPeersHTTPProxy(t *testing.T) {
+	peer := PeerInfo{Ip: net.IPv4(10, 1, 2, 3), Port: 6881}
+	var requests atomic.Int32
+	// the tracker host only exists behind the proxy
+	px := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "tracker.invalid" {
+			requests.Add(1)
+			trackerHandler(peer).ServeHTTP(w, r)
+		}
+	}))
+	defer px.Close()
+	opts := &ConnOptions{Proxy: &proxy.Proxy{Type: proxy.HTTP, Addr: strings.TrimPrefix(px.URL, "http://")}}
+	peers := FindPeers(&TorrentFile{Announce: "http://tracker.invalid/announce", FileLen: 1}, [IDLEN]byte{}, opts)
+	if len(peers) != 1 || requests.Load() != 1 {
+		t.Errorf("peers %v, %d requests through the proxy", peers, requests.Load())
+	}
+}
+
+// connectProxy is an HTTP proxy stand-in opening CONNECT tunnels, it counts
+// the tunnels in n
+func connectProxy(t *testing.T, n *atomic.Int32) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				up, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				defer up.Close()
+				n.Add(1)
+				c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(up, br)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDownloadThroughProxy(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<15, 100000)
+	ln := newSeed(t, tf, data, nil)
+	var tunnels atomic.Int32
+	opts := &ConnOptions{Proxy: &proxy.Proxy{Type: proxy.HTTP, Addr: connectProxy(t, &tunnels)}, Encryption: EncryptionPrefer}
+	peer := PeerInfo{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Port())}
+	if !bytes.Equal(downloadFile(t, tf, peer, opts), data) {
+		t.Error("downloaded data differs")
+	}
+	if tunnels.Load() == 0 {
+		t.Error("peer not connected through the proxy")
+	}
+}
+
+func TestAnnouncePort(t *testing.T) {
+	ports := make(chan string, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ports <- r.URL.Query().Get("port")
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	Announce(context.Background(), &TorrentFile{Announce: tracker.URL, FileLen: 1}, [IDLEN]byte{}, 51413, AnnounceStats{Left: 1}, nil)
+	if port := <-ports; port != "51413" {
+		t.Errorf("announced port %s, want 51413", port)
+	}
+}
+
+func TestAnnounceStats(t *testing.T) {
+	queries := make(chan url.Values, 1)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+	stats := AnnounceStats{Uploaded: 10, Downloaded: 20, Left: 30}
+	Announce(context.Background(), &TorrentFile{Announce: tracker.URL, FileLen: 50}, [IDLEN]byte{}, 51413, stats, nil)
+	q := <-queries
+	want := map[string]string{"uploaded": "10", "downloaded": "20", "left": "30", "compact": "1"}
+	for key, value := range want {
+		if q.Get(key) != value {
+			t.Errorf("%s=%q, want %q", key, q.Get(key), value)
+		}
+	}
+}
+
+func TestAnnounceCancel(t *testing.T) {
+	// neither tracker ever answers
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer tracker.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+	for _, announce := range []string{tracker.URL, "udp://" + pc.LocalAddr().String()} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		peers := Announce(ctx, &TorrentFile{Announce: announce, FileLen: 1}, [IDLEN]byte{}, PeerPort, AnnounceStats{Left: 1}, nil)
+		cancel()
+		if len(peers) != 0 || time.Since(start) > 2*time.Second {
+			t.Errorf("%s: %v after %v", announce, peers, time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"context"
+	"net"
+)
+
+// Transport carries peer connections, NewConn dials with it and the Listener
+// accepts from it
+type Transport interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+type tcpTransport struct{}
+
+// TCP is the default transport
+var TCP Transport = tcpTransport{}
+
+func (tcpTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return new(net.Dialer).DialContext(ctx, "tcp", addr)
+}
+
+// Listen with an empty host opens one dual-stack socket, IPv4 peers show up
+// with IPv4-mapped addresses
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// WrapFunc turns a raw connection into the one peers talk over, e.g. with
+// tls.Client or tls.Server, outbound tells which side we are
+type WrapFunc func(conn net.Conn, outbound bool) (net.Conn, error)
+
+type wrappedTransport struct {
+	Transport
+	wrap WrapFunc
+}
+
+// WrapTransport applies wrap to every connection of t, inbound ones are
+// wrapped in Accept, so wrap should not block on the network
+func WrapTransport(t Transport, wrap WrapFunc) Transport {
+	return &wrappedTransport{t, wrap}
+}
+
+func (t *wrappedTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.wrap(conn, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+func (t *wrappedTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedListener{ln, t.wrap}, nil
+}
+
+type wrappedListener struct {
+	net.Listener
+	wrap WrapFunc
+}
+
+// Accept skips the connections that fail to wrap
+func (l *wrappedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		res, err := l.wrap(conn, false)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		return res, nil
+	}
+}
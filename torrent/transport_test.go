@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 and a pool trusting it
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// transferOver downloads a torrent from a seeder, both on the transport
+func transferOver(t *testing.T, tr Transport, enc EncryptionPolicy) {
+	t.Helper()
+	tf, data := newTestTorrent(t, "file", 1<<15, 200000)
+	opts := &ConnOptions{Transport: tr, Encryption: enc}
+	ln := newSeed(t, tf, data, opts)
+	peer := PeerInfo{Ip: net.IPv4(127, 0, 0, 1), Port: uint16(ln.Port())}
+	if !bytes.Equal(downloadFile(t, tf, peer, opts), data) {
+		t.Error("downloaded data differs")
+	}
+}
+
+func TestPipeNetwork(t *testing.T) {
+	transferOver(t, NewPipeNetwork(), EncryptionDisabled)
+}
+
+func TestPipeNetworkEncrypted(t *testing.T) {
+	transferOver(t, NewPipeNetwork(), EncryptionRequire)
+}
+
+func TestPipeNetworkRefused(t *testing.T) {
+	_, err := NewPipeNetwork().Dial(context.Background(), "127.0.0.1:1")
+	if err == nil {
+		t.Error("dial without a listener succeeded")
+	}
+}
+
+func TestWrapTransport(t *testing.T) {
+	cert, pool := selfSigned(t)
+	wrap := func(conn net.Conn, outbound bool) (net.Conn, error) {
+		if outbound {
+			return tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}), nil
+		}
+		return tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}}), nil
+	}
+	transferOver(t, WrapTransport(NewPipeNetwork(), wrap), EncryptionDisabled)
+	transferOver(t, WrapTransport(TCP, wrap), EncryptionDisabled)
+}
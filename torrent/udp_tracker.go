@@ -0,0 +1,144 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// BEP 15: a connect exchange hands out a connection id that the announce
+// has to carry, every request is retried until answered
+const (
+	udpProtocolId  uint64 = 0x41727101980
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionError    uint32 = 3
+)
+
+const (
+	UDPTrackerTimeout = 5 * time.Second
+	UDPTrackerRetries = 3
+)
+
+// hostAddr keeps the host name of the tracker, so that a proxy resolves it
+type hostAddr string
+
+func (a hostAddr) Network() string { return "udp" }
+func (a hostAddr) String() string  { return string(a) }
+
+// listenUDP opens the socket for a UDP tracker, through the proxy if it
+// carries tracker traffic
+func listenUDP(ctx context.Context, host string, opts *ConnOptions) (net.PacketConn, net.Addr, error) {
+	if p := opts.proxy(); p.Trackers() {
+		ctx, cancel := context.WithTimeout(ctx, UDPTrackerTimeout)
+		defer cancel()
+		pc, err := p.ListenPacket(ctx)
+		return pc, hostAddr(host), err
+	}
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, err := net.ListenPacket("udp", ":0")
+	return pc, addr, err
+}
+
+// udpTransaction sends a request and returns the body of the matching
+// response, after action and transaction id, and the address it came from
+func udpTransaction(pc net.PacketConn, addr net.Addr, connId uint64, action uint32, body []byte) ([]byte, net.Addr, error) {
+	tid := make([]byte, 4)
+	rand.Read(tid)
+	req := new(bytes.Buffer)
+	binary.Write(req, binary.BigEndian, connId)
+	binary.Write(req, binary.BigEndian, action)
+	req.Write(tid)
+	req.Write(body)
+
+	buf := make([]byte, 1<<16)
+	for i := 0; i < UDPTrackerRetries; i++ {
+		_, err := pc.WriteTo(req.Bytes(), addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		pc.SetReadDeadline(time.Now().Add(UDPTrackerTimeout))
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, nil, err
+			}
+			if n < 8 || !bytes.Equal(buf[4:8], tid) {
+				continue
+			}
+			res := binary.BigEndian.Uint32(buf[0:4])
+			if res == actionError {
+				return nil, nil, fmt.Errorf("tracker error: %s", buf[8:n])
+			}
+			if res != action {
+				return nil, nil, fmt.Errorf("unexpected tracker action: %d", res)
+			}
+			return append([]byte(nil), buf[8:n]...), from, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("udp tracker %s timed out", addr)
+}
+
+// findPeersUDP announces to a UDP tracker, it returns its peers and the
+// seconds it wants between announces
+func findPeersUDP(ctx context.Context, tf *TorrentFile, peerId [IDLEN]byte, port int, stats AnnounceStats, opts *ConnOptions) ([]PeerInfo, int, error) {
+	u, err := url.Parse(tf.Announce)
+	if err != nil {
+		return nil, 0, err
+	}
+	pc, addr, err := listenUDP(ctx, u.Host, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer pc.Close()
+	// closing the socket ends a transaction that is waiting for an answer
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+
+	res, _, err := udpTransaction(pc, addr, udpProtocolId, actionConnect, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(res) < 8 {
+		return nil, 0, fmt.Errorf("connect response too short: %d", len(res))
+	}
+	connId := binary.BigEndian.Uint64(res[0:8])
+
+	body := new(bytes.Buffer)
+	body.Write(tf.InfoSHA[:])
+	body.Write(peerId[:])
+	binary.Write(body, binary.BigEndian, stats.Downloaded)
+	binary.Write(body, binary.BigEndian, stats.Left)
+	binary.Write(body, binary.BigEndian, stats.Uploaded)
+	binary.Write(body, binary.BigEndian, uint32(0)) // event
+	binary.Write(body, binary.BigEndian, uint32(0)) // ip, the sender
+	binary.Write(body, binary.BigEndian, uint32(0)) // key
+	binary.Write(body, binary.BigEndian, int32(-1)) // num_want, default
+	binary.Write(body, binary.BigEndian, uint16(port))
+	res, from, err := udpTransaction(pc, addr, connId, actionAnnounce, body.Bytes())
+	if err != nil {
+		return nil, 0, err
+	}
+	// interval, leechers, seeders, then the compact peers, which are IPv6
+	// when the tracker was reached over IPv6
+	if len(res) < 12 {
+		return nil, 0, fmt.Errorf("announce response too short: %d", len(res))
+	}
+	ipLen := IpLen
+	if udp, ok := from.(*net.UDPAddr); ok && udp.IP.To4() == nil {
+		ipLen = Ip6Len
+	}
+	interval := int(binary.BigEndian.Uint32(res[0:4]))
+	return buildPeerInfo(res[12:], ipLen), interval, nil
+}
@@ -0,0 +1,208 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// the largest block a peer may request, bigger requests are dropped
+const MAXREQUEST = 1 << 17
+
+// the most requests a peer may queue before we stop serving it
+const MAXQUEUED = 256
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// uploader serves the block requests of one peer, the reader of the
+// connection queues requests and cancels, run sends the blocks
+type uploader struct {
+	t     *Torrent
+	conn  *PeerConn
+	mu    sync.Mutex
+	queue []blockRequest
+	wake  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newUploader(t *Torrent, c *PeerConn) *uploader {
+	return &uploader{
+		t:    t,
+		conn: c,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+func (u *uploader) notify() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (u *uploader) stop() {
+	u.once.Do(func() {
+		close(u.done)
+	})
+}
+
+// handle processes the messages that concern uploading
+func (u *uploader) handle(msg *PeerMsg) error {
+	switch msg.Id {
+	case MsgInterested, MsgNotInterested:
+		u.conn.mu.Lock()
+		u.conn.PeerInterested = msg.Id == MsgInterested
+		u.conn.mu.Unlock()
+		u.t.choker.kickNow()
+	case MsgRequest:
+		index, begin, length, err := GetRequest(msg)
+		if err != nil {
+			return err
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		// requests while choked are dropped, as the spec says, unless the
+		// piece is allowed fast, fast peers are told about it
+		if u.conn.isAmChoking() && !u.conn.allowedOut[index] {
+			u.reject(blockRequest{index, begin, length})
+			return nil
+		}
+		if len(u.queue) >= MAXQUEUED {
+			return fmt.Errorf("too many queued requests")
+		}
+		u.queue = append(u.queue, blockRequest{index, begin, length})
+		u.notify()
+	case MsgCancel:
+		index, begin, length, err := GetRequest(msg)
+		if err != nil {
+			return err
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		for i, req := range u.queue {
+			if req == (blockRequest{index, begin, length}) {
+				u.queue = append(u.queue[:i], u.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// reject tells a fast peer that its request is dropped, other peers learn it
+// from the choke
+func (u *uploader) reject(req blockRequest) {
+	if u.conn.SupportsFast() {
+		u.conn.WriteMsg(NewRejectMsg(req.index, req.begin, req.length))
+	}
+}
+
+// choke stops serving the peer, its pending requests are dropped except for
+// allowed fast pieces
+func (u *uploader) choke() {
+	u.conn.mu.Lock()
+	changed := !u.conn.AmChoking
+	u.conn.AmChoking = true
+	u.conn.mu.Unlock()
+	if !changed {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conn.WriteMsg(&PeerMsg{MsgChoke, nil})
+	var kept []blockRequest
+	for _, req := range u.queue {
+		if u.conn.allowedOut[req.index] {
+			kept = append(kept, req)
+		} else {
+			u.reject(req)
+		}
+	}
+	u.queue = kept
+}
+
+func (u *uploader) unchoke() {
+	u.conn.mu.Lock()
+	changed := u.conn.AmChoking
+	u.conn.AmChoking = false
+	u.conn.mu.Unlock()
+	if changed {
+		u.conn.WriteMsg(&PeerMsg{MsgUnchoke, nil})
+	}
+}
+
+func (u *uploader) pop() (blockRequest, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	choking := u.conn.isAmChoking()
+	for i, req := range u.queue {
+		if choking && !u.conn.allowedOut[req.index] {
+			continue
+		}
+		u.queue = append(u.queue[:i], u.queue[i+1:]...)
+		return req, true
+	}
+	return blockRequest{}, false
+}
+
+func (u *uploader) run() {
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-u.wake:
+		}
+		for {
+			req, ok := u.pop()
+			if !ok {
+				break
+			}
+			data, err := u.t.readBlock(req.index, req.begin, req.length)
+			if err != nil {
+				fmt.Println("fail to read block: " + err.Error())
+				u.reject(req)
+				continue
+			}
+			_, err = u.conn.WriteMsg(NewPieceMsg(req.index, req.begin, data))
+			if err != nil {
+				return
+			}
+			u.conn.uploaded.Add(int64(len(data)))
+			u.t.uploaded.Add(int64(len(data)))
+		}
+	}
+}
+
+// GetRequest parses the payload of MsgRequest, MsgCancel and MsgReject
+func GetRequest(msg *PeerMsg) (index, begin, length int, err error) {
+	if msg.Id != MsgRequest && msg.Id != MsgCancel && msg.Id != MsgReject {
+		return 0, 0, 0, fmt.Errorf("expected MsgRequest, MsgCancel or MsgReject, got Id %d", msg.Id)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return
+}
+
+func NewHaveMsg(index int) *PeerMsg {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &PeerMsg{MsgHave, payload}
+}
+
+func NewPieceMsg(index, begin int, data []byte) *PeerMsg {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &PeerMsg{MsgPiece, payload}
+}
@@ -0,0 +1,203 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// ByteRange is a damaged part of a file, End is exclusive
+type ByteRange struct {
+	Begin int `json:"begin"`
+	End   int `json:"end"`
+}
+
+// FileReport lists the damaged ranges of a file, offsets are within the
+// file. Missing ranges could not be read, corrupt ones belong to pieces
+// whose hash did not match
+type FileReport struct {
+	Path    string      `json:"path"`
+	Length  int         `json:"length"`
+	Missing []ByteRange `json:"missing,omitempty"`
+	Corrupt []ByteRange `json:"corrupt,omitempty"`
+}
+
+// Damaged reports whether any range of the file is missing or corrupt
+func (r *FileReport) Damaged() bool {
+	return len(r.Missing) > 0 || len(r.Corrupt) > 0
+}
+
+// fileSpan is the part of a piece that lies in one file
+type fileSpan struct {
+	file   int
+	begin  int // in the piece
+	length int
+	offset int // in the file
+}
+
+// layout maps pieces to the files of a torrent
+type layout struct {
+	files    []FileInfo
+	offsets  []int // of each file in the torrent
+	pieceLen int
+	totalLen int
+}
+
+func newLayout(files []FileInfo, pieceLen, totalLen int) *layout {
+	if len(files) == 0 {
+		files = []FileInfo{{Length: totalLen}}
+	}
+	l := &layout{files: files, pieceLen: pieceLen, totalLen: totalLen}
+	offset := 0
+	for _, f := range files {
+		l.offsets = append(l.offsets, offset)
+		offset += f.Length
+	}
+	return l
+}
+
+// spans returns the parts of a piece in each file it overlaps
+func (l *layout) spans(index int) []fileSpan {
+	begin := index * l.pieceLen
+	end := begin + l.pieceLen
+	if end > l.totalLen {
+		end = l.totalLen
+	}
+	var spans []fileSpan
+	for i, f := range l.files {
+		fb, fe := l.offsets[i], l.offsets[i]+f.Length
+		b, e := max(begin, fb), min(end, fe)
+		if b >= e {
+			continue
+		}
+		spans = append(spans, fileSpan{i, b - begin, e - b, b - fb})
+	}
+	return spans
+}
+
+// pieceCheck is the outcome of hashing one piece
+type pieceCheck struct {
+	index   int
+	valid   bool
+	missing []fileSpan // spans that could not be read
+	corrupt []fileSpan // spans of a piece whose hash did not match
+}
+
+// checkPieces hashes the given pieces of the storage on all CPUs, every
+// piece if indexes is nil. progress is called after each piece and may be nil
+func checkPieces(storage Storage, shas [][SHALEN]byte, l *layout, indexes []int, progress func(done, total int)) []pieceCheck {
+	if indexes == nil {
+		indexes = make([]int, len(shas))
+		for i := range indexes {
+			indexes[i] = i
+		}
+	}
+	todo := make(chan int)
+	results := make(chan pieceCheck)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range todo {
+				results <- checkStoredPiece(storage, shas[index], l, index)
+			}
+		}()
+	}
+	go func() {
+		for _, index := range indexes {
+			todo <- index
+		}
+		close(todo)
+		wg.Wait()
+		close(results)
+	}()
+	checks := make([]pieceCheck, 0, len(indexes))
+	for res := range results {
+		checks = append(checks, res)
+		if progress != nil {
+			progress(len(checks), len(indexes))
+		}
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].index < checks[j].index })
+	return checks
+}
+
+func checkStoredPiece(storage Storage, sha [SHALEN]byte, l *layout, index int) pieceCheck {
+	res := pieceCheck{index: index}
+	spans := l.spans(index)
+	size := 0
+	for _, s := range spans {
+		size += s.length
+	}
+	buf := make([]byte, size)
+	// each file is read on its own, so a missing one does not hide the others
+	for _, s := range spans {
+		_, err := storage.ReadAt(index, buf[s.begin:s.begin+s.length], s.begin)
+		if err != nil {
+			res.missing = append(res.missing, s)
+		}
+	}
+	if len(res.missing) > 0 {
+		return res
+	}
+	if sha1.Sum(buf) != sha {
+		res.corrupt = spans
+		return res
+	}
+	res.valid = true
+	return res
+}
+
+// Verify hashes the pieces of tf in storage, e.g. data copied from another
+// mirror, and returns the valid ones. The report has an entry for each file
+func Verify(tf *TorrentFile, storage Storage) (Bitfield, []FileReport, error) {
+	return VerifyProgress(tf, storage, nil)
+}
+
+// VerifyProgress is Verify calling progress after each piece
+func VerifyProgress(tf *TorrentFile, storage Storage, progress func(done, total int)) (Bitfield, []FileReport, error) {
+	if storage == nil {
+		return nil, nil, fmt.Errorf("no storage")
+	}
+	if tf.PieceLen <= 0 {
+		return nil, nil, fmt.Errorf("invalid piece length: %d", tf.PieceLen)
+	}
+	l := newLayout(tf.Files, tf.PieceLen, tf.FileLen)
+	field := NewBitfield(len(tf.PieceSHA))
+	reports := make([]FileReport, len(l.files))
+	for i, f := range l.files {
+		reports[i] = FileReport{Path: filepath.Join(append([]string{tf.FileName}, f.Path...)...), Length: f.Length}
+	}
+	for _, res := range checkPieces(storage, tf.PieceSHA, l, nil, progress) {
+		if res.valid {
+			field.SetPiece(res.index)
+		}
+		for _, s := range res.missing {
+			reports[s.file].Missing = addRange(reports[s.file].Missing, ByteRange{s.offset, s.offset + s.length})
+		}
+		for _, s := range res.corrupt {
+			reports[s.file].Corrupt = addRange(reports[s.file].Corrupt, ByteRange{s.offset, s.offset + s.length})
+		}
+		// a piece past the end of the files, the last one lacks its data
+		if !res.valid && len(res.missing) == 0 && len(res.corrupt) == 0 {
+			last := len(l.files) - 1
+			begin := res.index*l.pieceLen - l.offsets[last]
+			reports[last].Missing = addRange(reports[last].Missing, ByteRange{begin, begin + l.pieceLen})
+		}
+	}
+	return field, reports, nil
+}
+
+// addRange appends r, merging it with the last range if they touch. Pieces
+// are added in order, so the ranges stay sorted
+func addRange(ranges []ByteRange, r ByteRange) []ByteRange {
+	if n := len(ranges); n > 0 && ranges[n-1].End >= r.Begin {
+		ranges[n-1].End = max(ranges[n-1].End, r.End)
+		return ranges
+	}
+	return append(ranges, r)
+}
@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles stores data in the files of tf below dir
+func writeFiles(t *testing.T, tf *TorrentFile, data []byte, dir string) {
+	t.Helper()
+	s, err := NewFileStorage(filepath.Join(dir, tf.FileName), tf.PieceLen, tf.FileList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, s, data, tf.PieceLen)
+	s.Close()
+}
+
+func TestVerify(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<10, 3000, 5000, 2000)
+	dir := t.TempDir()
+	writeFiles(t, tf, data, dir)
+	// piece 2 spans a and b, c is gone
+	f, err := os.OpenFile(filepath.Join(dir, "dir", "a"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{^data[2500]}, 2500)
+	f.Close()
+	os.Remove(filepath.Join(dir, "dir", "c"))
+
+	s, err := OpenFileStorage(filepath.Join(dir, tf.FileName), tf.PieceLen, tf.FileList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	field, reports, err := Verify(tf, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tf.PieceSHA {
+		want := i != 2 && i < 7
+		if field.HasPiece(i) != want {
+			t.Errorf("piece %d valid %v, want %v", i, field.HasPiece(i), want)
+		}
+	}
+	want := []FileReport{
+		{Path: filepath.Join("dir", "a"), Length: 3000, Corrupt: []ByteRange{{2048, 3000}}},
+		{Path: filepath.Join("dir", "b"), Length: 5000, Corrupt: []ByteRange{{0, 72}}},
+		{Path: filepath.Join("dir", "c"), Length: 2000, Missing: []ByteRange{{0, 2000}}},
+	}
+	if !reflect.DeepEqual(reports, want) {
+		t.Errorf("reports %+v, want %+v", reports, want)
+	}
+}
+
+func TestVerifyPastTheEnd(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<10, 3000, 2000)
+	dir := t.TempDir()
+	writeFiles(t, tf, data, dir)
+	// the torrent has a hash more than its files have data for
+	tf.PieceSHA = append(tf.PieceSHA, [SHALEN]byte{1})
+	s, err := OpenFileStorage(filepath.Join(dir, tf.FileName), tf.PieceLen, tf.FileList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	field, reports, err := Verify(tf, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if field.HasPiece(5) || !field.HasPiece(4) {
+		t.Errorf("valid pieces %x", field)
+	}
+	want := []ByteRange{{5<<10 - 3000, 6<<10 - 3000}}
+	if reports[0].Damaged() || !reflect.DeepEqual(reports[1].Missing, want) {
+		t.Errorf("reports %+v, want %v missing in b", reports, want)
+	}
+}
+
+func TestVerifySingleFile(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<10, 5000)
+	dir := t.TempDir()
+	writeFiles(t, tf, data, dir)
+	s, err := OpenFileStorage(filepath.Join(dir, tf.FileName), tf.PieceLen, tf.FileList())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	field, reports, err := Verify(tf, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tf.PieceSHA {
+		if !field.HasPiece(i) {
+			t.Errorf("valid piece %d is bad", i)
+		}
+	}
+	if len(reports) != 1 || reports[0].Path != "file" || reports[0].Damaged() {
+		t.Errorf("reports %+v", reports)
+	}
+}
+
+func TestOpenFileStorageCreatesNothing(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenFileStorage(filepath.Join(dir, "dir"), 1<<10, []FileInfo{{[]string{"a"}, 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.ReadAt(0, make([]byte, 100), 0); err == nil {
+		t.Error("read from a missing file")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Error("verify created the torrent directory")
+	}
+}
@@ -0,0 +1,213 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WebSeedBlocks is how many blocks are fetched from a web seed at once,
+// neighbouring blocks of a piece in one request
+const WebSeedBlocks = 16
+
+// WebSeedRetries is how many requests in a row may fail before a web seed
+// is given up, WebSeedDelay is the pause after each failure
+const (
+	WebSeedRetries = 3
+	WebSeedDelay   = 5 * time.Second
+)
+
+// webSeed is an HTTP server holding the files of the torrent (BEP 19). The
+// picker sees it as a peer that has every piece
+type webSeed struct {
+	t      *Torrent
+	url    string
+	conn   *PeerConn // stands for the web seed in the picker, it is never connected
+	layout *layout
+	client *http.Client
+}
+
+// webSeedRoutine downloads from a web seed until the pieces we want are
+// done. A web seed that sent a corrupt piece is banned
+func (t *Torrent) webSeedRoutine(seedURL string) {
+	field := NewBitfield(len(t.PieceSHA))
+	for i := range t.PieceSHA {
+		field.SetPiece(i)
+	}
+	ws := &webSeed{
+		t:      t,
+		url:    seedURL,
+		conn:   &PeerConn{Field: field, webSeed: true},
+		layout: newLayout(t.Files, t.PieceLen, t.FileLen),
+		client: httpClient(t.ConnOptions),
+	}
+	// requests are given up once the torrent stops or is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.done:
+		case <-t.stopped:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	t.picker.addField(field, 1)
+	defer t.picker.addField(field, -1)
+	defer t.picker.releaseAll(ws.conn)
+
+	failures := 0
+	for !t.picker.complete() {
+		wait := t.picker.wait()
+		reqs := ws.pick()
+		if len(reqs) == 0 {
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		corrupt, err := ws.fetch(ctx, reqs)
+		if ctx.Err() != nil {
+			return
+		}
+		if corrupt {
+			fmt.Printf("banning web seed %s: %v\n", seedURL, err)
+			return
+		}
+		if err != nil {
+			fmt.Printf("web seed %s failed: %v\n", seedURL, err)
+			failures++
+			if failures >= WebSeedRetries {
+				return
+			}
+			select {
+			case <-time.After(WebSeedDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		failures = 0
+	}
+}
+
+// pick asks the picker for the next blocks of the web seed
+func (ws *webSeed) pick() []blockRequest {
+	var reqs []blockRequest
+	for len(reqs) < WebSeedBlocks {
+		req, ok := ws.t.picker.nextBlock(ws.conn, func(int) bool { return true })
+		if !ok {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+// fetch downloads the blocks, a run of neighbouring blocks of a piece in one
+// request per file. Blocks that did not arrive are released. It reports
+// whether the web seed sent a corrupt piece
+func (ws *webSeed) fetch(ctx context.Context, reqs []blockRequest) (bool, error) {
+	for len(reqs) > 0 {
+		n := 1
+		for n < len(reqs) && reqs[n].index == reqs[0].index && reqs[n].begin == reqs[n-1].begin+reqs[n-1].length {
+			n++
+		}
+		run := reqs[:n]
+		last := run[n-1]
+		data, err := ws.read(ctx, run[0].index, run[0].begin, last.begin+last.length-run[0].begin)
+		if err != nil {
+			for _, req := range reqs {
+				ws.t.picker.release(ws.conn, req)
+			}
+			return false, err
+		}
+		for _, req := range run {
+			block := data[req.begin-run[0].begin:][:req.length]
+			ws.t.downloaded.Add(int64(len(block)))
+			err = ws.t.receiveBlock(ws.conn, req.index, req.begin, block)
+			if err != nil {
+				for _, req := range reqs {
+					ws.t.picker.release(ws.conn, req)
+				}
+				return true, err
+			}
+		}
+		reqs = reqs[n:]
+	}
+	return false, nil
+}
+
+// read returns length bytes of a piece from begin on, from every file they
+// lie in
+func (ws *webSeed) read(ctx context.Context, index, begin, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	for _, s := range ws.layout.spans(index) {
+		b, e := max(begin, s.begin), min(begin+length, s.begin+s.length)
+		if b >= e {
+			continue
+		}
+		err := ws.get(ctx, s.file, s.offset+b-s.begin, buf[b-begin:e-begin])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// get fetches len(buf) bytes of a file from off on with a Range request
+func (ws *webSeed) get(ctx context.Context, file, off int, buf []byte) error {
+	u := ws.fileURL(file)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+len(buf)-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, skip to it
+		_, err = io.CopyN(io.Discard, resp.Body, int64(off))
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	_, err = io.ReadFull(resp.Body, buf)
+	return err
+}
+
+// fileURL returns the URL of a file on the web seed. A URL ending in a slash
+// is a directory holding the torrent, otherwise it names the file of a
+// single-file torrent or the directory of a multi-file one
+func (ws *webSeed) fileURL(file int) string {
+	u := ws.url
+	name := path.Base(filepath.ToSlash(ws.t.FileName))
+	if len(ws.t.Files) == 0 {
+		if strings.HasSuffix(u, "/") {
+			u += url.PathEscape(name)
+		}
+		return u
+	}
+	if strings.HasSuffix(u, "/") {
+		u += url.PathEscape(name)
+	}
+	for _, elem := range ws.t.Files[file].Path {
+		u += "/" + url.PathEscape(elem)
+	}
+	return u
+}
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"bytes"
+	"go-torrent/proxy"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebSeed serves the files of tf with data below a directory URL
+func newWebSeed(t *testing.T, tf *TorrentFile, data []byte) http.Handler {
+	t.Helper()
+	root := t.TempDir()
+	name := filepath.Join(root, tf.FileName)
+	if len(tf.Files) == 0 {
+		os.WriteFile(name, data, 0644)
+	} else {
+		off := 0
+		for _, f := range tf.Files {
+			p := filepath.Join(append([]string{name}, f.Path...)...)
+			os.MkdirAll(filepath.Dir(p), 0755)
+			os.WriteFile(p, data[off:off+f.Length], 0644)
+			off += f.Length
+		}
+	}
+	return http.FileServer(http.Dir(root))
+}
+
+// waitDone fails the test unless the torrent finishes in time
+func waitDone(t *testing.T, tt *Torrent) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- tt.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download timed out")
+	}
+}
+
+func TestWebSeed(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<15, 3<<14, 100, 1<<16)
+	seed := httptest.NewServer(newWebSeed(t, tf, data))
+	defer seed.Close()
+
+	dir := t.TempDir()
+	task := newTestTask(tf, dir)
+	task.WebSeeds = []string{seed.URL + "/"}
+	tt, err := Start(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	waitDone(t, tt)
+	var got []byte
+	for _, f := range tf.Files {
+		b, err := os.ReadFile(filepath.Join(append([]string{dir, tf.FileName}, f.Path...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded data differs")
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	tf, data := newTestTorrent(t, "file.bin", 1<<15, 100000)
+	seed := httptest.NewServer(newWebSeed(t, tf, data))
+	defer seed.Close()
+
+	task := newTestTask(tf, t.TempDir())
+	// the URL names the file itself
+	task.WebSeeds = []string{seed.URL + "/file.bin"}
+	tt, err := Start(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	waitDone(t, tt)
+	got, err := os.ReadFile(task.FileName)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded data differs, %v", err)
+	}
+}
+
+func TestWebSeedCorrupt(t *testing.T) {
+	tf, data := newTestTorrent(t, "dir", 1<<15, 5<<15, 7<<15)
+	var badHits, goodHits atomic.Int32
+	files := newWebSeed(t, tf, data)
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodHits.Add(1)
+		files.ServeHTTP(w, r)
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits.Add(1)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(bytes.Repeat([]byte{1}, 1<<20))
+	}))
+	defer bad.Close()
+
+	task := newTestTask(tf, t.TempDir())
+	task.WebSeeds = []string{bad.URL + "/", good.URL + "/"}
+	tt, err := Start(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	waitDone(t, tt)
+	if goodHits.Load() == 0 {
+		t.Error("nothing fetched from the good web seed")
+	}
+	// the bad one is banned after its first corrupt piece, the blocks of a
+	// piece may take a request per file
+	if n := badHits.Load(); n > 2 {
+		t.Errorf("%d requests to a banned web seed", n)
+	}
+}
+
+func TestWebSeedFileURL(t *testing.T) {
+	task := &TorrentTask{FileName: filepath.Join("data", "my dir"), Files: []FileInfo{{[]string{"sub", "a b"}, 1}}}
+	ws := &webSeed{t: &Torrent{TorrentTask: task}}
+	for _, c := range []struct{ url, want string }{
+		{"http://host/", "http://host/my%20dir/sub/a%20b"},
+		{"http://host/pkg", "http://host/pkg/sub/a%20b"},
+	} {
+		ws.url = c.url
+		if got := ws.fileURL(0); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.url, got, c.want)
+		}
+	}
+}
+
+func TestWebSeedProxy(t *testing.T) {
+	tf, data := newTestTorrent(t, "file", 1<<14, 1<<15)
+	files := newWebSeed(t, tf, data)
+	hosts := make(chan string, 16)
+	// the web seed host only exists behind the proxy
+	proxied := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case hosts <- r.URL.Host:
+		default:
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer proxied.Close()
+
+	task := newTestTask(tf, t.TempDir())
+	task.WebSeeds = []string{"http://seed.invalid/"}
+	task.ConnOptions = &ConnOptions{Proxy: &proxy.Proxy{Type: proxy.HTTP, Addr: strings.TrimPrefix(proxied.URL, "http://")}}
+	tt, err := Start(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tt.Close()
+	waitDone(t, tt)
+	if host := <-hosts; host != "seed.invalid" {
+		t.Errorf("proxy asked for %s", host)
+	}
+}
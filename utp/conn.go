@@ -0,0 +1,562 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	maxPayload   = 1200 - headerLen // keeps packets below the IPv6 minimum MTU
+	RecvWindow   = 1 << 20          // bytes buffered for Read
+	SendBuffer   = 1 << 20          // bytes buffered by Write
+	MaxRetries   = 8                // sends of a packet before the connection fails
+	minRTO       = 500 * time.Millisecond
+	maxRTO       = 30 * time.Second
+	maxOOO       = 1024 // out of order packets kept, by distance to ack_nr
+	keepAlive    = 29 * time.Second
+	closeLinger  = 30 * time.Second
+	tickInterval = 50 * time.Millisecond
+)
+
+var (
+	ErrReset   = errors.New("utp connection reset by peer")
+	ErrTimeout = errors.New("utp connection timed out")
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+type outPacket struct {
+	p      *packet
+	size   int
+	sentAt time.Time
+	sends  int
+	lost   bool // waiting to be sent again
+}
+
+// Conn is a uTP connection, packets are acknowledged like TCP segments and
+// the send window follows LEDBAT
+type Conn struct {
+	s      *Socket
+	raddr  *net.UDPAddr
+	recvId uint16 // connection id of the packets we receive
+	sendId uint16 // connection id of the packets we send
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	state       int
+	err         error // why the connection failed
+	closing     bool  // Close was called, FIN follows the buffered data
+	closingAt   time.Time
+	established chan struct{}
+	done        chan struct{}
+
+	// sending
+	isn      uint16 // seq_nr of our first packet, what a duplicate SYN is answered with
+	seq      uint16 // seq_nr of the next packet
+	sendBuf  []byte // written but not sent yet
+	inflight []*outPacket
+	finSent  bool
+	peerWnd  uint32
+	cc       *ledbat
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	lastAck  uint16
+	dupAcks  int
+	lastSent time.Time
+
+	// receiving
+	ack        uint16 // seq_nr of the last packet received in order
+	readBuf    bytes.Buffer
+	ooo        map[uint16]*packet
+	eof        bool
+	replyDelay uint32 // one way delay of the last packet received, echoed to the peer
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	rdTimer       *time.Timer
+	wdTimer       *time.Timer
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvId, sendId uint16) *Conn {
+	c := &Conn{
+		s:           s,
+		raddr:       raddr,
+		recvId:      recvId,
+		sendId:      sendId,
+		established: make(chan struct{}),
+		done:        make(chan struct{}),
+		peerWnd:     RecvWindow,
+		cc:          newLedbat(),
+		rto:         time.Second,
+		ooo:         make(map[uint16]*packet),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *Conn) recvWnd() uint32 {
+	if c.readBuf.Len() >= RecvWindow {
+		return 0
+	}
+	return uint32(RecvWindow - c.readBuf.Len())
+}
+
+// send fills in the header fields that describe our side and writes the packet
+func (c *Conn) send(p *packet) {
+	p.connId = c.sendId
+	if p.typ == stSyn {
+		p.connId = c.recvId
+	} else {
+		p.ack = c.ack
+	}
+	p.timestamp = nowMicro()
+	p.delay = c.replyDelay
+	p.wnd = c.recvWnd()
+	c.lastSent = time.Now()
+	c.s.writeTo(p.encode(), c.raddr)
+}
+
+// queue gives the packet the next seq_nr and sends it until it is acked
+func (c *Conn) queue(p *packet) {
+	p.seq = c.seq
+	c.seq++
+	op := &outPacket{p: p, size: len(p.payload)}
+	c.inflight = append(c.inflight, op)
+	c.transmit(op)
+}
+
+func (c *Conn) transmit(op *outPacket) {
+	op.sentAt = time.Now()
+	op.sends++
+	op.lost = false
+	c.send(op.p)
+}
+
+// sendState acks what we received so far, packets received out of order are
+// reported in the selective ack
+func (c *Conn) sendState() {
+	c.send(&packet{typ: stState, seq: c.seq, sack: c.sackMask()})
+}
+
+// sackMask: bit i stands for ack_nr+2+i, least significant bit first
+func (c *Conn) sackMask() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	last := 0
+	for seq := range c.ooo {
+		if d := int(seq - c.ack - 2); d > last {
+			last = d
+		}
+	}
+	size := (last/32 + 1) * 4
+	if size > 32 {
+		size = 32
+	}
+	mask := make([]byte, size)
+	for seq := range c.ooo {
+		d := int(seq - c.ack - 2)
+		if d >= 0 && d < size*8 {
+			mask[d/8] |= 1 << uint(d%8)
+		}
+	}
+	return mask
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// handle processes a packet of the peer, it runs on the reader of the socket
+func (c *Conn) handle(p *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	c.replyDelay = nowMicro() - p.timestamp
+	switch p.typ {
+	case stReset:
+		c.fail(ErrReset)
+		return
+	case stSyn:
+		// our state packet got lost, the peer learns our first seq_nr from
+		// it, so data sent in the meantime is not skipped
+		c.send(&packet{typ: stState, seq: c.isn})
+		return
+	}
+	c.peerWnd = p.wnd
+	if c.state == stateSynSent {
+		if p.typ != stState {
+			return
+		}
+		c.ack = p.seq - 1
+		c.state = stateConnected
+		close(c.established)
+	}
+	if p.delay != 0 {
+		c.cc.sample(p.delay)
+	}
+	c.processAck(p)
+	if p.typ == stData || p.typ == stFin {
+		c.receive(p)
+		c.sendState()
+	}
+	c.flush()
+	c.cond.Broadcast()
+}
+
+func (c *Conn) processAck(p *packet) {
+	now := time.Now()
+	acked := 0
+	newAck := false
+	// everything up to ack_nr
+	for len(c.inflight) > 0 && !seqLess(p.ack, c.inflight[0].p.seq) {
+		op := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		acked += op.size
+		newAck = true
+		if op.sends == 1 {
+			c.updateRTT(now.Sub(op.sentAt))
+		}
+	}
+	// packets after a gap
+	lost := false
+	if p.sack != nil {
+		sacked := 0
+		kept := c.inflight[:0]
+		for i := len(c.inflight) - 1; i >= 0; i-- {
+			op := c.inflight[i]
+			d := int(op.p.seq - p.ack - 2)
+			if d >= 0 && d < len(p.sack)*8 && p.sack[d/8]&(1<<uint(d%8)) != 0 {
+				sacked++
+				acked += op.size
+				if op.sends == 1 {
+					c.updateRTT(now.Sub(op.sentAt))
+				}
+				c.inflight[i] = nil
+				continue
+			}
+			// three packets sent after it made it, this one did not
+			if sacked >= 3 && op.sends < MaxRetries && now.Sub(op.sentAt) > c.rtt {
+				lost = true
+				c.transmit(op)
+			}
+		}
+		for _, op := range c.inflight {
+			if op != nil {
+				kept = append(kept, op)
+			}
+		}
+		c.inflight = kept
+	}
+	if newAck || p.ack != c.lastAck {
+		c.dupAcks = 0
+	} else if p.typ == stState && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			lost = true
+			c.transmit(c.inflight[0])
+		}
+	}
+	c.lastAck = p.ack
+	if lost {
+		c.cc.onLoss(c.rtt)
+	}
+	c.cc.onAck(acked)
+}
+
+func (c *Conn) receive(p *packet) {
+	// already delivered
+	if !seqLess(c.ack, p.seq) {
+		return
+	}
+	if p.seq != c.ack+1 {
+		if int(p.seq-c.ack) <= maxOOO {
+			c.ooo[p.seq] = p
+		}
+		return
+	}
+	c.deliver(p)
+	for {
+		next, ok := c.ooo[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, next.seq)
+		c.deliver(next)
+	}
+}
+
+func (c *Conn) deliver(p *packet) {
+	c.ack = p.seq
+	if c.eof {
+		return
+	}
+	if p.typ == stFin {
+		c.eof = true
+		return
+	}
+	c.readBuf.Write(p.payload)
+}
+
+// flush sends lost packets and new data as far as the window allows, FIN
+// goes out once everything written before Close has been sent
+func (c *Conn) flush() {
+	if c.state != stateConnected {
+		return
+	}
+	window := int(c.cc.cwnd)
+	if int(c.peerWnd) < window {
+		window = int(c.peerWnd)
+	}
+	flying := 0
+	for _, op := range c.inflight {
+		if !op.lost {
+			flying += op.size
+		}
+	}
+	for _, op := range c.inflight {
+		if !op.lost {
+			continue
+		}
+		if flying > 0 && flying+op.size > window {
+			return
+		}
+		c.transmit(op)
+		flying += op.size
+	}
+	for len(c.sendBuf) > 0 {
+		n := len(c.sendBuf)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		if flying > 0 && flying+n > window {
+			return
+		}
+		payload := make([]byte, n)
+		copy(payload, c.sendBuf)
+		c.sendBuf = c.sendBuf[n:]
+		c.queue(&packet{typ: stData, payload: payload})
+		flying += n
+	}
+	if c.closing && !c.finSent {
+		c.finSent = true
+		c.queue(&packet{typ: stFin})
+	}
+}
+
+// tick retransmits what timed out and ends connections that are done
+func (c *Conn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if c.closing && (c.finSent && len(c.inflight) == 0 || time.Since(c.closingAt) > closeLinger) {
+		c.shutdown()
+		return
+	}
+	if len(c.inflight) > 0 && time.Since(c.inflight[0].sentAt) > c.rto {
+		if c.inflight[0].sends >= MaxRetries {
+			c.fail(ErrTimeout)
+			return
+		}
+		// everything in flight is presumed lost
+		c.cc.onTimeout()
+		c.rto *= 2
+		if c.rto > maxRTO {
+			c.rto = maxRTO
+		}
+		for _, op := range c.inflight {
+			op.lost = true
+		}
+		if c.state == stateSynSent {
+			c.transmit(c.inflight[0])
+		}
+		c.flush()
+	}
+	if c.state == stateConnected && time.Since(c.lastSent) > keepAlive {
+		c.sendState()
+	}
+}
+
+func (c *Conn) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.tick()
+	}
+}
+
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.shutdown()
+}
+
+// shutdown releases the connection, it must be called with mu held
+func (c *Conn) shutdown() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	close(c.done)
+	c.s.remove(c)
+	c.cond.Broadcast()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.readBuf.Len() == 0 && !c.eof && !c.closing && c.state != stateClosed && !expired(c.readDeadline) {
+		c.cond.Wait()
+	}
+	switch {
+	case c.readBuf.Len() > 0:
+		full := c.recvWnd() < maxPayload
+		n, _ := c.readBuf.Read(b)
+		// the peer stopped sending once our window was full
+		if full && c.recvWnd() >= maxPayload && c.state == stateConnected {
+			c.sendState()
+		}
+		return n, nil
+	case c.eof:
+		return 0, io.EOF
+	case c.closing:
+		return 0, net.ErrClosed
+	case c.state == stateClosed:
+		return 0, c.err
+	default:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		for len(c.sendBuf) >= SendBuffer && !c.closing && c.state != stateClosed && !expired(c.writeDeadline) {
+			c.cond.Wait()
+		}
+		switch {
+		case c.closing:
+			return n, net.ErrClosed
+		case c.state == stateClosed:
+			return n, c.err
+		case expired(c.writeDeadline):
+			return n, os.ErrDeadlineExceeded
+		}
+		k := SendBuffer - len(c.sendBuf)
+		if k > len(b) {
+			k = len(b)
+		}
+		c.sendBuf = append(c.sendBuf, b[:k]...)
+		b = b[k:]
+		n += k
+		c.flush()
+	}
+	return n, nil
+}
+
+// Close sends FIN after the data written so far, the connection lingers
+// until the peer acks it
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	c.closingAt = time.Now()
+	if c.state != stateConnected {
+		c.shutdown()
+	} else {
+		c.flush()
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.rdTimer = c.wakeAt(c.rdTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.wdTimer = c.wakeAt(c.wdTimer, t)
+	return nil
+}
+
+// wakeAt wakes up blocked readers and writers once the deadline passes
+func (c *Conn) wakeAt(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
@@ -0,0 +1,105 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops and delays the packets written to it
+type lossyConn struct {
+	net.PacketConn
+	loss  float64
+	delay time.Duration
+	mu    sync.Mutex
+	rand  *mrand.Rand
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	drop := l.rand.Float64() < l.loss
+	l.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	if l.delay == 0 {
+		return l.PacketConn.WriteTo(b, addr)
+	}
+	c := append([]byte(nil), b...)
+	time.AfterFunc(l.delay, func() { l.PacketConn.WriteTo(c, addr) })
+	return len(b), nil
+}
+
+func lossySocket(t *testing.T, loss float64, delay time.Duration) *Socket {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSocket(&lossyConn{PacketConn: pc, loss: loss, delay: delay, rand: mrand.New(mrand.NewSource(1))})
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// transfer sends size bytes from one socket to another over a path that
+// loses and delays packets
+func transfer(t *testing.T, loss float64, delay time.Duration, size int) {
+	a, b := lossySocket(t, loss, delay), lossySocket(t, loss, delay)
+	data := make([]byte, size)
+	rand.Read(data)
+	go func() {
+		c, err := b.Accept()
+		if err != nil {
+			return
+		}
+		c.Write(data)
+		c.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	c, err := a.Dial(ctx, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(60 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("%v after %d bytes", err, len(got))
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes that differ", len(got))
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	transfer(t, 0, 0, 4<<20)
+}
+
+func TestTransferLoss(t *testing.T) {
+	transfer(t, 0.05, 0, 1<<20)
+}
+
+func TestTransferDelay(t *testing.T) {
+	transfer(t, 0.02, 20*time.Millisecond, 1<<20)
+}
+
+func TestDialNoListener(t *testing.T) {
+	s, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = s.Dial(ctx, "127.0.0.1:1")
+	if err == nil {
+		t.Error("dial without a listener succeeded")
+	}
+}
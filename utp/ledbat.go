@@ -0,0 +1,102 @@
+package utp
+
+import (
+	"time"
+)
+
+// LEDBAT keeps the queuing delay we add to the path around Target, so bulk
+// transfers yield to interactive traffic on the same uplink
+const (
+	Target      = 100 * time.Millisecond
+	Gain        = 1.0
+	MaxWindow   = 1 << 20 // bytes in flight, at most
+	baseHistory = 10      // minutes the base delay is remembered
+)
+
+type ledbat struct {
+	cwnd      float64 // bytes in flight allowed
+	slowStart bool
+	bases     [baseHistory]uint32 // lowest delay seen in each of the last minutes
+	baseIdx   int
+	baseAt    time.Time
+	lossAt    time.Time
+	ourDelay  time.Duration // the last queuing delay, for stats
+}
+
+func newLedbat() *ledbat {
+	l := &ledbat{cwnd: 2 * maxPayload, slowStart: true, baseAt: time.Now()}
+	for i := range l.bases {
+		l.bases[i] = ^uint32(0)
+	}
+	return l
+}
+
+func (l *ledbat) base() uint32 {
+	res := ^uint32(0)
+	for _, b := range l.bases {
+		if b < res {
+			res = b
+		}
+	}
+	return res
+}
+
+// sample records a one way delay measured by the peer, the clocks of both
+// sides differ, so only the distance to the lowest sample matters
+func (l *ledbat) sample(delay uint32) {
+	if time.Since(l.baseAt) >= time.Minute {
+		l.baseIdx = (l.baseIdx + 1) % baseHistory
+		l.bases[l.baseIdx] = ^uint32(0)
+		l.baseAt = time.Now()
+	}
+	if delay < l.bases[l.baseIdx] {
+		l.bases[l.baseIdx] = delay
+	}
+	l.ourDelay = time.Duration(delay-l.base()) * time.Microsecond
+}
+
+// onAck grows or shrinks the window in proportion to how far the queuing
+// delay is from Target
+func (l *ledbat) onAck(acked int) {
+	if acked <= 0 {
+		return
+	}
+	if l.slowStart {
+		if l.ourDelay > Target/2 {
+			l.slowStart = false
+		} else {
+			l.cwnd += float64(acked)
+		}
+	}
+	if !l.slowStart {
+		offTarget := float64(Target-l.ourDelay) / float64(Target)
+		l.cwnd += Gain * offTarget * float64(acked) * maxPayload / l.cwnd
+	}
+	l.clamp()
+}
+
+// onLoss halves the window, at most once per rtt
+func (l *ledbat) onLoss(rtt time.Duration) {
+	if time.Since(l.lossAt) < rtt {
+		return
+	}
+	l.lossAt = time.Now()
+	l.slowStart = false
+	l.cwnd /= 2
+	l.clamp()
+}
+
+// onTimeout falls back to a single packet
+func (l *ledbat) onTimeout() {
+	l.slowStart = false
+	l.cwnd = maxPayload
+}
+
+func (l *ledbat) clamp() {
+	if l.cwnd < maxPayload {
+		l.cwnd = maxPayload
+	}
+	if l.cwnd > MaxWindow {
+		l.cwnd = MaxWindow
+	}
+}
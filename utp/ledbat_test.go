@@ -0,0 +1,44 @@
+package utp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedbatWindow(t *testing.T) {
+	l := newLedbat()
+	// no queuing delay, the window grows
+	l.sample(1000)
+	start := l.cwnd
+	l.onAck(maxPayload)
+	if l.cwnd <= start {
+		t.Fatalf("window %v did not grow from %v", l.cwnd, start)
+	}
+	// a queuing delay of twice the target shrinks it
+	l.sample(1000 + uint32(2*Target/time.Microsecond))
+	grown := l.cwnd
+	for i := 0; i < 10; i++ {
+		l.onAck(maxPayload)
+	}
+	if l.cwnd >= grown {
+		t.Fatalf("window %v did not shrink from %v", l.cwnd, grown)
+	}
+	l.onTimeout()
+	if l.cwnd != maxPayload {
+		t.Errorf("window %v after a timeout, want %d", l.cwnd, maxPayload)
+	}
+}
+
+func TestLedbatLoss(t *testing.T) {
+	l := newLedbat()
+	l.cwnd = 8 * maxPayload
+	l.onLoss(time.Second)
+	if l.cwnd != 4*maxPayload {
+		t.Fatalf("window %v, want %d", l.cwnd, 4*maxPayload)
+	}
+	// at most once per rtt
+	l.onLoss(time.Second)
+	if l.cwnd != 4*maxPayload {
+		t.Errorf("window halved twice within an rtt")
+	}
+}
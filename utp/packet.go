@@ -0,0 +1,118 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// packet types of BEP 29
+const (
+	stData  byte = 0
+	stFin   byte = 1
+	stState byte = 2
+	stReset byte = 3
+	stSyn   byte = 4
+)
+
+const (
+	version   byte = 1
+	headerLen      = 20
+	extNone   byte = 0
+	extSack   byte = 1
+)
+
+var errPacket = errors.New("malformed utp packet")
+
+// packet: type and version, extension, connection id, timestamp, timestamp
+// difference, window size, seq_nr, ack_nr, then extensions and payload
+type packet struct {
+	typ       byte
+	connId    uint16
+	timestamp uint32 // microseconds, sender clock
+	delay     uint32 // timestamp difference, the one way delay the sender measured
+	wnd       uint32 // receive window of the sender
+	seq       uint16
+	ack       uint16
+	sack      []byte // bitmask of the packets received after ack+1, nil if none
+	payload   []byte
+}
+
+func (p *packet) encode() []byte {
+	size := headerLen + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+	buf := make([]byte, size)
+	buf[0] = p.typ<<4 | version
+	if p.sack != nil {
+		buf[1] = extSack
+	}
+	binary.BigEndian.PutUint16(buf[2:4], p.connId)
+	binary.BigEndian.PutUint32(buf[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], p.delay)
+	binary.BigEndian.PutUint32(buf[12:16], p.wnd)
+	binary.BigEndian.PutUint16(buf[16:18], p.seq)
+	binary.BigEndian.PutUint16(buf[18:20], p.ack)
+	curr := headerLen
+	if p.sack != nil {
+		buf[curr] = extNone
+		buf[curr+1] = byte(len(p.sack))
+		curr += 2
+		curr += copy(buf[curr:], p.sack)
+	}
+	copy(buf[curr:], p.payload)
+	return buf
+}
+
+func decodePacket(b []byte) (*packet, error) {
+	if !isPacket(b) {
+		return nil, errPacket
+	}
+	p := &packet{
+		typ:       b[0] >> 4,
+		connId:    binary.BigEndian.Uint16(b[2:4]),
+		timestamp: binary.BigEndian.Uint32(b[4:8]),
+		delay:     binary.BigEndian.Uint32(b[8:12]),
+		wnd:       binary.BigEndian.Uint32(b[12:16]),
+		seq:       binary.BigEndian.Uint16(b[16:18]),
+		ack:       binary.BigEndian.Uint16(b[18:20]),
+	}
+	// extensions are chained, unknown ones are skipped
+	ext := b[1]
+	curr := headerLen
+	for ext != extNone {
+		if curr+2 > len(b) {
+			return nil, errPacket
+		}
+		next, length := b[curr], int(b[curr+1])
+		curr += 2
+		if curr+length > len(b) {
+			return nil, errPacket
+		}
+		if ext == extSack {
+			p.sack = b[curr : curr+length]
+		}
+		curr += length
+		ext = next
+	}
+	p.payload = b[curr:]
+	return p, nil
+}
+
+// isPacket tells uTP packets from the other protocols sharing the socket,
+// e.g. the bencoded dicts of the DHT, which start with 'd'
+func isPacket(b []byte) bool {
+	return len(b) >= headerLen && b[0]&0x0F == version && b[0]>>4 <= stSyn
+}
+
+// seqLess compares sequence numbers that wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+var epoch = time.Now()
+
+func nowMicro() uint32 {
+	return uint32(time.Since(epoch).Microseconds())
+}
@@ -0,0 +1,53 @@
+package utp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := &packet{
+		typ:       stData,
+		connId:    7,
+		timestamp: 1000,
+		delay:     20,
+		wnd:       1 << 16,
+		seq:       65535,
+		ack:       12,
+		sack:      []byte{0x05, 0, 0, 0},
+		payload:   []byte("payload"),
+	}
+	got, err := decodePacket(p.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.typ != p.typ || got.connId != p.connId || got.timestamp != p.timestamp || got.delay != p.delay ||
+		got.wnd != p.wnd || got.seq != p.seq || got.ack != p.ack {
+		t.Errorf("header %+v, want %+v", got, p)
+	}
+	if !bytes.Equal(got.sack, p.sack) || !bytes.Equal(got.payload, p.payload) {
+		t.Errorf("sack %x payload %q", got.sack, got.payload)
+	}
+}
+
+func TestPacketMalformed(t *testing.T) {
+	b := (&packet{typ: stState, sack: []byte{1, 2, 3, 4}}).encode()
+	// the sack extension claims more bytes than there are
+	b[headerLen+1] = 200
+	_, err := decodePacket(b)
+	if err == nil {
+		t.Error("truncated extension accepted")
+	}
+	if isPacket([]byte("d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q4:ping1:t2:aa1:y1:qe")) {
+		t.Error("DHT message taken for a uTP packet")
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) {
+		t.Error("plain order")
+	}
+	if !seqLess(65535, 0) || seqLess(0, 65535) {
+		t.Error("order across the wrap around")
+	}
+}
@@ -0,0 +1,277 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AcceptBacklog = 32
+	OtherBacklog  = 256 // packets of other protocols waiting for PacketConn
+)
+
+type connKey struct {
+	addr string
+	id   uint16 // the recvId of the connection
+}
+
+type otherPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// Socket multiplexes uTP connections over one UDP socket, packets that are
+// not uTP, e.g. DHT messages, are handed to PacketConn
+type Socket struct {
+	pc        net.PacketConn
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	accept    chan *Conn
+	other     chan otherPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a UDP socket on addr, e.g. ":6881"
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP on an existing socket, it is closed with the Socket
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:     pc,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, AcceptBacklog),
+		other:  make(chan otherPacket, OtherBacklog),
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		if !isPacket(b) {
+			select {
+			case s.other <- otherPacket{b, addr}:
+			default:
+			}
+			continue
+		}
+		p, err := decodePacket(b)
+		if err != nil {
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		s.dispatch(p, udpAddr)
+	}
+}
+
+func (s *Socket) dispatch(p *packet, addr *net.UDPAddr) {
+	key := connKey{addr.String(), p.connId}
+	if p.typ == stSyn {
+		key.id = p.connId + 1
+	}
+	s.mu.Lock()
+	c := s.conns[key]
+	if c == nil && p.typ == stSyn {
+		c = newConn(s, addr, p.connId+1, p.connId)
+		c.state = stateConnected
+		c.isn = uint16(rand.Intn(1 << 16))
+		c.seq = c.isn
+		c.ack = p.seq
+		close(c.established)
+		select {
+		case s.accept <- c:
+			s.conns[key] = c
+			go c.run()
+		default:
+			// nobody accepts, the peer retries
+			c = nil
+		}
+	}
+	s.mu.Unlock()
+	if c != nil {
+		c.handle(p)
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) writeTo(b []byte, addr net.Addr) {
+	s.pc.WriteTo(b, addr)
+}
+
+// Dial opens a uTP connection to addr, host:port
+func (s *Socket) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	var c *Conn
+	for {
+		id := uint16(rand.Intn(1 << 16))
+		key := connKey{raddr.String(), id}
+		_, used := s.conns[key]
+		_, usedNext := s.conns[connKey{raddr.String(), id + 1}]
+		if !used && !usedNext {
+			c = newConn(s, raddr, id, id+1)
+			s.conns[key] = c
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.seq = 1
+	c.queue(&packet{typ: stSyn})
+	c.mu.Unlock()
+	go c.run()
+
+	select {
+	case <-c.established:
+		return c, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.fail(ctx.Err())
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Accept returns the next inbound connection, Socket is a net.Listener
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the UDP socket and every connection on it
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// PacketConn returns the packets of other protocols sharing the socket, it
+// is meant for a single reader such as dht.Config.Conn
+func (s *Socket) PacketConn() net.PacketConn {
+	return &packetConn{s: s}
+}
+
+type packetConn struct {
+	s        *Socket
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pc.mu.Lock()
+	deadline := pc.deadline
+	pc.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case op := <-pc.s.other:
+		return copy(b, op.b), op.addr, nil
+	case <-pc.s.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return pc.s.pc.WriteTo(b, addr)
+}
+
+// Close leaves the socket open, it belongs to the Socket
+func (pc *packetConn) Close() error {
+	return nil
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return pc.s.Addr()
+}
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	return pc.SetReadDeadline(t)
+}
+
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.deadline = t
+	return nil
+}
+
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package utp
+
+import (
+	"context"
+	"go-torrent/dht"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestSocketOtherPackets(t *testing.T) {
+	s, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	o, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	msg := "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q4:ping1:t2:aa1:y1:qe"
+	o.WriteTo([]byte(msg), s.Addr())
+	pc := s.PacketConn()
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != msg {
+		t.Errorf("got %q", buf[:n])
+	}
+}
+
+func TestSocketSharedWithDHT(t *testing.T) {
+	a, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	da, err := dht.New(dht.Config{Conn: a.PacketConn(), BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer da.Close()
+	db, err := dht.New(dht.Config{Conn: b.PacketConn(), BootstrapNodes: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = da.Ping(context.Background(), netip.MustParseAddrPort(b.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := b.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hi"))
+		c.Close()
+	}()
+	c, err := a.Dial(context.Background(), b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 2)
+	_, err = c.Read(buf)
+	if err != nil || string(buf) != "hi" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+}